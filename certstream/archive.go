@@ -0,0 +1,418 @@
+package certstream
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// archiveFileLimit bounds PEM and DER files, which are read whole
+const archiveFileLimit = 64 * 1024 * 1024
+
+// ListArchiveFiles expands paths into the files below them, walking directories
+// recursively and skipping hidden files and directories. Files are returned in
+// lexical order per directory.
+func ListArchiveFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != path && strings.HasPrefix(entry.Name(), ".") {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.Type().IsRegular() {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", path, err)
+		}
+	}
+	return files, nil
+}
+
+// archiveQueue hands out files to the archive sources sharing it
+type archiveQueue struct {
+	files  []string
+	next   atomic.Int64
+	failed atomic.Int64
+}
+
+func (q *archiveQueue) take() (string, bool) {
+	i := q.next.Add(1) - 1
+	if i >= int64(len(q.files)) {
+		return "", false
+	}
+	return q.files[i], true
+}
+
+// ArchiveSource is a Source reading certificates from files, one file at a time:
+//
+//   - NDJSON CertStream messages, including capture files written by a Recorder
+//   - CT log entries as returned by get-entries, one per line or as whole responses
+//   - PEM files with one or more certificates
+//   - DER certificates
+//
+// Any of them may be gzip-compressed. JSON files are streamed, so their size is not
+// limited by memory. Files that cannot be read are logged and skipped. The source
+// returns io.EOF once every file has been read.
+type ArchiveSource struct {
+	name   string
+	queue  *archiveQueue
+	logger Logger
+
+	mu      sync.Mutex // guards reader, which Close may release during Next
+	reader  *archiveReader
+	current atomic.Value // path of the file being read
+	health  sourceHealth
+}
+
+// NewArchiveSource creates a source reading the given files in order
+func NewArchiveSource(files ...string) *ArchiveSource {
+	return NewArchiveSources(files, 1)[0].(*ArchiveSource)
+}
+
+// NewArchiveSources creates parallel sources sharing the given files, each taking the
+// next unread file when done with one. Use ListArchiveFiles to expand directories.
+func NewArchiveSources(files []string, parallel int) []Source {
+	if parallel < 1 {
+		parallel = 1
+	}
+	queue := &archiveQueue{files: files}
+	sources := make([]Source, parallel)
+	for i := range sources {
+		name := "archive"
+		if parallel > 1 {
+			name = fmt.Sprintf("archive-%d", i+1)
+		}
+		source := &ArchiveSource{name: name, queue: queue, logger: NewDefaultLogger(false)}
+		source.current.Store("")
+		sources[i] = source
+	}
+	return sources
+}
+
+// Name returns the source name
+func (s *ArchiveSource) Name() string {
+	return s.name
+}
+
+// SetLogger sets the logger used for skipped files and entries
+func (s *ArchiveSource) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// Start does nothing; files are opened by Next
+func (s *ArchiveSource) Start(ctx context.Context) error {
+	s.health.connected()
+	return nil
+}
+
+// Next returns the next certificate as a CertStream message, moving on to the next
+// file at the end of the current one
+func (s *ArchiveSource) Next(ctx context.Context) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if s.reader == nil {
+			path, ok := s.queue.take()
+			if !ok {
+				s.current.Store("")
+				return nil, io.EOF
+			}
+			s.current.Store(path)
+			reader, err := openArchive(path, s.logger)
+			if err != nil {
+				s.skip(path, err)
+				continue
+			}
+			s.reader = reader
+		}
+
+		data, err := s.reader.next()
+		if err == nil {
+			s.health.received()
+			return data, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			s.skip(s.reader.path, err)
+		}
+		s.reader.close()
+		s.reader = nil
+	}
+}
+
+// skip logs a file, or the rest of it, that could not be read
+func (s *ArchiveSource) skip(path string, err error) {
+	s.queue.failed.Add(1)
+	s.health.failed(err)
+	s.logger.Error("Skipping %s: %v", path, err)
+}
+
+// Close closes the file being read; a restarted source continues with the next file
+func (s *ArchiveSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader != nil {
+		s.reader.close()
+		s.reader = nil
+	}
+	s.health.disconnected()
+	return nil
+}
+
+// Health reports the file being read and the progress over all files
+func (s *ArchiveSource) Health() SourceHealth {
+	health := s.health.get()
+	taken := s.queue.next.Load()
+	if taken > int64(len(s.queue.files)) {
+		taken = int64(len(s.queue.files))
+	}
+	health.Detail = fmt.Sprintf("file %d/%d", taken, len(s.queue.files))
+	if failed := s.queue.failed.Load(); failed > 0 {
+		health.Detail += fmt.Sprintf(", %d skipped", failed)
+	}
+	if current := s.current.Load().(string); current != "" {
+		health.Detail += ", reading " + current
+	}
+	return health
+}
+
+// archiveReader yields the messages of one file
+type archiveReader struct {
+	path    string
+	logger  Logger
+	file    *os.File
+	gz      *gzip.Reader
+	next    func() ([]byte, error)
+	pending [][]byte // messages of a CT get-entries response not yet returned
+}
+
+// openArchive opens a file and detects its format from the first bytes
+func openArchive(path string, logger Logger) (*archiveReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &archiveReader{path: path, logger: logger, file: file}
+
+	var input io.Reader = bufio.NewReader(file)
+	if magic, _ := input.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if r.gz, err = gzip.NewReader(input); err != nil {
+			file.Close()
+			return nil, err
+		}
+		input = bufio.NewReader(r.gz)
+	}
+	buffered := input.(*bufio.Reader)
+
+	start, err := firstNonSpace(buffered)
+	switch {
+	case errors.Is(err, io.EOF):
+		r.next = func() ([]byte, error) { return nil, io.EOF }
+	case err != nil:
+		r.close()
+		return nil, err
+	case start == '{' || start == '[':
+		r.next = r.jsonMessages(json.NewDecoder(buffered), start == '[')
+	default:
+		data, err := io.ReadAll(io.LimitReader(buffered, archiveFileLimit+1))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		if len(data) > archiveFileLimit {
+			r.close()
+			return nil, fmt.Errorf("larger than %d bytes", archiveFileLimit)
+		}
+		certs, err := parseCertificateFile(data)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.next = func() ([]byte, error) {
+			if len(certs) == 0 {
+				return nil, io.EOF
+			}
+			cert := certs[0]
+			certs = certs[1:]
+			return r.certificateMessage(cert, "X509LogEntry")
+		}
+	}
+	return r, nil
+}
+
+// firstNonSpace returns the first byte that is not white space, without consuming it
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+// parseCertificateFile parses PEM certificates, or DER certificates when the data is not PEM
+func parseCertificateFile(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("neither JSON, PEM nor DER: %w", err)
+		}
+		return certs, nil
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no CERTIFICATE blocks in PEM file")
+	}
+	return certs, nil
+}
+
+// archiveValue is the union of the JSON values accepted in archives
+type archiveValue struct {
+	MessageType string          `json:"message_type"`
+	Message     json.RawMessage `json:"message"` // capture record
+	Raw         []byte          `json:"raw"`     // capture record holding invalid JSON
+	LeafInput   []byte          `json:"leaf_input"`
+	ExtraData   []byte          `json:"extra_data"`
+	Entries     []ctLogEntry    `json:"entries"`
+}
+
+// jsonMessages returns a reader of a stream of JSON values, such as NDJSON, or of the
+// elements of a top-level array
+func (r *archiveReader) jsonMessages(decoder *json.Decoder, array bool) func() ([]byte, error) {
+	started := false
+	return func() ([]byte, error) {
+		for {
+			if len(r.pending) > 0 {
+				data := r.pending[0]
+				r.pending = r.pending[1:]
+				return data, nil
+			}
+
+			if array {
+				if !started {
+					if _, err := decoder.Token(); err != nil {
+						return nil, err
+					}
+					started = true
+				}
+				if !decoder.More() {
+					return nil, io.EOF
+				}
+			}
+
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return nil, err
+			}
+			data, err := r.message(raw)
+			if err != nil {
+				return nil, err
+			}
+			if data != nil {
+				return data, nil
+			}
+		}
+	}
+}
+
+// message converts one JSON value into a CertStream message, or returns nil for values
+// without one. The entries of a get-entries response are queued. Values that are not
+// understood are skipped, as in CT log sources.
+func (r *archiveReader) message(raw json.RawMessage) ([]byte, error) {
+	var value archiveValue
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	switch {
+	case value.Message != nil:
+		return value.Message, nil
+	case value.Raw != nil:
+		return value.Raw, nil
+	case value.MessageType != "":
+		return raw, nil
+	case value.LeafInput != nil:
+		return r.entryMessage(ctLogEntry{LeafInput: value.LeafInput, ExtraData: value.ExtraData}), nil
+	case value.Entries != nil:
+		for _, entry := range value.Entries {
+			if data := r.entryMessage(entry); data != nil {
+				r.pending = append(r.pending, data)
+			}
+		}
+		return nil, nil
+	}
+	r.logger.Debug("%s: skipping JSON value that is neither a CertStream message nor a CT log entry", r.path)
+	return nil, nil
+}
+
+// entryMessage converts a CT log entry, or returns nil when it cannot be parsed
+func (r *archiveReader) entryMessage(entry ctLogEntry) []byte {
+	cert, updateType, err := parseLogEntry(entry)
+	if err != nil {
+		r.logger.Debug("%s: skipping CT log entry: %v", r.path, err)
+		return nil
+	}
+	data, err := r.certificateMessage(cert, updateType)
+	if err != nil {
+		r.logger.Debug("%s: skipping CT log entry: %v", r.path, err)
+		return nil
+	}
+	return data
+}
+
+// certificateMessage encodes a certificate read from the file as a CertStream message
+func (r *archiveReader) certificateMessage(cert *x509.Certificate, updateType string) ([]byte, error) {
+	data := certDataFromX509(cert, updateType)
+	data.Data.Source.Name = r.path
+	return json.Marshal(data)
+}
+
+func (r *archiveReader) close() {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	r.file.Close()
+}
@@ -0,0 +1,440 @@
+package certstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackpressurePolicy decides what a stage does with a message that does not fit in
+// its full queue
+type BackpressurePolicy string
+
+// Backpressure policies accepted by WithRawBackpressure and WithEventBackpressure
+const (
+	// BackpressureDropNewest drops the message that does not fit (default)
+	BackpressureDropNewest BackpressurePolicy = "drop-newest"
+	// BackpressureDropOldest drops the oldest queued message to make room
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest"
+	// BackpressureBlock waits for room, up to the timeout, then drops the message
+	BackpressureBlock BackpressurePolicy = "block"
+	// BackpressureSpill appends the message to a spill file, from which it is queued
+	// again in order as soon as there is room
+	BackpressureSpill BackpressurePolicy = "spill"
+)
+
+// DefaultSpillLimit is the default size in bytes of the records a spill file may hold
+const DefaultSpillLimit = 1 << 30
+
+// Backpressure configures how one stage of the monitor handles a full queue. Blocking
+// and spilling are reserved for traffic that may match the watch list: when the raw
+// queue is full, messages the prefilter rules out are dropped as with drop-newest, so
+// the unfiltered firehose never delays or takes disk space from candidate matches. With
+// an empty watch list every message counts as a candidate.
+type Backpressure struct {
+	Policy     BackpressurePolicy
+	Timeout    time.Duration // Longest wait of the block policy before dropping; 0 waits until the monitor stops
+	SpillDir   string        // Directory of the spill file (default: os.TempDir())
+	SpillLimit int64         // Size in bytes of the records the spill file may hold before dropping (default: DefaultSpillLimit)
+}
+
+// ParseBackpressure parses a policy followed by optional settings separated by
+// semicolons, such as "block; timeout=5s" or "spill; dir=/var/spool/certstream; limit=512MB"
+func ParseBackpressure(s string) (Backpressure, error) {
+	parts := strings.Split(s, ";")
+	b := Backpressure{Policy: BackpressurePolicy(strings.ToLower(strings.TrimSpace(parts[0])))}
+	for _, setting := range parts[1:] {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if !found {
+			return Backpressure{}, fmt.Errorf("backpressure %q: setting %q is not key=value", s, setting)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil {
+				return Backpressure{}, fmt.Errorf("backpressure %q: invalid timeout %q", s, value)
+			}
+			b.Timeout = timeout
+		case "dir":
+			b.SpillDir = value
+		case "limit":
+			limit, err := parseByteSize(value)
+			if err != nil {
+				return Backpressure{}, fmt.Errorf("backpressure %q: invalid limit %q", s, value)
+			}
+			b.SpillLimit = limit
+		default:
+			return Backpressure{}, fmt.Errorf("backpressure %q: unknown setting %q", s, key)
+		}
+	}
+
+	if err := b.Validate(); err != nil {
+		return Backpressure{}, err
+	}
+	return b, nil
+}
+
+// Validate checks the policy and that its settings are not negative. An empty policy
+// stands for drop-newest.
+func (b Backpressure) Validate() error {
+	switch b.Policy {
+	case "", BackpressureDropNewest, BackpressureDropOldest, BackpressureBlock, BackpressureSpill:
+	default:
+		return fmt.Errorf("backpressure policy must be %s, %s, %s or %s, got %q",
+			BackpressureDropNewest, BackpressureDropOldest, BackpressureBlock, BackpressureSpill, b.Policy)
+	}
+	if b.Timeout < 0 {
+		return fmt.Errorf("backpressure timeout must not be negative, got %v", b.Timeout)
+	}
+	if b.SpillLimit < 0 {
+		return fmt.Errorf("backpressure spill limit must not be negative, got %d", b.SpillLimit)
+	}
+	return nil
+}
+
+// parseByteSize parses a byte count with an optional KB, MB or GB suffix (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("not a byte size")
+	}
+	return n * multiplier, nil
+}
+
+// stage is a queue between two parts of the monitor applying a backpressure policy
+type stage[T any] struct {
+	name    string
+	ch      chan T
+	config  Backpressure
+	spill   *spillFile // nil unless the policy is spill
+	encode  func(T) ([]byte, error)
+	decode  func([]byte) (T, error)
+	logger  Logger
+	onDrop  func(T)       // called with the items dropped or evicted, if set
+	dropped atomic.Uint64 // messages dropped, including those evicted by drop-oldest
+	spilled atomic.Uint64 // messages written to the spill file
+	failed  atomic.Uint64 // messages that could not be spilled
+}
+
+func newStage[T any](name string, size int, config Backpressure, logger Logger, encode func(T) ([]byte, error), decode func([]byte) (T, error)) *stage[T] {
+	if err := config.Validate(); err != nil {
+		logger.Error("Ignoring %s backpressure: %v", name, err)
+		config = Backpressure{}
+	}
+	if config.Policy == "" {
+		config.Policy = BackpressureDropNewest
+	}
+	s := &stage[T]{name: name, ch: make(chan T, size), config: config, encode: encode, decode: decode, logger: logger}
+	if config.Policy == BackpressureSpill {
+		limit := config.SpillLimit
+		if limit == 0 {
+			limit = DefaultSpillLimit
+		}
+		s.spill = &spillFile{dir: config.SpillDir, limit: limit, ready: make(chan struct{}, 1)}
+	}
+	return s
+}
+
+// push queues an item, applying the policy when the queue is full. candidate is only
+// called then; items that are not candidates are dropped instead of blocking or
+// spilling. push reports whether the item was queued or spilled.
+func (s *stage[T]) push(item T, candidate func() bool, done <-chan struct{}) bool {
+	// Spilled items go first, so nothing overtakes them
+	if s.spill == nil || s.spill.pending() == 0 {
+		select {
+		case s.ch <- item:
+			return true
+		default:
+		}
+	}
+
+	policy := s.config.Policy
+	if (policy == BackpressureBlock || policy == BackpressureSpill) && candidate != nil && !candidate() {
+		policy = BackpressureDropNewest
+	}
+
+	switch policy {
+	case BackpressureDropOldest:
+		for {
+			select {
+			case s.ch <- item:
+				return true
+			default:
+			}
+			select {
+			case evicted := <-s.ch:
+				s.dropped.Add(1)
+				if s.onDrop != nil {
+					s.onDrop(evicted)
+				}
+			default:
+			}
+		}
+
+	case BackpressureBlock:
+		var timeout <-chan time.Time
+		if s.config.Timeout > 0 {
+			timer := time.NewTimer(s.config.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case s.ch <- item:
+			return true
+		case <-timeout:
+		case <-done:
+		}
+
+	case BackpressureSpill:
+		data, err := s.encode(item)
+		if err == nil {
+			err = s.spill.append(data)
+		}
+		if err == nil {
+			s.spilled.Add(1)
+			return true
+		}
+		if failed := s.failed.Add(1); failed%1000 == 1 {
+			s.logger.Error("Failed to spill %s queue: %v", s.name, err)
+		}
+	}
+
+	s.dropped.Add(1)
+	if s.onDrop != nil {
+		s.onDrop(item)
+	}
+	return false
+}
+
+// feed queues spilled items again, oldest first, until done is closed. Items still in
+// the spill file when the monitor stops are fed after the next Start.
+func (s *stage[T]) feed(done <-chan struct{}) {
+	for {
+		data, err := s.spill.peek()
+		switch {
+		case errors.Is(err, io.EOF):
+			select {
+			case <-s.spill.ready:
+				continue
+			case <-done:
+				return
+			}
+		case err != nil:
+			s.logger.Error("Discarding %s spill file: %v", s.name, err)
+			s.dropped.Add(uint64(s.spill.reset()))
+			continue
+		}
+
+		item, err := s.decode(data)
+		if err != nil {
+			s.logger.Debug("Dropping unreadable spilled %s item: %v", s.name, err)
+			s.dropped.Add(1)
+			s.spill.pop()
+			continue
+		}
+		select {
+		case s.ch <- item:
+			s.spill.pop()
+		case <-done:
+			return
+		}
+	}
+}
+
+// spillFile is a FIFO of length-prefixed records in an unlinked temporary file, so it
+// disappears with the process. Records are appended by pushers and read by one feeder,
+// which removes a record only once it was queued.
+type spillFile struct {
+	dir   string
+	limit int64
+	ready chan struct{} // signalled after an append
+
+	mu      sync.Mutex
+	file    *os.File
+	readAt  int64 // offset of the oldest record
+	writeAt int64 // end of the file
+	count   int   // records not yet removed
+	err     error // failed compaction, reported by peek until reset
+}
+
+// spillHeaderSize is the size of the record length prefix
+const spillHeaderSize = 4
+
+// spillCompactSize is how large the consumed prefix of a spill file grows before it
+// is reclaimed, once it is also larger than the records left
+const spillCompactSize = 1 << 20
+
+func (f *spillFile) pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count
+}
+
+// append adds a record, creating the file on first use
+func (f *spillFile) append(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		file, err := os.CreateTemp(f.dir, "certstream-spill-*")
+		if err != nil {
+			return err
+		}
+		// Without a name the file goes away when closed or when the process exits
+		os.Remove(file.Name())
+		f.file = file
+	}
+	size := int64(spillHeaderSize + len(data))
+	if f.writeAt-f.readAt+size > f.limit {
+		return fmt.Errorf("spill file reached its limit of %d bytes", f.limit)
+	}
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[spillHeaderSize:], data)
+	if _, err := f.file.WriteAt(record, f.writeAt); err != nil {
+		return err
+	}
+	f.writeAt += size
+	f.count++
+
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the oldest record, or io.EOF when there is none
+func (f *spillFile) peek() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.count == 0 {
+		return nil, io.EOF
+	}
+	var header [spillHeaderSize]byte
+	if _, err := f.file.ReadAt(header[:], f.readAt); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := f.file.ReadAt(data, f.readAt+spillHeaderSize); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pop removes the oldest record, truncating the file once it is empty
+func (f *spillFile) pop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var header [spillHeaderSize]byte
+	if _, err := f.file.ReadAt(header[:], f.readAt); err != nil {
+		return
+	}
+	f.readAt += spillHeaderSize + int64(binary.BigEndian.Uint32(header[:]))
+	f.count--
+	if f.count == 0 {
+		f.truncate()
+		return
+	}
+
+	// Reclaim the consumed prefix once it dominates the file, so a backlog that never
+	// empties does not grow the file without limit
+	if f.readAt > spillCompactSize && f.readAt > f.writeAt/2 {
+		if err := f.compact(); err != nil {
+			f.err = fmt.Errorf("failed to compact spill file: %w", err)
+		}
+	}
+}
+
+// compact moves the records left to the start of the file; f.mu must be held
+func (f *spillFile) compact() error {
+	buf := make([]byte, 64*1024)
+	var dst int64
+	for src := f.readAt; src < f.writeAt; {
+		n := min(int64(len(buf)), f.writeAt-src)
+		if _, err := f.file.ReadAt(buf[:n], src); err != nil {
+			return err
+		}
+		if _, err := f.file.WriteAt(buf[:n], dst); err != nil {
+			return err
+		}
+		src += n
+		dst += n
+	}
+	f.readAt, f.writeAt = 0, dst
+	return f.file.Truncate(dst)
+}
+
+// reset discards every record, returning how many there were
+func (f *spillFile) reset() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := f.count
+	f.count, f.err = 0, nil
+	f.truncate()
+	return count
+}
+
+// truncate empties the file; f.mu must be held
+func (f *spillFile) truncate() {
+	f.readAt, f.writeAt = 0, 0
+	if f.file != nil {
+		f.file.Truncate(0)
+	}
+}
+
+// spilledEvent is the spill file encoding of an event. The parsed certificate is not
+// encoded but parsed again from the DER when the event is read back.
+type spilledEvent struct {
+	CertEvent
+	ParsedDER bool `json:"parsed_der,omitempty"`
+}
+
+func encodeEvent(event CertEvent) ([]byte, error) {
+	spilled := spilledEvent{CertEvent: event, ParsedDER: event.X509 != nil}
+	spilled.X509 = nil
+	return json.Marshal(spilled)
+}
+
+func decodeEvent(data []byte) (CertEvent, error) {
+	var spilled spilledEvent
+	if err := json.Unmarshal(data, &spilled); err != nil {
+		return CertEvent{}, err
+	}
+	event := spilled.CertEvent
+	if spilled.ParsedDER {
+		event.X509, _ = event.Certificate.ParseDER()
+	}
+	return event, nil
+}
+
+func encodeRaw(data []byte) ([]byte, error) { return data, nil }
+
+func decodeRaw(data []byte) ([]byte, error) { return data, nil }
@@ -1,6 +1,35 @@
 package certstream
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
 
 func TestIsDomainMatch(t *testing.T) {
 	tests := []struct {
@@ -23,3 +52,2206 @@ func TestIsDomainMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestIsDomainMatchPattern(t *testing.T) {
+	tests := []struct {
+		certDomain  string
+		watchDomain string
+		want        bool
+	}{
+		{"www.login.nhn.no", "*.login.nhn.*", true},
+		{"a.b.login.nhn.no", "*.login.nhn.*", false},
+		{"vpn-oslo.example.com", "vpn-*.example.com", true},
+		{"vpn.example.com", "vpn-*.example.com", false},
+		{"www.example.com", "*.example.com", true},
+		{"a.www.example.com", "*.example.com", false},
+		{"example.com", "*.example.com", false},
+		{"a.www.example.com", "**.example.com", true},
+		{"web1.example.com", "web?.example.com", true},
+		{"web10.example.com", "web?.example.com", false},
+		{"WWW.Example.COM", "*.example.com", true},
+	}
+	for _, tt := range tests {
+		if got := IsDomainMatch(tt.certDomain, tt.watchDomain); got != tt.want {
+			t.Errorf("IsDomainMatch(%q,%q) = %v; want %v", tt.certDomain, tt.watchDomain, got, tt.want)
+		}
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		input   string
+		literal string
+		wantErr bool
+	}{
+		{"nhn.no", "nhn.no", false},
+		{"NHN.no.", "nhn.no", false},
+		{"*.login.nhn.*", ".login.nhn.", false},
+		{"vpn-*.example.com", ".example.com", false},
+		{"*.*", ".", false},
+		{"**", "", false},
+		{"", "", true},
+		{"a..b", "", true},
+		{"a**.example.com", "", true},
+		{"exa mple.com", "", true},
+	}
+	for _, tt := range tests {
+		pattern, err := ParsePattern(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePattern(%q) error = %v; wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && pattern.Literal() != tt.literal {
+			t.Errorf("ParsePattern(%q).Literal() = %q; want %q", tt.input, pattern.Literal(), tt.literal)
+		}
+	}
+}
+
+func TestProcessCertificateReportsPattern(t *testing.T) {
+	monitor := New(WithDomains([]string{"*.login.nhn.*", "example.org"}))
+
+	payload := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.login.nhn.no","other.com"]}}}`)
+	monitor.processCertificate(payload)
+
+	select {
+	case event := <-monitor.Events():
+		if len(event.MatchedDomains) != 1 || event.MatchedDomains[0] != "*.login.nhn.*" {
+			t.Fatalf("MatchedDomains = %v; want [*.login.nhn.*]", event.MatchedDomains)
+		}
+		if len(event.Matches) != 1 || event.Matches[0].Domain != "www.login.nhn.no" {
+			t.Fatalf("Matches = %+v; want www.login.nhn.no", event.Matches)
+		}
+	default:
+		t.Fatal("expected an event")
+	}
+
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["nhn.no"]}}}`))
+	if stats := monitor.Stats(); stats.PrefilterSkips != 1 {
+		t.Errorf("PrefilterSkips = %d; want 1", stats.PrefilterSkips)
+	}
+}
+
+func TestRegexRuleLiterals(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{`^(secure|login|verify)[-.].*nhn`, []string{"secure", "login", "verify"}},
+		{`nhn\.no$`, []string{"nhn.no"}},
+		{`(?i)HelseNorge`, []string{"helsenorge"}},
+		{`^a+bc`, []string{"bc"}},
+		{`^.*$`, nil},
+		{`(login|.*)x`, []string{"x"}},
+	}
+	for _, tt := range tests {
+		rule, err := compileRegexRule(RegexRule{Name: "test", Pattern: tt.pattern})
+		if err != nil {
+			t.Fatalf("compileRegexRule(%q): %v", tt.pattern, err)
+		}
+		if len(rule.literals) != len(tt.want) {
+			t.Errorf("literals(%q) = %q; want %q", tt.pattern, rule.literals, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if rule.literals[i] != tt.want[i] {
+				t.Errorf("literals(%q) = %q; want %q", tt.pattern, rule.literals, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRegexRuleValidate(t *testing.T) {
+	if err := (RegexRule{Name: "ok", Pattern: `^login\.`}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (RegexRule{Name: "bad", Pattern: `(`}).Validate(); err == nil {
+		t.Error("expected error for invalid expression")
+	}
+	if err := (RegexRule{Pattern: `login`}).Validate(); err == nil {
+		t.Error("expected error for unnamed rule")
+	}
+}
+
+func TestProcessCertificateRegexRule(t *testing.T) {
+	monitor := New(WithRegexRules([]RegexRule{{Name: "phish", Pattern: `^(secure|login|verify)[-.].*nhn`}}))
+
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.example.com","Login-NHN.example.com"]}}}`))
+	select {
+	case event := <-monitor.Events():
+		if len(event.MatchedDomains) != 1 || event.MatchedDomains[0] != "regex:phish" {
+			t.Fatalf("MatchedDomains = %v; want [regex:phish]", event.MatchedDomains)
+		}
+		if len(event.Matches) != 1 || event.Matches[0].Rule != "phish" || event.Matches[0].Domain != "Login-NHN.example.com" {
+			t.Fatalf("Matches = %+v", event.Matches)
+		}
+	default:
+		t.Fatal("expected an event")
+	}
+
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["nhn.no"]}}}`))
+	if stats := monitor.Stats(); stats.PrefilterSkips != 1 || stats.CertsDecoded != 1 {
+		t.Errorf("stats = %+v; want one prefilter skip and one decode", stats)
+	}
+}
+
+func TestProcessCertificateKeepsEveryKey(t *testing.T) {
+	monitor := New(
+		WithDomains([]string{"nhn.no", "*.login.nhn.*"}),
+		WithRegexRules([]RegexRule{{Name: "phish", Pattern: `^login\.`}}),
+		WithKeywordRules([]KeywordRule{{Term: "portal"}}),
+	)
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["login.nhn.no","portal.login.nhn.no"]}}}`))
+	event := <-monitor.Events()
+	if len(event.Matches) != 2 {
+		t.Fatalf("Matches = %+v", event.Matches)
+	}
+	// Both watch entries fired for the one SAN; the reported pattern comes first
+	if got := strings.Join(event.Matches[0].Keys, ","); event.Matches[0].Key() != "nhn.no" || got != "nhn.no,regex:phish" {
+		t.Errorf("login.nhn.no: Key = %s, Keys = %s", event.Matches[0].Key(), got)
+	}
+	if got := strings.Join(event.Matches[1].Keys, ","); got != "nhn.no,*.login.nhn.*,keyword:portal" {
+		t.Errorf("portal.login.nhn.no: Keys = %s", got)
+	}
+}
+
+func TestLookalikeScore(t *testing.T) {
+	tests := []struct {
+		certDomain string
+		watch      string
+		lookalike  bool
+	}{
+		{"nhn-no.com", "nhn.no", true},
+		{"nhhn.no", "nhn.no", true},
+		{"nhn.no.secure-login.xyz", "nhn.no", true},
+		{"nhn.com", "nhn.no", true},
+		{"hnn.no", "nhn.no", true},
+		{"login-nhn.com", "nhn.no", true},
+		{"helsenorg.no", "helsenorge.no", true},
+		{"he1senorge.no", "helsenorge.no", true},
+		{"nhn.no", "nhn.no", false},
+		{"www.nhn.no", "nhn.no", false},
+		{"nan.no", "nhn.no", false},
+		{"ntnu.no", "nhn.no", false},
+		{"example.com", "nhn.no", false},
+	}
+	for _, tt := range tests {
+		score := LookalikeScore(tt.certDomain, tt.watch)
+		if got := score >= DefaultLookalikeThreshold; got != tt.lookalike {
+			t.Errorf("LookalikeScore(%q,%q) = %.2f; lookalike = %v, want %v", tt.certDomain, tt.watch, score, got, tt.lookalike)
+		}
+	}
+}
+
+func TestProcessCertificateLookalike(t *testing.T) {
+	monitor := New(WithDomains([]string{"lookalike:nhn.no"}))
+
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no","nhhn.no","example.com"]}}}`))
+	select {
+	case event := <-monitor.Events():
+		if len(event.Matches) != 2 {
+			t.Fatalf("Matches = %+v; want 2", event.Matches)
+		}
+		if event.Matches[0].Kind != MatchKindSubdomain || event.Matches[0].Score != 1 {
+			t.Errorf("first match = %+v; want subdomain", event.Matches[0])
+		}
+		if event.Matches[1].Kind != MatchKindLookalike || event.Matches[1].Domain != "nhhn.no" || event.Matches[1].Score >= 1 {
+			t.Errorf("second match = %+v; want lookalike nhhn.no", event.Matches[1])
+		}
+		if len(event.MatchedDomains) != 1 || event.MatchedDomains[0] != "lookalike:nhn.no" {
+			t.Errorf("MatchedDomains = %v", event.MatchedDomains)
+		}
+	default:
+		t.Fatal("expected an event")
+	}
+}
+
+func TestDecodeIDN(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"www.xn--80ak6aa92e.com", "www.аррӏе.com"},
+		{"XN--NN-4WC.no", "nһn.no"},
+		{"plain.example.com", "plain.example.com"},
+	}
+	for _, tt := range tests {
+		got, err := DecodeIDN(tt.input)
+		if err != nil {
+			t.Fatalf("DecodeIDN(%q): %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("DecodeIDN(%q) = %q; want %q", tt.input, got, tt.want)
+		}
+	}
+
+	if _, err := DecodeIDN("xn--a-ecp!.com"); err == nil {
+		t.Error("expected error for invalid punycode")
+	}
+	if got := ToUnicode("xn--a-ecp!.com"); got != "xn--a-ecp!.com" {
+		t.Errorf("ToUnicode should return invalid input unchanged, got %q", got)
+	}
+
+	// A long run of large digits must not wrap around
+	if _, err := DecodeIDN("xn--99999999999999a.com"); err == nil || !strings.Contains(err.Error(), "overflow") {
+		t.Errorf("DecodeIDN with an overflowing delta = %v; want an overflow error", err)
+	}
+}
+
+func FuzzDecodeIDN(f *testing.F) {
+	for _, seed := range []string{"xn--bcher-kva.example", "www.xn--80ak6aa92e.com", "xn--bbbbbbbbbba", "xn--99999999999a", "xn--a-ecp!"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, domain string) {
+		decoded, err := DecodeIDN(domain)
+		if err != nil {
+			return
+		}
+		if utf8.ValidString(domain) && !utf8.ValidString(decoded) {
+			t.Errorf("DecodeIDN(%q) = %q, not valid UTF-8", domain, decoded)
+		}
+		for _, r := range decoded {
+			if r == utf8.RuneError && !strings.ContainsRune(domain, utf8.RuneError) {
+				t.Errorf("DecodeIDN(%q) = %q, with an invalid code point", domain, decoded)
+			}
+		}
+	})
+}
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"xn--80ak6aa92e.com", "apple.com"},
+		{"xn--nn-4wc.no", "nhn.no"},
+		{"xn--nh-ded.no", "nhn.no"},
+		{"rnicrosoft.com", "microsoft.com"},
+		{"ｎｈｎ.no", "nhn.no"},
+		{"hélsenorge.no", "helsenorge.no"},
+	}
+	for _, tt := range tests {
+		if Skeleton(tt.a) != Skeleton(tt.b) {
+			t.Errorf("Skeleton(%q) = %q, Skeleton(%q) = %q; want equal", tt.a, Skeleton(tt.a), tt.b, Skeleton(tt.b))
+		}
+	}
+	if Skeleton("nhn.no") == Skeleton("nbn.no") {
+		t.Error("distinct domains should not share a skeleton")
+	}
+}
+
+func TestProcessCertificateHomoglyph(t *testing.T) {
+	payload := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["login.xn--nn-4wc.no"]}}}`)
+
+	monitor := New(WithDomains([]string{"nhn.no"}))
+	monitor.processCertificate(payload)
+	if len(monitor.Events()) != 0 {
+		t.Fatal("homoglyph domain should not match without homoglyph matching")
+	}
+
+	monitor = New(WithDomains([]string{"nhn.no"}), WithHomoglyphMatching(true))
+	monitor.processCertificate(payload)
+	select {
+	case event := <-monitor.Events():
+		if len(event.Matches) != 1 {
+			t.Fatalf("Matches = %+v; want 1", event.Matches)
+		}
+		match := event.Matches[0]
+		if match.Kind != MatchKindHomoglyph || match.UnicodeDomain != "login.nһn.no" || match.Pattern != "nhn.no" {
+			t.Errorf("match = %+v", match)
+		}
+	default:
+		t.Fatal("expected an event")
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"www.nhn.no", "nhn.no"},
+		{"nhn.co.uk", "nhn.co.uk"},
+		{"a.b.nhn.co.uk", "nhn.co.uk"},
+		{"WWW.Example.COM.", "example.com"},
+		{"*.nhn.no", "nhn.no"},
+		{"evil.github.io", "evil.github.io"},
+		{"foo.bar.ck", "foo.bar.ck"},
+		{"www.ck", "www.ck"},
+		{"example.unknowntld", "example.unknowntld"},
+		{"shop.nhn.co.ls", "nhn.co.ls"},
+		{"www.nhn.xn--55qx5d.cn", "nhn.xn--55qx5d.cn"},
+		{"a.b.city.kawasaki.jp", "city.kawasaki.jp"},
+		{"co.uk", ""},
+		{"no", ""},
+	}
+	for _, tt := range tests {
+		if got := RegistrableDomain(tt.domain); got != tt.want {
+			t.Errorf("RegistrableDomain(%q) = %q; want %q", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPublicSuffixList(t *testing.T) {
+	original := activeSuffixList.Load()
+	defer activeSuffixList.Store(original)
+
+	path := filepath.Join(t.TempDir(), "psl.dat")
+	if err := os.WriteFile(path, []byte("// test list\nno\nexample.no\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadPublicSuffixList(path); err != nil {
+		t.Fatalf("LoadPublicSuffixList: %v", err)
+	}
+	if got := RegistrableDomain("www.nhn.example.no"); got != "nhn.example.no" {
+		t.Errorf("RegistrableDomain with loaded list = %q; want nhn.example.no", got)
+	}
+	if err := LoadPublicSuffixList(filepath.Join(t.TempDir(), "missing.dat")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestBrandPattern(t *testing.T) {
+	tests := []struct {
+		certDomain string
+		want       bool
+	}{
+		{"nhn.no", true},
+		{"www.nhn.com", true},
+		{"login.nhn.co.uk", true},
+		{"nhn.example.com", false},
+		{"mynhn.no", false},
+	}
+	for _, tt := range tests {
+		if got := IsDomainMatch(tt.certDomain, "brand:nhn"); got != tt.want {
+			t.Errorf("IsDomainMatch(%q, brand:nhn) = %v; want %v", tt.certDomain, got, tt.want)
+		}
+	}
+	if _, err := ParsePattern("brand:nhn.no"); err == nil {
+		t.Error("expected error for multi-label brand pattern")
+	}
+}
+
+func TestAhoCorasickContains(t *testing.T) {
+	needles := [][]byte{[]byte("nhn.no"), []byte("he"), []byte("she"), []byte("hers"), []byte("example.com"), []byte("xn--")}
+	ac := newAhoCorasick(needles)
+
+	haystacks := []string{
+		"ushers", "SHE", "h", "www.NHN.no", "nhn.n", "foo.example.co", "login.XN--nn-4wc.no", "", "ahishe",
+		`{"all_domains":["mail.example.com"]}`, `{"all_domains":["mail.example.org"]}`,
+	}
+	for _, haystack := range haystacks {
+		want := false
+		for _, needle := range needles {
+			if bytesContainsFold([]byte(haystack), needle) {
+				want = true
+			}
+		}
+		if got := ac.contains([]byte(haystack)); got != want {
+			t.Errorf("contains(%q) = %v; want %v", haystack, got, want)
+		}
+	}
+}
+
+func TestPatternIndexLookup(t *testing.T) {
+	patterns := make([]Pattern, 0, 4)
+	for _, entry := range []string{"nhn.no", "www.nhn.no", "*.example.com", "brand:nhn"} {
+		pattern, err := ParsePattern(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	ix := newPatternIndex(patterns)
+
+	tests := []struct {
+		domain string
+		want   []int
+	}{
+		{"www.nhn.no", []int{0, 1, 3}},
+		{"NHN.no.", []int{0, 3}},
+		{"a.www.nhn.no", []int{0, 1, 3}},
+		{"mynhn.no", nil},
+		{"api.example.com", []int{2}},
+		{"nhn.co.uk", []int{3}},
+	}
+	for _, tt := range tests {
+		got := ix.lookup(tt.domain, nil)
+		sort.Ints(got)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) && !(len(got) == 0 && len(tt.want) == 0) {
+			t.Errorf("lookup(%q) = %v; want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+// benchmarkPayload is a typical lite-stream certificate message that matches no watch entry
+var benchmarkPayload = []byte(`{"data":{"cert_index":1234567890,"cert_link":"https://ct.googleapis.com/logs/us1/argon2025h2/ct/v1/get-entries?start=1234567890&end=1234567890","leaf_cert":{"all_domains":["shop.unrelated-store.com","www.shop.unrelated-store.com","cdn.unrelated-store.com"],"extensions":{"authorityInfoAccess":"CA Issuers - URI:http://r11.i.lencr.org/\nOCSP - URI:http://r11.o.lencr.org\n","authorityKeyIdentifier":"keyid:C5:CF:46:A4:EA:F4:C3:C0:7A:6C:95:C4:2D:B0:5E:92:2F:26:E3:B9\n","basicConstraints":"CA:FALSE","keyUsage":"Digital Signature, Key Encipherment","subjectAltName":"DNS:shop.unrelated-store.com, DNS:www.shop.unrelated-store.com, DNS:cdn.unrelated-store.com","subjectKeyIdentifier":"5B:2C:93:0F:AE:11:53:2F:9A:06:76:0F:AD:53:6E:FD:26:48:1C:6A"},"fingerprint":"9A:7B:3C:00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00","not_after":1767225600,"not_before":1759449600,"serial_number":"0345A7B1C2D3E4F5061728394A5B6C7D8E9F","signature_algorithm":"sha256, rsa","subject":{"C":null,"CN":"shop.unrelated-store.com","L":null,"O":null,"OU":null,"ST":null,"aggregated":"/CN=shop.unrelated-store.com","email_address":null},"issuer":{"C":"US","CN":"R11","L":null,"O":"Let's Encrypt","OU":null,"ST":null,"aggregated":"/C=US/CN=R11/O=Let's Encrypt","email_address":null},"is_ca":false},"seen":1759453200.123,"source":{"name":"Google 'Argon2025h2' log","url":"https://ct.googleapis.com/logs/us1/argon2025h2/"},"update_type":"X509LogEntry"},"message_type":"certificate_update"}`)
+
+// benchmarkWatchList generates n distinct customer domains
+func benchmarkWatchList(n int) []string {
+	domains := make([]string, n)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("customer%d-portal.example%d.no", i, i%97)
+	}
+	return domains
+}
+
+func BenchmarkQuickPayloadMatch(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("domains=%d", n), func(b *testing.B) {
+			monitor := New(WithDomains(benchmarkWatchList(n)))
+			b.SetBytes(int64(len(benchmarkPayload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if monitor.matcher.Load().prefilter(benchmarkPayload) {
+					b.Fatal("unexpected prefilter hit")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchDomains(b *testing.B) {
+	var cert CertData
+	if err := json.Unmarshal(benchmarkPayload, &cert); err != nil {
+		b.Fatal(err)
+	}
+	cert.Data.LeafCert.AllDomains = append(cert.Data.LeafCert.AllDomains, "login.customer5-portal.example5.no")
+
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("domains=%d", n), func(b *testing.B) {
+			monitor := New(WithDomains(benchmarkWatchList(n)))
+			matcher := monitor.matcher.Load()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if matched, _ := matcher.match(cert.Data.LeafCert.AllDomains); len(matched) != 1 {
+					b.Fatalf("matched = %v; want 1 domain", matched)
+				}
+			}
+		})
+	}
+}
+
+func TestParseExcludeRule(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ExcludeRule
+		wantErr bool
+	}{
+		{"domain=www.nhn.no; issuer.o=Let's Encrypt", ExcludeRule{Domain: "www.nhn.no", IssuerO: "Let's Encrypt"}, false},
+		{"issuer.cn = R11", ExcludeRule{IssuerCN: "R11"}, false},
+		{"san_count>100", ExcludeRule{MinSANs: 101}, false},
+		{"san_count <= 2", ExcludeRule{MaxSANs: 2}, false},
+		{"sha256=AB:CD", ExcludeRule{SHA256: "AB:CD"}, false},
+		{"san_count=0", ExcludeRule{}, true},
+		{"owner=me", ExcludeRule{}, true},
+		{"domain=a..b", ExcludeRule{}, true},
+		{" ; ", ExcludeRule{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseExcludeRule(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExcludeRule(%q) error = %v; wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseExcludeRule(%q) = %+v; want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestProcessCertificateExclusions(t *testing.T) {
+	monitor := New(
+		WithDomains([]string{"nhn.no"}),
+		WithExcludeRules([]ExcludeRule{
+			{Domain: "www.nhn.no", IssuerO: "Let's Encrypt"},
+			{SHA256: "aa:bb:cc"},
+		}),
+	)
+
+	// Renewal of a known host is dropped entirely
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"issuer":{"O":"Let's Encrypt"}}}}`))
+	// Known fingerprint is dropped
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["vpn.nhn.no"],"sha256":"AABBCC"}}}`))
+	// Other issuer is kept
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"issuer":{"O":"Sectigo"}}}}`))
+	// Excluded domain is removed but the other match survives
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no","new.nhn.no"],"issuer":{"O":"Let's Encrypt"}}}}`))
+
+	if stats := monitor.Stats(); stats.Excluded != 2 || stats.EventsSent != 2 {
+		t.Fatalf("stats = %+v; want 2 excluded and 2 sent", stats)
+	}
+	<-monitor.Events()
+	event := <-monitor.Events()
+	if len(event.Matches) != 1 || event.Matches[0].Domain != "new.nhn.no" {
+		t.Errorf("Matches = %+v; want only new.nhn.no", event.Matches)
+	}
+}
+
+func TestMonitorUpdateDomains(t *testing.T) {
+	monitor := New(WithDomains([]string{"nhn.no"}))
+	payload := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.example.org"]}}}`)
+
+	monitor.processCertificate(payload)
+	if stats := monitor.Stats(); stats.EventsSent != 0 {
+		t.Fatalf("EventsSent = %d before update; want 0", stats.EventsSent)
+	}
+
+	monitor.AddDomains("example.org", "NHN.no")
+	if got := monitor.Domains(); len(got) != 2 || got[1] != "example.org" {
+		t.Fatalf("Domains() = %v; want [nhn.no example.org]", got)
+	}
+	monitor.processCertificate(payload)
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("EventsSent = %d after AddDomains; want 1", stats.EventsSent)
+	}
+
+	monitor.RemoveDomains("example.org.")
+	if got := monitor.Domains(); len(got) != 1 || got[0] != "nhn.no" {
+		t.Fatalf("Domains() = %v; want [nhn.no]", got)
+	}
+	monitor.processCertificate(payload)
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("EventsSent = %d after RemoveDomains; want 1", stats.EventsSent)
+	}
+
+	monitor.SetDomains([]string{"*.example.*"})
+	monitor.processCertificate(payload)
+	if stats := monitor.Stats(); stats.EventsSent != 2 {
+		t.Fatalf("EventsSent = %d after SetDomains; want 2", stats.EventsSent)
+	}
+}
+
+func TestKeywordRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		domain string
+		want   bool
+	}{
+		{"helsenorge", "helsenorge-login.info", true},
+		{"helsenorge", "www.myhelsenorge.com", true},
+		{"helsenorge", "HELSENORGE.example.org", true},
+		{"helsenorge", "helse-norge.com", false},
+		{"helsenorge; boundaries=1", "myhelsenorge.com", true},
+		{"helsenorge; boundaries=1", "xhelsenorgex.com", false},
+		{"helsenorge; boundaries=2", "login-helsenorge-no.com", true},
+		{"helsenorge; boundaries=2", "myhelsenorge-login.com", false},
+		{"helsenorge; boundaries=2", "xhelsenorgex.helsenorge.net", true},
+		{"helsenorge; ignore=helsenorge.no, *.nhn.no", "www.helsenorge.no", false},
+		{"helsenorge; ignore=helsenorge.no, *.nhn.no", "helsenorge.nhn.no", false},
+		{"helsenorge; ignore=helsenorge.no, *.nhn.no", "helsenorge.no.evil.com", true},
+		{"blåbær", "xn--blbr-roah.no", true},
+	}
+
+	for _, tt := range tests {
+		rule, err := ParseKeywordRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseKeywordRule(%q): %v", tt.rule, err)
+		}
+		compiled, err := compileKeywordRule(rule)
+		if err != nil {
+			t.Fatalf("compileKeywordRule(%q): %v", tt.rule, err)
+		}
+		if got := compiled.matchDomain(tt.domain); got != tt.want {
+			t.Errorf("%q matchDomain(%q) = %v; want %v", tt.rule, tt.domain, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "helse.norge", "nhn; boundaries=3", "nhn; ignore=a..b", "nhn; color=red"} {
+		if _, err := ParseKeywordRule(invalid); err == nil {
+			t.Errorf("ParseKeywordRule(%q) succeeded; want error", invalid)
+		}
+	}
+}
+
+func TestProcessCertificateKeyword(t *testing.T) {
+	monitor := New(
+		WithDomains([]string{"nhn.no"}),
+		WithKeywordRules([]KeywordRule{{Term: "Helsenorge", Ignore: []string{"helsenorge.no"}}}),
+	)
+
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.helsenorge.no"]}}}`))
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["helsenorge-login.info","www.nhn.no"]}}}`))
+
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("EventsSent = %d; want 1", stats.EventsSent)
+	}
+	event := <-monitor.Events()
+	if len(event.MatchedDomains) != 2 || event.MatchedDomains[0] != "nhn.no" || event.MatchedDomains[1] != "keyword:helsenorge" {
+		t.Errorf("MatchedDomains = %v; want [nhn.no keyword:helsenorge]", event.MatchedDomains)
+	}
+	if len(event.Matches) != 2 || event.Matches[0].Kind != MatchKindKeyword || event.Matches[0].Rule != "helsenorge" {
+		t.Errorf("Matches = %+v; want a keyword match for helsenorge-login.info first", event.Matches)
+	}
+}
+
+func TestParseFieldRule(t *testing.T) {
+	rule, err := ParseFieldRule(`issuer.o contains "Sectigo Limited"`)
+	if err != nil {
+		t.Fatalf("ParseFieldRule: %v", err)
+	}
+	if rule != (FieldRule{Field: FieldIssuerO, Op: FieldOpContains, Value: "Sectigo Limited"}) {
+		t.Errorf("ParseFieldRule = %+v", rule)
+	}
+	if rule, err := ParseFieldRule("SAN.IP prefix 10."); err != nil || rule.Field != FieldSANIP || rule.Value != "10." {
+		t.Errorf("ParseFieldRule unquoted = %+v, %v", rule, err)
+	}
+
+	for _, invalid := range []string{"", "issuer.x contains a", "issuer.o like a", "issuer.o contains", `subject.o matches "("`, `issuer.o equals "open`} {
+		if _, err := ParseFieldRule(invalid); err == nil {
+			t.Errorf("ParseFieldRule(%q) succeeded; want error", invalid)
+		}
+	}
+}
+
+func TestFieldRuleMatchCert(t *testing.T) {
+	var cert CertData
+	payload := `{"data":{"leaf_cert":{
+		"subject":{"CN":"vpn.nhn.no","O":["Norsk Helsenett SF","NHN"],"aggregated":"/CN=vpn.nhn.no/O=Norsk Helsenett SF"},
+		"issuer":{"O":"Sectigo Limited","CN":"Sectigo RSA Domain Validation Secure Server CA"},
+		"signature_algorithm":"sha256, rsa",
+		"extensions":{"subjectAltName":"DNS:vpn.nhn.no, email:security@nhn.no, IP Address:10.1.2.3, IP Address:2001:db8::1"}},
+		"source":{"name":"Google 'Argon2026' log"}}}`
+	if err := json.Unmarshal([]byte(payload), &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`issuer.o contains "sectigo"`, true},
+		{`issuer.cn prefix "Let's Encrypt"`, false},
+		{`subject.o equals "nhn"`, true},
+		{`subject.aggregated contains "/O=Norsk Helsenett"`, true},
+		{`signature_algorithm contains "rsa"`, true},
+		{`san.email suffix "@nhn.no"`, true},
+		{`san.ip equals "2001:db8::1"`, true},
+		{`san.dns contains "@"`, false},
+		{`san matches "^10\\."`, true},
+		{`source.name contains argon`, true},
+		{`subject.cn suffix ".example.org"`, false},
+	}
+	for _, tt := range tests {
+		rule, err := ParseFieldRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseFieldRule(%q): %v", tt.rule, err)
+		}
+		compiled, _ := compileFieldRule(rule)
+		if got := compiled.matchCert(&cert); got != tt.want {
+			t.Errorf("%s matchCert = %v; want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestProcessCertificateFieldRules(t *testing.T) {
+	sectigo := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"subject":{"CN":"www.nhn.no"},"issuer":{"O":"Sectigo Limited"}}}}`)
+	letsEncrypt := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"subject":{"CN":"www.nhn.no"},"issuer":{"O":"Let's Encrypt"}}}}`)
+	other := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["shop.example.org"],"subject":{"CN":"shop.example.org"},"issuer":{"O":"Sectigo Limited"}}}}`)
+	rules := []FieldRule{{Field: FieldIssuerO, Op: FieldOpContains, Value: "sectigo"}}
+
+	// AND: the watch list and the field rule must both match
+	monitor := New(WithDomains([]string{"nhn.no"}), WithFieldRules(rules))
+	for _, payload := range [][]byte{sectigo, letsEncrypt, other} {
+		monitor.processCertificate(payload)
+	}
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("and: EventsSent = %d; want 1", stats.EventsSent)
+	}
+	event := <-monitor.Events()
+	if len(event.MatchedDomains) != 2 || event.MatchedDomains[1] != `field:issuer.o contains "sectigo"` {
+		t.Errorf("and: MatchedDomains = %v", event.MatchedDomains)
+	}
+
+	// OR: either one is enough, and field-only hits report the primary domain
+	monitor = New(WithDomains([]string{"nhn.no"}), WithFieldRules(rules), WithFieldMode(FieldModeOr))
+	for _, payload := range [][]byte{sectigo, letsEncrypt, other} {
+		monitor.processCertificate(payload)
+	}
+	if stats := monitor.Stats(); stats.EventsSent != 3 || stats.PrefilterSkips != 0 {
+		t.Fatalf("or: stats = %+v; want 3 events and no prefilter skips", stats)
+	}
+	<-monitor.Events()
+	<-monitor.Events()
+	event = <-monitor.Events()
+	if len(event.Matches) != 1 || event.Matches[0].Kind != MatchKindField || event.Matches[0].Domain != "shop.example.org" {
+		t.Errorf("or: Matches = %+v; want a field match for shop.example.org", event.Matches)
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	var cert CertData
+	payload := `{"data":{"cert_index":42,"leaf_cert":{
+		"all_domains":["www.nhn.no","vpn.nhn.no","nhn.no"],
+		"subject":{"CN":"www.nhn.no"},
+		"issuer":{"O":"Let's Encrypt","CN":"R11"},
+		"not_before":1700000000,"not_after":1707776000,
+		"extensions":{"subjectAltName":"DNS:www.nhn.no, DNS:vpn.nhn.no, DNS:nhn.no"}}}}`
+	if err := json.Unmarshal([]byte(payload), &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`domain ~ "*.nhn.no"`, true},
+		{`domain == "VPN.nhn.no"`, true},
+		{`domain != "vpn.nhn.no"`, false},
+		{`issuer.o in ["Let's Encrypt", "ZeroSSL"]`, true},
+		{`!issuer.o in ["Let's Encrypt"]`, false},
+		{`domain ~ "*.nhn.no" && !issuer.o in ["Let's Encrypt"] && san_count > 50`, false},
+		{`san_count >= 3 && validity_days == 90 && cert_index in [41, 42]`, true},
+		{`subject.cn =~ "^www\\."`, true},
+		{`issuer.cn contains "r1"`, true},
+		{`is_ca || is_ca == false`, true},
+		// && binds tighter than ||
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && false || true`, true},
+		// ! binds tighter than && and || but looser than comparisons
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!san_count > 5 || false`, true},
+		{`!!true`, true},
+	}
+	for _, tt := range tests {
+		expr, err := ParseFilterExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFilterExpression(%q): %v", tt.expr, err)
+		}
+		if got := expr.Match(&cert); got != tt.want {
+			t.Errorf("%s = %v; want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestFilterExpressionShortCircuit(t *testing.T) {
+	calls := 0
+	fields := map[string]filterField{"test.calls": {boolean: func(*CertData) bool {
+		calls++
+		return true
+	}}}
+
+	tests := []struct {
+		expr  string
+		calls int
+	}{
+		{`false && test.calls`, 0},
+		{`true || test.calls`, 0},
+		{`true && test.calls`, 1},
+		{`false || test.calls`, 1},
+		{`test.calls || test.calls`, 1},
+		{`test.calls && test.calls && false`, 2},
+		{`false && test.calls || test.calls`, 1},
+	}
+	for _, tt := range tests {
+		expr, err := parseFilterExpression(tt.expr, fields)
+		if err != nil {
+			t.Fatalf("parseFilterExpression(%q): %v", tt.expr, err)
+		}
+		calls = 0
+		expr.Match(&CertData{})
+		if calls != tt.calls {
+			t.Errorf("%s evaluated test.calls %d times; want %d", tt.expr, calls, tt.calls)
+		}
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expr   string
+		column int
+	}{
+		{`domain ~ "*.nhn.no" &&`, 23},
+		{`domain = "nhn.no"`, 8},
+		{`issuer.x == "a"`, 1},
+		{`san_count > "many"`, 11},
+		{`domain && true`, 1},
+		{`domain ~ "nhn..no"`, 10},
+		{`subject.cn =~ "("`, 15},
+		{`issuer.o in ["a", 1]`, 19},
+		{`(domain == "a"`, 15},
+		{`domain == "a" )`, 15},
+		{`"å" == "ø" && x`, 15},
+		{`domain == "unterminated`, 11},
+		{`san_count`, 1},
+	}
+	for _, tt := range tests {
+		_, err := ParseFilterExpression(tt.expr)
+		filterErr, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("ParseFilterExpression(%q) error = %v; want a FilterError", tt.expr, err)
+			continue
+		}
+		if filterErr.Column != tt.column {
+			t.Errorf("ParseFilterExpression(%q) column = %d (%v); want %d", tt.expr, filterErr.Column, err, tt.column)
+		}
+	}
+}
+
+func TestProcessCertificateFilterExpression(t *testing.T) {
+	letsEncrypt := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"issuer":{"O":"Let's Encrypt"}}}}`)
+	sectigo := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"subject":{"CN":"www.nhn.no"},"issuer":{"O":"Sectigo"}}}}`)
+
+	// Combined with a watch list the expression is an extra condition
+	monitor := New(WithDomains([]string{"nhn.no"}), WithFilterExpression(`!issuer.o in ["Let's Encrypt"]`))
+	monitor.processCertificate(letsEncrypt)
+	monitor.processCertificate(sectigo)
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("EventsSent = %d; want 1", stats.EventsSent)
+	}
+	if event := <-monitor.Events(); len(event.MatchedDomains) != 1 || event.MatchedDomains[0] != "nhn.no" {
+		t.Errorf("MatchedDomains = %v; want [nhn.no]", event.MatchedDomains)
+	}
+
+	// On its own it selects certificates
+	monitor = New(WithFilterExpression(`domain ~ "*.nhn.no" && issuer.o == "sectigo"`))
+	monitor.processCertificate(letsEncrypt)
+	monitor.processCertificate(sectigo)
+	if stats := monitor.Stats(); stats.EventsSent != 1 {
+		t.Fatalf("filter only: EventsSent = %d; want 1", stats.EventsSent)
+	}
+	event := <-monitor.Events()
+	if len(event.Matches) != 1 || event.Matches[0].Kind != MatchKindFilter || event.Matches[0].Domain != "www.nhn.no" {
+		t.Errorf("filter only: Matches = %+v", event.Matches)
+	}
+
+	// The domain reported is the one that satisfied the expression, not the common name
+	multiSAN := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["cdn.example.com","login.nhn.no"],"subject":{"CN":"cdn.example.com"},"issuer":{"O":"Sectigo"}}}}`)
+	monitor.processCertificate(multiSAN)
+	event = <-monitor.Events()
+	if len(event.Matches) != 1 || event.Matches[0].Domain != "login.nhn.no" || event.Matches[0].RegistrableDomain != "nhn.no" {
+		t.Errorf("multi-SAN filter match: Matches = %+v", event.Matches)
+	}
+
+	// Without a domain test the common name is reported
+	monitor = New(WithFilterExpression(`issuer.o == "sectigo"`))
+	monitor.processCertificate(multiSAN)
+	if event := <-monitor.Events(); len(event.Matches) != 1 || event.Matches[0].Domain != "cdn.example.com" {
+		t.Errorf("filter without domain test: Matches = %+v", event.Matches)
+	}
+}
+
+// fakeCTLog serves get-sth and get-entries for a fixed list of log entries
+func fakeCTLog(t *testing.T, entries []ctLogEntry) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ct/v1/get-sth", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int{"tree_size": len(entries)})
+	})
+	mux.HandleFunc("/ct/v1/get-entries", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		if start < 0 || end < start || end >= len(entries) {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		// Return at most two entries, as real logs cap their responses
+		if end > start+1 {
+			end = start + 1
+		}
+		json.NewEncoder(w).Encode(map[string][]ctLogEntry{"entries": entries[start : end+1]})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testCertificate returns a self-signed certificate for the given names in DER form
+func testCertificate(t *testing.T, names ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0xabc),
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"Norsk Helsenett"}},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// testLogEntry builds an RFC 6962 entry for a self-signed certificate with the given names
+func testLogEntry(t *testing.T, precert bool, names ...string) ctLogEntry {
+	t.Helper()
+	der := testCertificate(t, names...)
+
+	uint24 := func(b []byte) []byte {
+		return append([]byte{byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+	leaf := make([]byte, 12)
+	binary.BigEndian.PutUint64(leaf[2:], uint64(time.Now().UnixMilli()))
+	if !precert {
+		leaf = append(leaf, uint24(der)...)
+		return ctLogEntry{LeafInput: append(leaf, 0, 0)}
+	}
+	binary.BigEndian.PutUint16(leaf[10:], precertLogEntryType)
+	leaf = append(leaf, make([]byte, 32)...) // issuer_key_hash
+	leaf = append(leaf, uint24([]byte("tbs"))...)
+	return ctLogEntry{LeafInput: append(leaf, 0, 0), ExtraData: uint24(der)}
+}
+
+func TestParseLogEntry(t *testing.T) {
+	cert, updateType, err := parseLogEntry(testLogEntry(t, false, "www.nhn.no", "nhn.no"))
+	if err != nil || updateType != "X509LogEntry" || cert.Subject.CommonName != "www.nhn.no" {
+		t.Fatalf("x509 entry: %v %q %v", cert, updateType, err)
+	}
+	cert, updateType, err = parseLogEntry(testLogEntry(t, true, "login.nhn.no"))
+	if err != nil || updateType != "PrecertLogEntry" || cert.Subject.CommonName != "login.nhn.no" {
+		t.Fatalf("precert entry: %v %q %v", cert, updateType, err)
+	}
+
+	data := certDataFromX509(cert, updateType)
+	leaf := data.Data.LeafCert
+	if len(leaf.AllDomains) != 1 || leaf.AllDomains[0] != "login.nhn.no" {
+		t.Errorf("AllDomains = %v", leaf.AllDomains)
+	}
+	if leaf.SerialNumber != "ABC" || leaf.Subject.O != "Norsk Helsenett" || leaf.Extensions.SubjectAltName != "DNS:login.nhn.no" {
+		t.Errorf("unexpected leaf: %+v", leaf)
+	}
+	if leaf.Subject.Aggregated != "/O=Norsk Helsenett/CN=login.nhn.no" {
+		t.Errorf("Aggregated = %q", leaf.Subject.Aggregated)
+	}
+
+	for _, entry := range []ctLogEntry{{LeafInput: []byte{0, 0, 1}}, {LeafInput: make([]byte, 15)}} {
+		if _, _, err := parseLogEntry(entry); err == nil {
+			t.Errorf("expected error for %v", entry.LeafInput)
+		}
+	}
+}
+
+func TestMonitorCTLog(t *testing.T) {
+	server := fakeCTLog(t, []ctLogEntry{
+		testLogEntry(t, false, "www.example.com"),
+		testLogEntry(t, false, "www.nhn.no"),
+		{LeafInput: []byte("garbage")},
+		testLogEntry(t, true, "login.nhn.no"),
+		testLogEntry(t, false, "example.org"),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	monitor := New(
+		WithContext(ctx),
+		WithWebSocketURL(""),
+		WithCTLogs(CTLog{URL: server.URL + "/", Name: "fake", Backfill: 4}),
+		WithCTPollInterval(10*time.Millisecond),
+		WithCTBatchSize(3),
+		WithDomains([]string{"nhn.no"}),
+	)
+	monitor.Start()
+	defer monitor.Stop()
+
+	var updateTypes []string
+	for len(updateTypes) < 2 {
+		select {
+		case event := <-monitor.Events():
+			source := event.Certificate.Data.Source
+			if source.Name != "fake" || source.URL != server.URL {
+				t.Errorf("Source = %+v", source)
+			}
+			updateTypes = append(updateTypes, event.Certificate.Data.UpdateType)
+		case <-ctx.Done():
+			t.Fatalf("timed out after %d events", len(updateTypes))
+		}
+	}
+	if updateTypes[0] != "X509LogEntry" || updateTypes[1] != "PrecertLogEntry" {
+		t.Errorf("update types = %v", updateTypes)
+	}
+
+	// The first entry is before the backfill window and the garbage entry is skipped
+	for monitor.CTLogPositions()["fake"] != 5 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("positions = %v; want fake: 5", monitor.CTLogPositions())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if stats := monitor.Stats(); stats.RawReceived != 3 || stats.EventsSent != 2 {
+		t.Errorf("RawReceived = %d, EventsSent = %d; want 3, 2", stats.RawReceived, stats.EventsSent)
+	}
+}
+
+// sliceSource is a Source returning fixed messages, failing once after failAfter of them
+type sliceSource struct {
+	name      string
+	messages  [][]byte
+	failAfter int
+	next      int
+	failed    bool
+	starts    int
+}
+
+func (s *sliceSource) Name() string                    { return s.name }
+func (s *sliceSource) Start(ctx context.Context) error { s.starts++; return nil }
+func (s *sliceSource) Close() error                    { return nil }
+func (s *sliceSource) Health() SourceHealth            { return SourceHealth{Connected: true} }
+
+func (s *sliceSource) Next(ctx context.Context) ([]byte, error) {
+	if s.next == s.failAfter && !s.failed {
+		s.failed = true
+		return nil, fmt.Errorf("connection reset")
+	}
+	if s.next == len(s.messages) {
+		return nil, io.EOF
+	}
+	s.next++
+	return s.messages[s.next-1], nil
+}
+
+func TestMonitorCustomSource(t *testing.T) {
+	message := func(domain string) []byte {
+		return []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["` + domain + `"]}}}`)
+	}
+	source := &sliceSource{
+		name:      "replay",
+		messages:  [][]byte{message("www.nhn.no"), message("example.org"), message("login.nhn.no")},
+		failAfter: 1,
+	}
+
+	monitor := New(WithWebSocketURL(""), WithSource(source), WithDisableBackoff(true), WithDomains([]string{"nhn.no"}))
+	monitor.Start()
+	defer monitor.Stop()
+
+	var domains []string
+	for len(domains) < 2 {
+		select {
+		case event := <-monitor.Events():
+			domains = append(domains, event.Matches[0].Domain)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %v", domains)
+		}
+	}
+	sort.Strings(domains)
+	if domains[0] != "login.nhn.no" || domains[1] != "www.nhn.no" {
+		t.Errorf("matched %v; want login.nhn.no and www.nhn.no", domains)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !monitor.Stats().Sources[0].Finished && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stats := monitor.Stats()
+	if len(stats.Sources) != 1 {
+		t.Fatalf("Sources = %+v; want only the replay source", stats.Sources)
+	}
+	got := stats.Sources[0]
+	if got.Name != "replay" || got.Received != 3 || got.Restarts != 1 || !got.Finished || !got.Health.Connected {
+		t.Errorf("source stats = %+v", got)
+	}
+	if source.starts != 2 {
+		t.Errorf("source started %d times; want 2", source.starts)
+	}
+}
+
+// flappingSource delivers one message per connection, then drops it; with refuse set
+// it fails to connect after the first start
+type flappingSource struct {
+	sliceSource
+	delivered bool
+	refuse    bool
+}
+
+func (s *flappingSource) Start(ctx context.Context) error {
+	s.starts++
+	if s.refuse && s.starts > 1 {
+		return fmt.Errorf("connection refused")
+	}
+	s.delivered = false
+	return nil
+}
+
+func (s *flappingSource) Next(ctx context.Context) ([]byte, error) {
+	if s.delivered {
+		return nil, fmt.Errorf("connection reset")
+	}
+	s.delivered = true
+	return []byte(`{"message_type":"heartbeat"}`), nil
+}
+
+func TestMonitorBackoffResets(t *testing.T) {
+	restartsWithin := func(source *flappingSource, wait time.Duration) uint64 {
+		monitor := New(
+			WithWebSocketURL(""),
+			WithSource(source),
+			WithReconnectTimeout(10*time.Millisecond),
+			WithMaxReconnectTimeout(time.Minute),
+		)
+		monitor.SetLogger(NewDefaultLogger(false))
+		monitor.Start()
+		defer monitor.Stop()
+		time.Sleep(wait)
+		return monitor.Stats().Sources[0].Restarts
+	}
+
+	// A source that reconnects and delivers keeps reconnecting quickly, however
+	// often it drops
+	if restarts := restartsWithin(&flappingSource{sliceSource: sliceSource{name: "flapping"}}, time.Second); restarts < 20 {
+		t.Errorf("%d restarts of a source that delivers after every reconnect; want the backoff to reset", restarts)
+	}
+	// One that cannot connect backs off further every time
+	if restarts := restartsWithin(&flappingSource{sliceSource: sliceSource{name: "down"}, refuse: true}, time.Second); restarts > 10 {
+		t.Errorf("%d restarts of a source that cannot connect; want growing backoff", restarts)
+	}
+}
+
+func TestDedupCache(t *testing.T) {
+	cache := newDedupCache(time.Minute, 2)
+	now := time.Now()
+	if cache.duplicate("a", now) {
+		t.Error("first a reported as duplicate")
+	}
+	if !cache.duplicate("a", now.Add(30*time.Second)) {
+		t.Error("a within the TTL not reported as duplicate")
+	}
+	if cache.duplicate("a", now.Add(2*time.Minute)) {
+		t.Error("a after the TTL reported as duplicate")
+	}
+
+	// The cache is bounded; the oldest key goes first
+	later := now.Add(3 * time.Minute)
+	cache.duplicate("b", later)
+	cache.duplicate("c", later)
+	if cache.len() != 2 {
+		t.Errorf("len = %d; want 2", cache.len())
+	}
+	if cache.duplicate("a", later) || !cache.duplicate("c", later) {
+		t.Error("expected a to be evicted and c to be remembered")
+	}
+}
+
+func TestMonitorFanInDedup(t *testing.T) {
+	cert := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["www.nhn.no"],"sha256":"AB:CD","serial_number":"01"}}}`)
+	other := []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["login.nhn.no"],"sha256":"EF:01","serial_number":"02"}}}`)
+	first := &sliceSource{name: "own", messages: [][]byte{cert, other}, failAfter: -1}
+	second := &sliceSource{name: "public", messages: [][]byte{cert}, failAfter: -1}
+
+	monitor := New(WithWebSocketURL(""), WithSource(first), WithSource(second), WithDomains([]string{"nhn.no"}))
+	monitor.Start()
+	defer monitor.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stats := monitor.Stats(); !stats.Sources[0].Finished || !stats.Sources[1].Finished || stats.CertsDecoded < 3; stats = monitor.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if stats := monitor.Stats(); stats.EventsSent != 2 {
+		t.Errorf("EventsSent = %d; want 2", stats.EventsSent)
+	}
+}
+
+func TestFailoverSource(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		conn.Write(r.Context(), websocket.MessageText, []byte(`{"message_type":"heartbeat"}`))
+		conn.Read(r.Context())
+	}))
+	defer backup.Close()
+
+	primaryURL := "ws" + strings.TrimPrefix(down.URL, "http")
+	backupURL := "ws" + strings.TrimPrefix(backup.URL, "http")
+	source := NewFailoverSource([]string{primaryURL, backupURL})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := source.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer source.Close()
+	if health := source.Health(); !health.Connected || health.Detail != "using "+backupURL {
+		t.Errorf("Health = %+v; want connected to the backup", health)
+	}
+	data, err := source.Next(ctx)
+	if err != nil || !strings.Contains(string(data), "heartbeat") {
+		t.Errorf("Next = %q, %v", data, err)
+	}
+
+	source.Close()
+	if health := source.Health(); health.Connected || health.Detail != "" {
+		t.Errorf("Health after Close = %+v", health)
+	}
+	if err := NewFailoverSource([]string{primaryURL}).Start(ctx); err == nil {
+		t.Error("expected error when no endpoint is reachable")
+	}
+}
+
+func TestDedupIdentity(t *testing.T) {
+	var precert, final, reordered CertData
+	json.Unmarshal([]byte(`{"data":{"leaf_cert":{"all_domains":["www.nhn.no","nhn.no"],"sha256":"AA","serial_number":"0ABC","not_before":1700000000,"issuer":{"aggregated":"/C=US/O=Let's Encrypt/CN=R11"}}}}`), &precert)
+	json.Unmarshal([]byte(`{"data":{"leaf_cert":{"all_domains":["www.nhn.no","nhn.no"],"sha256":"BB","serial_number":"ABC","not_before":1700000000,"issuer":{"aggregated":"/C=US/O=Let's Encrypt/CN=R11"}}}}`), &final)
+	json.Unmarshal([]byte(`{"data":{"leaf_cert":{"all_domains":["NHN.no","www.nhn.no","nhn.no"],"sha256":"CC","serial_number":"DEF","not_before":1700000000}}}`), &reordered)
+
+	tests := []struct {
+		key              DedupKey
+		precertIsFinal   bool
+		reorderedIsFinal bool
+	}{
+		{DedupKeySHA256, false, false},
+		{DedupKeySerialIssuer, true, false},
+		{DedupKeySANs, true, true},
+	}
+	for _, tt := range tests {
+		if got := dedupIdentity(&precert, tt.key) == dedupIdentity(&final, tt.key); got != tt.precertIsFinal {
+			t.Errorf("%s: precert and final cert share identity = %v; want %v", tt.key, got, tt.precertIsFinal)
+		}
+		if got := dedupIdentity(&reordered, tt.key) == dedupIdentity(&final, tt.key); got != tt.reorderedIsFinal {
+			t.Errorf("%s: reordered SANs share identity = %v; want %v", tt.key, got, tt.reorderedIsFinal)
+		}
+	}
+
+	if identity := dedupIdentity(&CertData{}, DedupKeySerialIssuer); identity != "" {
+		t.Errorf("identity of an empty message = %q; want empty", identity)
+	}
+	if _, err := ParseDedupKey("Serial_Issuer"); err != nil {
+		t.Errorf("ParseDedupKey: %v", err)
+	}
+	if _, err := ParseDedupKey("fingerprint"); err == nil {
+		t.Error("expected error for unknown dedup key")
+	}
+}
+
+func TestProcessCertificateDedup(t *testing.T) {
+	precert := []byte(`{"message_type":"certificate_update","data":{"update_type":"PrecertLogEntry","leaf_cert":{"all_domains":["www.nhn.no"],"sha256":"AA","serial_number":"ABC"}}}`)
+	final := []byte(`{"message_type":"certificate_update","data":{"update_type":"X509LogEntry","leaf_cert":{"all_domains":["www.nhn.no"],"sha256":"BB","serial_number":"ABC"}}}`)
+
+	// Even a single source folds the final certificate into its precertificate
+	monitor := New(WithDomains([]string{"nhn.no"}))
+	monitor.processCertificate(precert)
+	monitor.processCertificate(final)
+	monitor.processCertificate(precert)
+	if stats := monitor.Stats(); stats.EventsSent != 1 || stats.Duplicates != 2 {
+		t.Errorf("default: EventsSent = %d, Duplicates = %d; want 1, 2", stats.EventsSent, stats.Duplicates)
+	}
+
+	monitor = New(WithDomains([]string{"nhn.no"}), WithDedup(DedupKeyNone))
+	monitor.processCertificate(precert)
+	monitor.processCertificate(precert)
+	if stats := monitor.Stats(); stats.EventsSent != 2 || stats.Duplicates != 0 {
+		t.Errorf("none: EventsSent = %d, Duplicates = %d; want 2, 0", stats.EventsSent, stats.Duplicates)
+	}
+}
+
+func TestProcessCertificateMessageVariants(t *testing.T) {
+	monitor := New(WithDomains([]string{"nhn.no"}))
+
+	// domains-only endpoint
+	monitor.processCertificate([]byte(`{"data":["www.nhn.no","nhn.no"],"message_type":"dns_entries"}`))
+	event := <-monitor.Events()
+	if event.Certificate.MessageType != "dns_entries" || event.CertType != "" || len(event.Matches) != 2 {
+		t.Errorf("dns_entries event: type %q, cert type %q, matches %+v", event.Certificate.MessageType, event.CertType, event.Matches)
+	}
+
+	// full-stream endpoint
+	monitor.processCertificate([]byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["login.nhn.no"],"as_der":"MII="},
+		"chain":[{"subject":{"CN":"R11","O":"Let's Encrypt"},"extensions":{"basicConstraints":"CA:TRUE"},"is_ca":true,"as_der":"MII="},
+		{"subject":{"CN":"ISRG Root X1","O":["Internet Security Research Group"]},"is_ca":true}]}}`))
+	event = <-monitor.Events()
+	if len(event.Chain) != 2 || event.Chain[0].Subject.CN != "R11" || event.Chain[1].Subject.CN != "ISRG Root X1" || !event.Chain[0].IsCA {
+		t.Errorf("Chain = %+v", event.Chain)
+	}
+	if event.Chain[0].Extensions["basicConstraints"] != "CA:TRUE" {
+		t.Errorf("chain extensions = %v", event.Chain[0].Extensions)
+	}
+
+	// Heartbeats are counted per source and never reach the workers
+	source := &sliceSource{name: "server", failAfter: -1, messages: [][]byte{
+		[]byte(`{"message_type":"heartbeat","timestamp":1700000000.5}`),
+		[]byte(`{"data":["www.nhn.no"],"message_type":"dns_entries"}`),
+	}}
+	monitor = New(WithWebSocketURL(""), WithSource(source), WithDomains([]string{"nhn.no"}))
+	monitor.Start()
+	defer monitor.Stop()
+	select {
+	case <-monitor.Events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	stats := monitor.Stats()
+	if got := stats.Sources[0]; got.Heartbeats != 1 || got.LastHeartbeat.IsZero() || got.Received != 1 {
+		t.Errorf("source stats = %+v", got)
+	}
+	if stats.CertsDecoded != 1 {
+		t.Errorf("CertsDecoded = %d; want 1", stats.CertsDecoded)
+	}
+}
+
+func TestProcessCertificateParseDER(t *testing.T) {
+	cert, err := x509.ParseCertificate(testCertificate(t, "www.nhn.no"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := certDataFromX509(cert, "X509LogEntry")
+	// The JSON claims an old certificate; the DER is authoritative
+	data.Data.LeafCert.NotBefore = float64(time.Now().AddDate(-1, 0, 0).Unix())
+	message, _ := json.Marshal(data)
+
+	monitor := New(WithDomains([]string{"nhn.no"}))
+	monitor.processCertificate(message)
+	if event := <-monitor.Events(); event.X509 != nil || event.CertType != "RENEWAL" {
+		t.Errorf("without WithParseDER: X509 = %v, CertType = %s", event.X509, event.CertType)
+	}
+
+	monitor = New(WithDomains([]string{"nhn.no"}), WithParseDER(true))
+	monitor.processCertificate(message)
+	event := <-monitor.Events()
+	if event.X509 == nil {
+		t.Fatal("X509 not set")
+	}
+	if event.X509.PublicKeyAlgorithm != x509.ECDSA || event.X509.Subject.CommonName != "www.nhn.no" {
+		t.Errorf("X509 = %v %s", event.X509.PublicKeyAlgorithm, event.X509.Subject.CommonName)
+	}
+	if event.CertType != "NEW" || int64(event.Certificate.Data.LeafCert.NotBefore) != cert.NotBefore.Unix() {
+		t.Errorf("CertType = %s, NotBefore = %v; want validity from the DER", event.CertType, event.Certificate.Data.LeafCert.NotBefore)
+	}
+
+	if _, err := (&CertData{}).ParseDER(); err != ErrNoDER {
+		t.Errorf("ParseDER without as_der = %v; want ErrNoDER", err)
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	start := time.Now().Unix() - 200*day
+	event := func(serial, issuer, key string, notBefore int64, names ...string) *CertEvent {
+		cert := CertData{MessageType: "certificate_update"}
+		leaf := &cert.Data.LeafCert
+		leaf.AllDomains = names
+		leaf.SerialNumber = serial
+		leaf.Issuer.Aggregated = "/O=" + issuer
+		leaf.Extensions.SubjectKeyIdentifier = key
+		leaf.NotBefore = float64(notBefore)
+		leaf.NotAfter = float64(notBefore + 90*day)
+		return &CertEvent{Certificate: cert}
+	}
+
+	classifier := NewClassifier(0)
+	steps := []struct {
+		name  string
+		event *CertEvent
+		want  string
+	}{
+		{"first certificate", event("01", "LE", "k1", start, "www.nhn.no", "nhn.no"), CertTypeNewDomain},
+		{"final certificate of the same issuance", event("1", "LE", "k1", start, "nhn.no", "www.nhn.no"), CertTypeNewDomain},
+		{"renewal near expiry with a new key", event("02", "LE", "k2", start+70*day, "nhn.no", "www.nhn.no"), CertTypeRenewal},
+		{"new key early in the lifetime", event("03", "LE", "k3", start+75*day, "nhn.no", "www.nhn.no"), CertTypeReissue},
+		{"other issuer", event("04", "Sectigo", "k3", start+80*day, "nhn.no", "www.nhn.no"), CertTypeIssuerChange},
+		{"new subdomain", event("05", "LE", "k4", start+81*day, "api.nhn.no"), CertTypeNewName},
+		{"known and new registrable domain", event("06", "LE", "k5", start+82*day, "www.nhn.no", "helsenorge.no"), CertTypeNewDomain},
+		{"no domains", event("07", "LE", "k6", start, ""), ""},
+	}
+	for _, step := range steps {
+		if got := classifier.Classify(step.event); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	path := t.TempDir() + "/classifier.json"
+	if err := classifier.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewClassifier(0)
+	if err := restored.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 2 {
+		t.Errorf("restored %d domains, want 2", restored.Len())
+	}
+	if got := restored.Classify(event("08", "Sectigo", "k3", start+85*day, "nhn.no", "www.nhn.no")); got != CertTypeRenewal {
+		t.Errorf("after restore: got %q, want %q", got, CertTypeRenewal)
+	}
+	if err := NewClassifier(0).Load(t.TempDir() + "/missing.json"); err != nil {
+		t.Errorf("loading a missing file: %v", err)
+	}
+
+	// The least recently seen domain is forgotten first
+	small := NewClassifier(2)
+	for _, name := range []string{"a.no", "b.no", "a.no", "c.no"} {
+		small.Classify(event("1", "LE", "k", start, name))
+	}
+	if got := small.Classify(event("2", "LE", "k", start+80*day, "a.no")); got != CertTypeRenewal {
+		t.Errorf("recently seen domain: got %q, want %q", got, CertTypeRenewal)
+	}
+	if got := small.Classify(event("2", "LE", "k", start+80*day, "b.no")); got != CertTypeNewDomain {
+		t.Errorf("evicted domain: got %q, want %q", got, CertTypeNewDomain)
+	}
+
+	// A domain with a certificate per customer keeps only the most recent names
+	hosting := NewClassifier(0)
+	for i := 0; i <= maxNamesPerDomain; i++ {
+		hosting.Classify(event(fmt.Sprint(i), "LE", "k", start+int64(i), fmt.Sprintf("customer%d.hosting.no", i)))
+	}
+	history := hosting.history("hosting.no")
+	if len(history.Names) != maxNamesPerDomain {
+		t.Errorf("remembered %d names, want %d", len(history.Names), maxNamesPerDomain)
+	}
+	if _, ok := history.Names["customer0.hosting.no"]; ok {
+		t.Error("the name certified longest ago was not forgotten")
+	}
+	last := fmt.Sprintf("customer%d.hosting.no", maxNamesPerDomain)
+	if got := hosting.Classify(event("x", "LE", "k", start+90*day, last)); got != CertTypeRenewal {
+		t.Errorf("most recent name: got %q, want %q", got, CertTypeRenewal)
+	}
+
+	// Saving encodes a snapshot, so classifying can go on meanwhile
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			hosting.Classify(event(fmt.Sprint(i), "LE", "k", start+100*day+int64(i), fmt.Sprintf("new%d.hosting.no", i)))
+		}
+	}()
+	if err := hosting.Save(t.TempDir() + "/hosting.json"); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
+
+func TestProcessCertificateClassify(t *testing.T) {
+	message := func(serial string) []byte {
+		cert := CertData{MessageType: "certificate_update"}
+		cert.Data.LeafCert.AllDomains = []string{"www.nhn.no"}
+		cert.Data.LeafCert.SerialNumber = serial
+		cert.Data.LeafCert.NotBefore = float64(time.Now().Unix())
+		data, _ := json.Marshal(cert)
+		return data
+	}
+
+	path := t.TempDir() + "/classifier.json"
+	monitor := New(WithWebSocketURL(""), WithDomains([]string{"nhn.no"}), WithClassifierState(path), WithClassifier(true))
+	monitor.processCertificate(message("01"))
+	if event := <-monitor.Events(); event.CertType != CertTypeNewDomain {
+		t.Errorf("CertType = %q, want %q", event.CertType, CertTypeNewDomain)
+	}
+	monitor.Start()
+	monitor.Stop()
+
+	// The history saved on Stop is loaded by the next monitor
+	monitor = New(WithWebSocketURL(""), WithDomains([]string{"nhn.no"}), WithClassifierState(path), WithClassifier(true))
+	monitor.processCertificate(message("02"))
+	if event := <-monitor.Events(); event.CertType != CertTypeRenewal {
+		t.Errorf("after restart: CertType = %q, want %q", event.CertType, CertTypeRenewal)
+	}
+
+	monitor = New(WithDomains([]string{"nhn.no"}))
+	monitor.processCertificate(message("03"))
+	if event := <-monitor.Events(); event.CertType != "NEW" {
+		t.Errorf("without WithClassifier: CertType = %q, want NEW", event.CertType)
+	}
+}
+
+func TestPeekCheckpoint(t *testing.T) {
+	cert := CertData{MessageType: "certificate_update"}
+	cert.Data.CertIndex = 42
+	cert.Data.Source.URL = "https://ct.example.com/log/"
+	data, _ := json.Marshal(cert)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		url   string
+		index int64
+		ok    bool
+	}{
+		{"compact", data, "https://ct.example.com/log/", 42, true},
+		{"spaced", []byte(`{"data": {"cert_index": 7, "source": {"name": "x", "url": "ct.example.com\/log\/"}}}`), "ct.example.com/log/", 7, true},
+		{"no source", []byte(`{"data": {"cert_index": 7}}`), "", 0, false},
+		{"dns_entries", []byte(`{"message_type": "dns_entries", "data": ["nhn.no"]}`), "", 0, false},
+	}
+	for _, tt := range tests {
+		url, index, ok := peekCheckpoint(tt.data)
+		if url != tt.url || index != tt.index || ok != tt.ok {
+			t.Errorf("%s: got %q, %d, %v", tt.name, url, index, ok)
+		}
+	}
+
+	if key := CheckpointKey("https://ct.googleapis.com/logs/us1/argon2026h1/"); key != "ct.googleapis.com/logs/us1/argon2026h1" {
+		t.Errorf("CheckpointKey = %q", key)
+	}
+}
+
+func TestMonitorCheckpoints(t *testing.T) {
+	entries := []ctLogEntry{
+		testLogEntry(t, false, "www.nhn.no"),
+		testLogEntry(t, false, "www.example.com"),
+		testLogEntry(t, false, "a.nhn.no"),
+		testLogEntry(t, false, "b.nhn.no"),
+		testLogEntry(t, false, "example.org"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A followed log continues after its checkpoint instead of at the tree head
+	server := fakeCTLog(t, entries)
+	key := CheckpointKey(server.URL)
+	monitor := New(
+		WithContext(ctx),
+		WithWebSocketURL(""),
+		WithCTLogs(CTLog{URL: server.URL, Name: "fake"}),
+		WithCTPollInterval(10*time.Millisecond),
+		WithDomains([]string{"nhn.no"}),
+		WithCheckpoints(Checkpoints{key: 2}),
+	)
+	monitor.Start()
+	select {
+	case event := <-monitor.Events():
+		if domains := event.Certificate.Data.LeafCert.AllDomains; domains[0] != "b.nhn.no" {
+			t.Errorf("first event for %v; want b.nhn.no", domains)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the entry after the checkpoint")
+	}
+	// The unmatched last entry is skipped by the prefilter but still checkpointed
+	for monitor.Checkpoints()[key] != 4 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("checkpoints = %v; want %s: 4", monitor.Checkpoints(), key)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	monitor.Stop()
+
+	// Other checkpointed logs are backfilled once from the saved checkpoint
+	tlsServer := httptest.NewTLSServer(fakeCTLog(t, entries).Config.Handler)
+	defer tlsServer.Close()
+	key = CheckpointKey(tlsServer.URL)
+	path := t.TempDir() + "/checkpoints.json"
+	if err := SaveCheckpoints(path, Checkpoints{key: 1}); err != nil {
+		t.Fatal(err)
+	}
+	monitor = New(
+		WithContext(ctx),
+		WithWebSocketURL(""),
+		WithDomains([]string{"nhn.no"}),
+		WithCheckpointFile(path),
+	)
+	if len(monitor.sources) != 1 {
+		t.Fatalf("%d sources; want one backfill", len(monitor.sources))
+	}
+	monitor.sources[0].source.(*CTLogSource).client = tlsServer.Client()
+	monitor.Start()
+
+	var domains []string
+	for len(domains) < 2 {
+		select {
+		case event := <-monitor.Events():
+			domains = append(domains, event.Certificate.Data.LeafCert.AllDomains[0])
+		case <-ctx.Done():
+			t.Fatalf("timed out after %v", domains)
+		}
+	}
+	sort.Strings(domains)
+	if domains[0] != "a.nhn.no" || domains[1] != "b.nhn.no" {
+		t.Errorf("backfilled %v; want a.nhn.no, b.nhn.no", domains)
+	}
+	for !monitor.Stats().Sources[0].Finished || monitor.Checkpoints()[key] != 4 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("backfill did not finish: %+v, checkpoints %v", monitor.Stats().Sources[0], monitor.Checkpoints())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	monitor.Stop()
+
+	saved, err := LoadCheckpoints(path)
+	if err != nil || saved[key] != 4 {
+		t.Errorf("saved checkpoints = %v, %v; want %s: 4", saved, err, key)
+	}
+}
+
+func TestCheckpointsHeldByBackfill(t *testing.T) {
+	entries := []ctLogEntry{
+		testLogEntry(t, false, "a.nhn.no"),
+		testLogEntry(t, false, "b.nhn.no"),
+		testLogEntry(t, false, "c.nhn.no"),
+		testLogEntry(t, false, "d.nhn.no"),
+		testLogEntry(t, false, "e.nhn.no"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The backfill pauses after entries 1 and 2
+	resume := make(chan struct{})
+	handler := fakeCTLog(t, entries).Config.Handler
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if start, _ := strconv.Atoi(r.URL.Query().Get("start")); start >= 3 {
+			select {
+			case <-resume:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer tlsServer.Close()
+	key := CheckpointKey(tlsServer.URL)
+
+	// Meanwhile the live stream reports the same log near its tree head
+	live := &sliceSource{name: "live", failAfter: -1, messages: [][]byte{
+		[]byte(`{"message_type":"certificate_update","data":{"cert_index":1000,"source":{"url":"` + key + `"},"leaf_cert":{"all_domains":["live.nhn.no"]}}}`),
+	}}
+	monitor := New(
+		WithContext(ctx),
+		WithWebSocketURL(""),
+		WithSource(live),
+		WithDomains([]string{"nhn.no"}),
+		WithCheckpoints(Checkpoints{key: 0}),
+	)
+	monitor.sources[0].source.(*CTLogSource).client = tlsServer.Client()
+	monitor.Start()
+	defer monitor.Stop()
+
+	for monitor.Stats().Processed < 3 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out: %+v", monitor.Stats())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if got := monitor.Checkpoints()[key]; got != 2 {
+		t.Errorf("checkpoint during the backfill = %d; want 2", got)
+	}
+
+	// Once the backfill is done the live stream's checkpoint applies
+	close(resume)
+	for monitor.Checkpoints()[key] != 1000 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("checkpoints = %v after the backfill; want %s: 1000", monitor.Checkpoints(), key)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestCheckpointsHeldByDrops(t *testing.T) {
+	message := func(index int, domain string) []byte {
+		return []byte(fmt.Sprintf(`{"message_type":"certificate_update","data":{"cert_index":%d,"source":{"url":"ct.example/log"},"leaf_cert":{"all_domains":["%s"]}}}`, index, domain))
+	}
+	monitor := New(WithWebSocketURL(""), WithDomains([]string{"nhn.no"}), WithBufferSize(100))
+	candidate := func() bool { return true }
+	for i := 0; i < cap(monitor.raw.ch); i++ {
+		monitor.raw.push(message(i, "www.nhn.no"), candidate, nil)
+	}
+	// Once the raw queue is full messages are dropped; only matches hold the checkpoint
+	full := cap(monitor.raw.ch)
+	monitor.raw.push(message(full, "example.org"), candidate, nil)
+	monitor.raw.push(message(full+1, "www.nhn.no"), candidate, nil)
+	monitor.raw.push(message(full+2, "www.nhn.no"), candidate, nil)
+	for len(monitor.raw.ch) > 0 {
+		monitor.processCertificate(<-monitor.raw.ch)
+	}
+	monitor.processCertificate(message(full+10, "www.nhn.no"))
+
+	if got := monitor.Checkpoints()["ct.example/log"]; got != int64(full) {
+		t.Errorf("checkpoint = %d; want %d, before the first dropped match", got, full)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	message := func(domain string) []byte {
+		return []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["` + domain + `"]}}}`)
+	}
+	messages := [][]byte{
+		message("www.nhn.no"),
+		[]byte(`{"message_type":"heartbeat","timestamp":1700000000.0}`),
+		message("example.org"),
+		[]byte("not json"),
+		message("login.nhn.no"),
+	}
+
+	// Record everything a source delivers, heartbeats and garbage included
+	path := t.TempDir() + "/capture.ndjson.gz"
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitor := New(WithWebSocketURL(""), WithSource(&sliceSource{name: "live", messages: messages, failAfter: -1}), WithRecorder(recorder))
+	monitor.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for !monitor.Stats().Sources[0].Finished && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	monitor.Stop()
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Messages() != uint64(len(messages)) {
+		t.Fatalf("recorded %d messages; want %d", recorder.Messages(), len(messages))
+	}
+
+	// Replaying as fast as possible yields the same messages, in order
+	replay := NewReplaySource(path, 0)
+	ctx := context.Background()
+	if err := replay.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range messages {
+		got, err := replay.Next(ctx)
+		if err != nil || string(got) != string(want) {
+			t.Fatalf("message %d = %q, %v; want %q", i, got, err, want)
+		}
+	}
+	if _, err := replay.Next(ctx); err != io.EOF {
+		t.Errorf("after the last message: %v; want io.EOF", err)
+	}
+	replay.Close()
+
+	// A replay through the monitor reports the recorded matches
+	monitor = New(WithWebSocketURL(""), WithSource(NewReplaySource(path, 0)), WithDomains([]string{"nhn.no"}))
+	monitor.Start()
+	defer monitor.Stop()
+	var domains []string
+	for len(domains) < 2 {
+		select {
+		case event := <-monitor.Events():
+			domains = append(domains, event.Matches[0].Domain)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %v", domains)
+		}
+	}
+	sort.Strings(domains)
+	if domains[0] != "login.nhn.no" || domains[1] != "www.nhn.no" {
+		t.Errorf("replay matched %v; want login.nhn.no and www.nhn.no", domains)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	path := t.TempDir() + "/capture.ndjson.gz"
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		recorder.Record("live", start.Add(time.Duration(i)*time.Second), []byte(`{}`))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two seconds of traffic at 20x take about 100ms
+	replay := NewReplaySource(path, 20)
+	ctx := context.Background()
+	if err := replay.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	began := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := replay.Next(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(began); elapsed < 90*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("replay took %v; want about 100ms", elapsed)
+	}
+	if health := replay.Health(); health.Detail != "line 3" {
+		t.Errorf("Detail = %q", health.Detail)
+	}
+}
+
+func TestReplayTruncatedCapture(t *testing.T) {
+	path := t.TempDir() + "/capture.ndjson.gz"
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		at := start.Add(time.Duration(i) * captureFlushInterval / 2)
+		if err := recorder.Record("live", at, []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A crash before Close leaves the records up to the last flush, without a gzip trailer
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	crashed := t.TempDir() + "/crashed.ndjson.gz"
+	if err := os.WriteFile(crashed, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := NewReplaySource(crashed, 0)
+	replay.SetLogger(NewDefaultLogger(false))
+	ctx := context.Background()
+	if err := replay.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	var replayed int
+	for {
+		message, err := replay.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("after %d messages: %v", replayed, err)
+		}
+		if want := fmt.Sprintf(`{"n":%d}`, replayed); string(message) != want {
+			t.Fatalf("message %d = %q; want %q", replayed, message, want)
+		}
+		replayed++
+	}
+	if replayed != 9 {
+		t.Errorf("replayed %d messages; want the 9 flushed before the crash", replayed)
+	}
+}
+
+func TestArchiveSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := func(domain string) string {
+		return `{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["` + domain + `"]}}}`
+	}
+
+	write("certs/a.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCertificate(t, "pem.nhn.no")}))
+	write("certs/b.der", testCertificate(t, "der.nhn.no"))
+	response, _ := json.Marshal(map[string][]ctLogEntry{"entries": {
+		testLogEntry(t, false, "entry.nhn.no"),
+		{LeafInput: []byte("garbage")},
+		testLogEntry(t, true, "example.com"),
+	}})
+	write("entries.json", response)
+	array, _ := json.Marshal([]ctLogEntry{testLogEntry(t, true, "array.nhn.no")})
+	write("array.json", array)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(message("stream.nhn.no") + "\n" + `{"message_type":"heartbeat"}` + "\n" + message("example.org") + "\n"))
+	gz.Close()
+	write("stream.ndjson.gz", compressed.Bytes())
+	write("broken.bin", []byte("not a certificate"))
+	write(".hidden/c.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCertificate(t, "hidden.nhn.no")}))
+
+	files, err := ListArchiveFiles([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 6 {
+		t.Fatalf("ListArchiveFiles = %v; want 6 files without the hidden one", files)
+	}
+
+	sources := NewArchiveSources(files, 3)
+	options := []Option{WithWebSocketURL(""), WithDomains([]string{"nhn.no"})}
+	for _, source := range sources {
+		options = append(options, WithSource(source))
+	}
+	monitor := New(options...)
+	monitor.Start()
+	defer monitor.Stop()
+
+	var domains []string
+	for len(domains) < 5 {
+		select {
+		case event := <-monitor.Events():
+			domains = append(domains, event.Matches[0].Domain)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %v", domains)
+		}
+	}
+	sort.Strings(domains)
+	want := []string{"array.nhn.no", "der.nhn.no", "entry.nhn.no", "pem.nhn.no", "stream.nhn.no"}
+	if strings.Join(domains, ",") != strings.Join(want, ",") {
+		t.Errorf("matched %v; want %v", domains, want)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := monitor.Stats()
+		if stats.Sources[0].Finished && stats.Sources[1].Finished && stats.Sources[2].Finished {
+			if detail := stats.Sources[0].Health.Detail; detail != "file 6/6, 1 skipped" {
+				t.Errorf("Detail = %q", detail)
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("archive sources did not finish")
+}
+
+func TestParseBackpressure(t *testing.T) {
+	b, err := ParseBackpressure("Spill; dir=/var/spool; limit=512MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Policy != BackpressureSpill || b.SpillDir != "/var/spool" || b.SpillLimit != 512<<20 {
+		t.Errorf("ParseBackpressure = %+v", b)
+	}
+	if b, err := ParseBackpressure("block; timeout=5s"); err != nil || b.Timeout != 5*time.Second {
+		t.Errorf("ParseBackpressure = %+v, %v", b, err)
+	}
+	for _, invalid := range []string{"drop", "block; timeout=soon", "block; timeout=-1s", "spill; limit=lots", "spill; size=1"} {
+		if _, err := ParseBackpressure(invalid); err == nil {
+			t.Errorf("ParseBackpressure(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestStageBackpressure(t *testing.T) {
+	logger := NewDefaultLogger(false)
+	never := make(chan struct{})
+	drain := func(s *stage[[]byte]) string {
+		var items []string
+		for len(s.ch) > 0 {
+			items = append(items, string(<-s.ch))
+		}
+		return strings.Join(items, ",")
+	}
+
+	s := newStage("raw", 2, Backpressure{}, logger, encodeRaw, decodeRaw)
+	for _, item := range []string{"1", "2", "3"} {
+		s.push([]byte(item), nil, never)
+	}
+	if got := drain(s); got != "1,2" || s.dropped.Load() != 1 {
+		t.Errorf("drop-newest kept %s, dropped %d", got, s.dropped.Load())
+	}
+
+	s = newStage("raw", 2, Backpressure{Policy: BackpressureDropOldest}, logger, encodeRaw, decodeRaw)
+	for _, item := range []string{"1", "2", "3"} {
+		s.push([]byte(item), nil, never)
+	}
+	if got := drain(s); got != "2,3" || s.dropped.Load() != 1 {
+		t.Errorf("drop-oldest kept %s, dropped %d", got, s.dropped.Load())
+	}
+
+	s = newStage("raw", 1, Backpressure{Policy: BackpressureBlock, Timeout: 10 * time.Millisecond}, logger, encodeRaw, decodeRaw)
+	s.push([]byte("1"), nil, never)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-s.ch
+	}()
+	if !s.push([]byte("2"), nil, never) {
+		t.Error("block dropped a message the consumer made room for")
+	}
+	if s.push([]byte("3"), nil, never) || s.dropped.Load() != 1 {
+		t.Errorf("block did not time out, dropped %d", s.dropped.Load())
+	}
+
+	// Spilled messages come back in order, ahead of newer ones; non-candidates are dropped
+	s = newStage("raw", 2, Backpressure{Policy: BackpressureSpill, SpillDir: t.TempDir()}, logger, encodeRaw, decodeRaw)
+	candidate := func(data []byte) func() bool {
+		return func() bool { return !bytes.HasPrefix(data, []byte("x")) }
+	}
+	for _, item := range []string{"1", "2", "3", "x", "4"} {
+		s.push([]byte(item), candidate([]byte(item)), never)
+	}
+	if s.spilled.Load() != 2 || s.dropped.Load() != 1 {
+		t.Errorf("spilled %d, dropped %d; want 2 and 1", s.spilled.Load(), s.dropped.Load())
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go s.feed(done)
+	var got []string
+	for len(got) < 4 {
+		select {
+		case item := <-s.ch:
+			got = append(got, string(item))
+			if len(got) == 1 {
+				s.push([]byte("5"), nil, never)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %v", got)
+		}
+	}
+	if strings.Join(got, ",") != "1,2,3,4" {
+		t.Errorf("spill delivered %v; want 1,2,3,4 before 5", got)
+	}
+	if item := <-s.ch; string(item) != "5" {
+		t.Errorf("last item = %s; want 5", item)
+	}
+
+	s = newStage("raw", 1, Backpressure{Policy: BackpressureSpill, SpillDir: t.TempDir(), SpillLimit: 8}, logger, encodeRaw, decodeRaw)
+	s.push([]byte("1"), nil, never)
+	if s.push([]byte("too long for the limit"), nil, never) || s.dropped.Load() != 1 {
+		t.Errorf("spill beyond the limit was not dropped")
+	}
+}
+
+func TestSpillFileSustainedBacklog(t *testing.T) {
+	// A backlog that never empties keeps one record pending while many pass through
+	spill := &spillFile{dir: t.TempDir(), limit: 4096, ready: make(chan struct{}, 1)}
+	record := func(i int) []byte {
+		return []byte(fmt.Sprintf("%01000d", i))
+	}
+	if err := spill.append(record(0)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10000; i++ {
+		if err := spill.append(record(i)); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		data, err := spill.peek()
+		if err != nil || string(data) != string(record(i-1)) {
+			t.Fatalf("record %d = %.20q, %v", i-1, data, err)
+		}
+		spill.pop()
+
+		info, err := spill.file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 2*spillCompactSize {
+			t.Fatalf("spill file grew to %d bytes after %d records", info.Size(), i)
+		}
+	}
+	if spill.pending() != 1 {
+		t.Errorf("%d records pending; want 1", spill.pending())
+	}
+}
+
+func TestSendEventSpill(t *testing.T) {
+	cert, err := x509.ParseCertificate(testCertificate(t, "www.nhn.no"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, _ := json.Marshal(certDataFromX509(cert, "X509LogEntry"))
+
+	monitor := New(
+		WithWebSocketURL(""),
+		WithDomains([]string{"nhn.no"}),
+		WithParseDER(true),
+		WithBufferSize(100),
+		WithDedup(DedupKeyNone),
+		WithEventBackpressure(Backpressure{Policy: BackpressureSpill, SpillDir: t.TempDir()}),
+	)
+	for i := 0; i < 150; i++ {
+		monitor.processCertificate(message)
+	}
+	if stats := monitor.Stats(); stats.EventsSent != 150 || stats.EventsSpilled != 50 || stats.EventsDropped != 0 {
+		t.Fatalf("sent %d, spilled %d, dropped %d", stats.EventsSent, stats.EventsSpilled, stats.EventsDropped)
+	}
+
+	monitor.Start()
+	defer monitor.Stop()
+	for i := 0; i < 150; i++ {
+		select {
+		case event := <-monitor.Events():
+			if event.X509 == nil || event.Matches[0].Domain != "www.nhn.no" {
+				t.Fatalf("event %d: X509 = %v, Matches = %v", i, event.X509, event.Matches)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d events", i)
+		}
+	}
+}
+
+func TestMonitorHandle(t *testing.T) {
+	message := func(domain string) []byte {
+		return []byte(`{"message_type":"certificate_update","data":{"leaf_cert":{"all_domains":["` + domain + `"]}}}`)
+	}
+	source := &sliceSource{name: "replay", failAfter: -1}
+	var want []string
+	for i := 0; i < 200; i++ {
+		domain := fmt.Sprintf("host%d.nhn.no", i)
+		if i%2 == 1 {
+			domain = fmt.Sprintf("host%d.vg.no", i)
+		}
+		source.messages = append(source.messages, message(domain))
+		want = append(want, domain)
+	}
+
+	monitor := New(WithWebSocketURL(""), WithSource(source), WithWorkerCount(1), WithDomains([]string{"nhn.no", "vg.no"}))
+
+	// One event at a time, in the order reported
+	var sequential []string
+	monitor.HandleFunc(func(ctx context.Context, event CertEvent) error {
+		sequential = append(sequential, event.Matches[0].Domain)
+		return nil
+	}, WithHandlerName("sequential"))
+
+	// In parallel, but in order per watch pattern
+	var mu sync.Mutex
+	perPattern := make(map[string][]string)
+	var reported []error
+	monitor.HandleFunc(func(ctx context.Context, event CertEvent) error {
+		domain := event.Matches[0].Domain
+		mu.Lock()
+		perPattern[event.MatchedDomains[0]] = append(perPattern[event.MatchedDomains[0]], domain)
+		mu.Unlock()
+		switch domain {
+		case "host10.nhn.no":
+			panic("boom")
+		case "host11.vg.no":
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	}, WithConcurrency(4), WithOrderingKey(PatternKey), WithHandlerBuffer(8), WithErrorHandler(func(event CertEvent, err error) {
+		mu.Lock()
+		reported = append(reported, err)
+		mu.Unlock()
+	}))
+
+	// Stop waits for the handlers to finish the events already reported
+	monitor.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for monitor.Stats().Processed < 200 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	monitor.Stop()
+
+	if fmt.Sprint(sequential) != fmt.Sprint(want) {
+		t.Errorf("sequential handler saw %d events out of order: %v", len(sequential), sequential)
+	}
+	for _, pattern := range []string{"nhn.no", "vg.no"} {
+		var expected []string
+		for _, domain := range want {
+			if strings.HasSuffix(domain, "."+pattern) {
+				expected = append(expected, domain)
+			}
+		}
+		if fmt.Sprint(perPattern[pattern]) != fmt.Sprint(expected) {
+			t.Errorf("events of %s out of order: %v", pattern, perPattern[pattern])
+		}
+	}
+
+	var panicErr *PanicError
+	if len(reported) != 2 || !errors.As(reported[0], &panicErr) && !errors.As(reported[1], &panicErr) {
+		t.Errorf("reported errors %v; want a panic and a rejection", reported)
+	} else if panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("PanicError = %v", panicErr)
+	}
+
+	stats := monitor.Stats().Handlers
+	if len(stats) != 2 || stats[0].Name != "sequential" || stats[0].Handled != 200 || stats[0].Failed != 0 {
+		t.Fatalf("handler stats = %+v", stats)
+	}
+	if got := stats[1]; got.Name != "handler-2" || got.Handled != 200 || got.Failed != 2 || got.Panics != 1 || got.Queued != 0 {
+		t.Errorf("handler stats = %+v", got)
+	}
+
+	// Handlers are registered before Start
+	monitor.Start()
+	defer monitor.Stop()
+	monitor.HandleFunc(func(ctx context.Context, event CertEvent) error { return nil })
+	if n := len(monitor.Stats().Handlers); n != 2 {
+		t.Errorf("%d handlers after registering one while running", n)
+	}
+}
@@ -0,0 +1,247 @@
+package certstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCheckpointGapLimit is the default number of entries backfilled per CT log after a restart
+const DefaultCheckpointGapLimit = 100000
+
+// checkpointSaveInterval is how often the monitor saves its checkpoints while running
+const checkpointSaveInterval = 30 * time.Second
+
+// backfillRetries is how many failed polls a gap backfill tolerates before giving up
+const backfillRetries = 3
+
+// Checkpoints holds the last processed certificate index per CT log, keyed by CheckpointKey
+type Checkpoints map[string]int64
+
+// CheckpointKey returns the key a CT log is checkpointed under: its URL without scheme
+// and trailing slash, so "https://ct.googleapis.com/logs/us1/argon2026h1/" and the
+// scheme-less source URLs some CertStream servers send share a checkpoint
+func CheckpointKey(logURL string) string {
+	key := strings.TrimSpace(logURL)
+	if i := strings.Index(key, "://"); i >= 0 {
+		key = key[i+3:]
+	}
+	return strings.TrimRight(key, "/")
+}
+
+// checkpoints tracks the highest processed certificate index per CT log. Workers
+// process messages concurrently, so entries just below a checkpoint may still be in
+// flight when it is taken.
+//
+// The live stream of a log runs ahead of a source still fetching the entries after an
+// earlier checkpoint, and past entries dropped under backpressure. A checkpoint is
+// therefore held at the position of an unfinished backfill, and below the first
+// entry dropped, so the next run fetches what this one missed.
+type checkpoints struct {
+	mu        sync.Mutex
+	indexes   map[string]int64
+	backfills map[string]int64 // last entry delivered by an unfinished backfill
+	gaps      map[string]int64 // entry before the first one dropped
+}
+
+func newCheckpoints(initial Checkpoints) *checkpoints {
+	c := &checkpoints{
+		indexes:   make(map[string]int64, len(initial)),
+		backfills: make(map[string]int64),
+		gaps:      make(map[string]int64),
+	}
+	for log, index := range initial {
+		c.update(log, index)
+	}
+	return c
+}
+
+// update records index as processed for a log, keeping the highest index
+func (c *checkpoints) update(logURL string, index int64) {
+	key := CheckpointKey(logURL)
+	if key == "" || index < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current, ok := c.indexes[key]; !ok || index > current {
+		c.indexes[key] = index
+	}
+}
+
+// backfilled records the last entry a backfill of a log delivered, holding the
+// checkpoint there until backfillDone
+func (c *checkpoints) backfilled(logURL string, index int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backfills[CheckpointKey(logURL)] = index
+}
+
+// backfillDone releases the hold of a backfill that reached the tree head
+func (c *checkpoints) backfillDone(logURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.backfills, CheckpointKey(logURL))
+}
+
+// dropped holds the checkpoint of a log below an entry that was not processed
+func (c *checkpoints) dropped(logURL string, index int64) {
+	key := CheckpointKey(logURL)
+	if key == "" || index < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gap, ok := c.gaps[key]; !ok || index-1 < gap {
+		c.gaps[key] = index - 1
+	}
+}
+
+// get returns the checkpoint of a log
+func (c *checkpoints) get(logURL string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := CheckpointKey(logURL)
+	index, ok := c.indexes[key]
+	return c.held(key, index), ok
+}
+
+// snapshot returns a copy of all checkpoints
+func (c *checkpoints) snapshot() Checkpoints {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	indexes := make(Checkpoints, len(c.indexes))
+	for key, index := range c.indexes {
+		indexes[key] = c.held(key, index)
+	}
+	// A log whose messages were all dropped resumes before the first of them
+	for key, gap := range c.gaps {
+		if _, ok := indexes[key]; !ok {
+			indexes[key] = gap
+		}
+	}
+	return indexes
+}
+
+// held lowers a checkpoint to its backfill and gap holds; c.mu must be held
+func (c *checkpoints) held(key string, index int64) int64 {
+	if backfill, ok := c.backfills[key]; ok {
+		index = min(index, backfill)
+	}
+	if gap, ok := c.gaps[key]; ok {
+		index = min(index, gap)
+	}
+	return index
+}
+
+// LoadCheckpoints reads checkpoints saved by SaveCheckpoints. A missing file yields no
+// checkpoints and no error.
+func LoadCheckpoints(path string) (Checkpoints, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Checkpoints{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoints: %w", err)
+	}
+	var indexes Checkpoints
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return nil, fmt.Errorf("checkpoint file %s: %w", path, err)
+	}
+	if indexes == nil {
+		indexes = Checkpoints{}
+	}
+	return indexes, nil
+}
+
+// SaveCheckpoints writes checkpoints, as returned by Monitor.Checkpoints, to path as
+// JSON, replacing the file atomically
+func SaveCheckpoints(path string, indexes Checkpoints) error {
+	data, err := json.MarshalIndent(indexes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoints: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write checkpoints: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames it
+// over path, so readers never see a partly written file, even after a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// peekCheckpoint extracts the source URL and certificate index of a raw message
+// without decoding it, so messages skipped by the prefilter still advance checkpoints
+func peekCheckpoint(data []byte) (string, int64, bool) {
+	value := jsonValueAfter(data, []byte(`"cert_index"`))
+	if value == nil {
+		return "", 0, false
+	}
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	index, err := strconv.ParseInt(string(value[:end]), 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	source := bytes.Index(data, []byte(`"source"`))
+	if source < 0 {
+		return "", 0, false
+	}
+	value = jsonValueAfter(data[source:], []byte(`"url"`))
+	if len(value) == 0 || value[0] != '"' {
+		return "", 0, false
+	}
+	end = bytes.IndexByte(value[1:], '"')
+	if end < 0 {
+		return "", 0, false
+	}
+	url := strings.ReplaceAll(string(value[1:1+end]), `\/`, "/")
+	return url, index, url != ""
+}
+
+// jsonValueAfter returns the data following an object key and its colon, or nil
+func jsonValueAfter(data, key []byte) []byte {
+	i := bytes.Index(data, key)
+	if i < 0 {
+		return nil
+	}
+	rest := bytes.TrimLeft(data[i+len(key):], " \t\r\n")
+	if len(rest) == 0 || rest[0] != ':' {
+		return nil
+	}
+	return bytes.TrimLeft(rest[1:], " \t\r\n")
+}
@@ -0,0 +1,337 @@
+package certstream
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate types reported in CertEvent.CertType when classification is enabled
+const (
+	CertTypeNewDomain    = "NEW_DOMAIN"    // no certificate was seen before for the registrable domain
+	CertTypeNewName      = "NEW_NAME"      // the registrable domain is known, but a name in the certificate is not
+	CertTypeRenewal      = "RENEWAL"       // the same names were certified before by the same issuer
+	CertTypeReissue      = "REISSUE"       // the same names with a different key while the previous certificate was far from expiry
+	CertTypeIssuerChange = "ISSUER_CHANGE" // the same names were last certified by a different issuer
+)
+
+// DefaultClassifierSize is the default number of registrable domains a Classifier remembers
+const DefaultClassifierSize = 100000
+
+// maxCertsPerDomain bounds the certificates remembered per registrable domain
+const maxCertsPerDomain = 32
+
+// maxNamesPerDomain bounds the names remembered per registrable domain, so a hosting
+// domain issuing a certificate per customer does not grow without limit
+const maxNamesPerDomain = 1000
+
+// classifierSaveInterval is how often the monitor saves the classifier state while running
+const classifierSaveInterval = 5 * time.Minute
+
+// Classifier labels certificates by comparing them with the certificates seen before
+// for the same registrable domains. It remembers up to a fixed number of registrable
+// domains, forgetting the least recently seen first, and can be saved to and loaded
+// from a file so the history survives restarts.
+type Classifier struct {
+	mu      sync.Mutex
+	size    int
+	domains map[string]*list.Element // registrable domain -> element holding *domainHistory
+	lru     *list.List               // most recently seen first
+}
+
+// domainHistory is what the classifier knows about one registrable domain
+type domainHistory struct {
+	Domain string                 `json:"domain"`
+	Names  map[string]int64       `json:"names"`           // name seen under the domain -> last not before
+	Certs  map[string]*certRecord `json:"certs,omitempty"` // sorted SAN set -> last certificate for it
+}
+
+// certRecord is the last certificate seen for a SAN set
+type certRecord struct {
+	Serial    string `json:"serial"`
+	Issuer    string `json:"issuer"`
+	Key       string `json:"key,omitempty"` // subject key identifier or public key hash
+	NotBefore int64  `json:"not_before"`
+	NotAfter  int64  `json:"not_after"`
+	Type      string `json:"type"`
+}
+
+// NewClassifier creates a classifier remembering up to size registrable domains
+// (DefaultClassifierSize when size is not positive)
+func NewClassifier(size int) *Classifier {
+	if size <= 0 {
+		size = DefaultClassifierSize
+	}
+	return &Classifier{size: size, domains: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Classify labels an event's certificate and records it. The event's X509 field is
+// used for the key when present, otherwise the subject key identifier. Messages
+// without domains get no label.
+func (c *Classifier) Classify(event *CertEvent) string {
+	leaf := &event.Certificate.Data.LeafCert
+	names := sanSet(leaf.AllDomains)
+	if len(names) == 0 {
+		return ""
+	}
+	record := &certRecord{
+		Serial:    strings.ToUpper(strings.TrimLeft(leaf.SerialNumber, "0")),
+		Issuer:    leaf.Issuer.Aggregated,
+		Key:       leaf.Extensions.SubjectKeyIdentifier,
+		NotBefore: int64(leaf.NotBefore),
+		NotAfter:  int64(leaf.NotAfter),
+	}
+	if record.Issuer == "" {
+		record.Issuer = leaf.Issuer.O
+	}
+	if event.X509 != nil {
+		sum := sha256.Sum256(event.X509.RawSubjectPublicKeyInfo)
+		record.Key = "spki:" + hex.EncodeToString(sum[:])
+	}
+	setKey := strings.Join(names, ",")
+
+	// Group the names by registrable domain
+	byDomain := make(map[string][]string)
+	for _, name := range names {
+		domain := RegistrableDomain(strings.TrimPrefix(name, "*."))
+		if domain == "" {
+			domain = name
+		}
+		byDomain[domain] = append(byDomain[domain], name)
+	}
+	domains := make([]string, 0, len(byDomain))
+	for domain := range byDomain {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	label := CertTypeRenewal
+	for _, domain := range domains {
+		history := c.history(domain)
+		if history == nil {
+			label = mostNotable(label, CertTypeNewDomain)
+			continue
+		}
+		for _, name := range byDomain[domain] {
+			if _, ok := history.Names[name]; !ok {
+				label = mostNotable(label, CertTypeNewName)
+				break
+			}
+		}
+		if previous, ok := history.Certs[setKey]; ok {
+			label = mostNotable(label, compareCerts(previous, record))
+		}
+	}
+
+	record.Type = label
+	for _, domain := range domains {
+		c.remember(domain, byDomain[domain], setKey, record)
+	}
+	return label
+}
+
+// compareCerts labels a certificate for a SAN set that was certified before
+func compareCerts(previous, current *certRecord) string {
+	switch {
+	case previous.Serial != "" && previous.Serial == current.Serial && previous.Issuer == current.Issuer:
+		// The precertificate and final certificate of one issuance share the label
+		return previous.Type
+	case previous.Issuer != current.Issuer && previous.Issuer != "" && current.Issuer != "":
+		return CertTypeIssuerChange
+	case previous.Key != "" && current.Key != "" && previous.Key != current.Key && !nearExpiry(previous, current.NotBefore):
+		return CertTypeReissue
+	}
+	return CertTypeRenewal
+}
+
+// nearExpiry reports whether less than a third of the previous certificate's lifetime
+// was left when the new one became valid, as with scheduled renewals
+func nearExpiry(previous *certRecord, notBefore int64) bool {
+	lifetime := previous.NotAfter - previous.NotBefore
+	if lifetime <= 0 || notBefore == 0 {
+		return true
+	}
+	return previous.NotAfter-notBefore < lifetime/3
+}
+
+// certTypeRank orders labels from least to most notable
+var certTypeRank = map[string]int{
+	CertTypeRenewal:      0,
+	CertTypeReissue:      1,
+	CertTypeIssuerChange: 2,
+	CertTypeNewName:      3,
+	CertTypeNewDomain:    4,
+}
+
+// mostNotable returns the more notable of two labels
+func mostNotable(a, b string) string {
+	if certTypeRank[b] > certTypeRank[a] {
+		return b
+	}
+	return a
+}
+
+// history returns the history of a registrable domain, marking it as recently seen;
+// c.mu must be held
+func (c *Classifier) history(domain string) *domainHistory {
+	element, ok := c.domains[domain]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*domainHistory)
+}
+
+// remember records names and a certificate under a registrable domain; c.mu must be held
+func (c *Classifier) remember(domain string, names []string, setKey string, record *certRecord) {
+	history := c.history(domain)
+	if history == nil {
+		history = &domainHistory{Domain: domain}
+		c.add(history)
+	}
+	if history.Names == nil {
+		history.Names = make(map[string]int64)
+	}
+	for _, name := range names {
+		history.Names[name] = record.NotBefore
+	}
+	history.forgetNames()
+	if history.Certs == nil {
+		history.Certs = make(map[string]*certRecord)
+	}
+	history.Certs[setKey] = record
+
+	// Forget the SAN set certified longest ago
+	if len(history.Certs) > maxCertsPerDomain {
+		oldestKey, oldest := "", int64(0)
+		for key, cert := range history.Certs {
+			if oldestKey == "" || cert.NotBefore < oldest {
+				oldestKey, oldest = key, cert.NotBefore
+			}
+		}
+		delete(history.Certs, oldestKey)
+	}
+}
+
+// clone returns a copy of the history sharing no maps with it. Certificate records are
+// replaced rather than modified, so they are shared.
+func (h *domainHistory) clone() *domainHistory {
+	names := make(map[string]int64, len(h.Names))
+	for name, notBefore := range h.Names {
+		names[name] = notBefore
+	}
+	certs := make(map[string]*certRecord, len(h.Certs))
+	for key, cert := range h.Certs {
+		certs[key] = cert
+	}
+	return &domainHistory{Domain: h.Domain, Names: names, Certs: certs}
+}
+
+// forgetNames forgets the names certified longest ago beyond maxNamesPerDomain
+func (h *domainHistory) forgetNames() {
+	for len(h.Names) > maxNamesPerDomain {
+		oldestName, oldest := "", int64(0)
+		for name, notBefore := range h.Names {
+			if oldestName == "" || notBefore < oldest || (notBefore == oldest && name < oldestName) {
+				oldestName, oldest = name, notBefore
+			}
+		}
+		delete(h.Names, oldestName)
+	}
+}
+
+// add inserts a history as most recently seen, evicting the least recently seen
+// domains beyond the size limit; c.mu must be held
+func (c *Classifier) add(history *domainHistory) {
+	c.domains[history.Domain] = c.lru.PushFront(history)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.domains, oldest.Value.(*domainHistory).Domain)
+	}
+}
+
+// Len returns the number of registrable domains remembered
+func (c *Classifier) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Save writes the history to path as JSON, replacing the file atomically
+func (c *Classifier) Save(path string) error {
+	// Copy under the lock and encode after, so classifying does not wait for the encoding
+	c.mu.Lock()
+	// Least recently seen first, so loading restores the order
+	histories := make([]*domainHistory, 0, c.lru.Len())
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		histories = append(histories, element.Value.(*domainHistory).clone())
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(histories)
+	if err != nil {
+		return fmt.Errorf("failed to encode classifier state: %w", err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write classifier state: %w", err)
+	}
+	return nil
+}
+
+// Load replaces the history with the one saved at path. A missing file is not an error.
+func (c *Classifier) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read classifier state: %w", err)
+	}
+	var histories []*domainHistory
+	if err := json.Unmarshal(data, &histories); err != nil {
+		return fmt.Errorf("classifier state %s: %w", path, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.domains = make(map[string]*list.Element, len(histories))
+	c.lru.Init()
+	for _, history := range histories {
+		if history == nil || history.Domain == "" {
+			continue
+		}
+		history.forgetNames()
+		c.add(history)
+	}
+	return nil
+}
+
+// sanSet returns the lowercased, sorted and de-duplicated names of a certificate
+func sanSet(domains []string) []string {
+	names := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			names = append(names, domain)
+		}
+	}
+	sort.Strings(names)
+	out := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
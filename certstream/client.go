@@ -3,36 +3,48 @@ package certstream
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"math"
 	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/coder/websocket"
 )
 
 // Monitor is the certstream client that monitors certificate transparency logs
 type Monitor struct {
-	config            Config
-	eventsChan        chan CertEvent
-	rawMessageChan    chan []byte
-	stopChan          chan struct{}
-	logger            Logger
-	lowerDomains      [][]byte
-	rawReceived       uint64
-	rawDropped        uint64
-	prefilterHits     uint64
-	prefilterSkips    uint64
-	certsDecoded      uint64
-	eventsSent        uint64
-	eventsDropped     uint64
-	wg                sync.WaitGroup
-	mu                sync.Mutex
-	isRunning         bool
-	reconnectAttempts int
-	droppedMessages   uint64 // Counter for dropped messages
+	config          Config
+	events          *stage[CertEvent]
+	raw             *stage[[]byte]
+	stopChan        chan struct{}
+	logger          Logger
+	matcher         atomic.Pointer[matcher] // swapped copy-on-write by SetDomains and friends
+	domainsMu       sync.Mutex              // serializes watch list updates
+	exclusions      *exclusions
+	dedup           *dedupCache // nil when deduplication is off
+	dedupKey        DedupKey
+	classifier      *Classifier // nil when classification is off
+	checkpoints     *checkpoints
+	recordFailed    uint32
+	sources         []*sourceRunner
+	handlers        []*registeredHandler // registered with Handle
+	handlerDrain    chan struct{}        // closed by Stop once the workers are done
+	handlerWg       sync.WaitGroup
+	rawReceived     uint64
+	processed       uint64
+	prefilterHits   uint64
+	prefilterSkips  uint64
+	certsDecoded    uint64
+	excluded        uint64
+	duplicates      uint64
+	eventsSent      uint64
+	wg              sync.WaitGroup
+	mu              sync.Mutex
+	isRunning       bool
+	droppedMessages uint64 // Counter for dropped messages
 }
 
 // New creates a new certificate monitor with the given options
@@ -62,29 +74,216 @@ func New(options ...Option) *Monitor {
 	if config.WorkerCount < 1 {
 		config.WorkerCount = 4
 	}
+	if config.CheckpointGapLimit <= 0 {
+		config.CheckpointGapLimit = DefaultCheckpointGapLimit
+	}
 
 	monitor := &Monitor{
-		config:            config,
-		eventsChan:        make(chan CertEvent, config.BufferSize),
-		rawMessageChan:    make(chan []byte, config.BufferSize*3),
-		stopChan:          make(chan struct{}),
-		logger:            NewDefaultLogger(config.Debug),
-		reconnectAttempts: 0,
-	}
-
-	if len(config.Domains) > 0 {
-		monitor.lowerDomains = make([][]byte, 0, len(config.Domains))
-		for _, domain := range config.Domains {
-			if domain == "" {
-				continue
+		config:   config,
+		stopChan: make(chan struct{}),
+		logger:   NewDefaultLogger(config.Debug),
+	}
+	monitor.events = newStage("event", config.BufferSize, config.EventBackpressure, monitor.logger, encodeEvent, decodeEvent)
+	monitor.raw = newStage("raw", config.BufferSize*3, config.RawBackpressure, monitor.logger, encodeRaw, decodeRaw)
+	monitor.raw.onDrop = monitor.rawDropped
+
+	monitor.matcher.Store(newMatcher(config, monitor.logger))
+	monitor.exclusions = newExclusions(config.ExcludeRules, monitor.logger)
+
+	// Resume from explicit checkpoints and those saved by an earlier run
+	monitor.checkpoints = newCheckpoints(config.Checkpoints)
+	if config.CheckpointFile != "" {
+		saved, err := LoadCheckpoints(config.CheckpointFile)
+		if err != nil {
+			monitor.logger.Error("Ignoring checkpoint file: %v", err)
+		}
+		for log, index := range saved {
+			monitor.checkpoints.update(log, index)
+		}
+	}
+	resume := monitor.checkpoints.snapshot()
+
+	// The websocket runs unless disabled with an empty URL; CT logs and custom sources
+	// are consumed next to it. Configured CT logs continue after their checkpoint; the
+	// other checkpointed logs are backfilled separately.
+	sources := websocketSources(config, monitor.logger)
+	followed := make(map[string]bool)
+	for _, log := range config.CTLogs {
+		if err := log.Validate(); err != nil {
+			monitor.logger.Error("Ignoring CT log: %v", err)
+			continue
+		}
+		source := NewCTLogSource(log, config.CTPollInterval, config.CTBatchSize)
+		if index, ok := resume[CheckpointKey(log.URL)]; ok {
+			source.resumeAt(index+1, config.CheckpointGapLimit)
+			source.holdCheckpoint(monitor.checkpoints)
+		}
+		followed[CheckpointKey(log.URL)] = true
+		sources = append(sources, source)
+	}
+	for key := range followed {
+		delete(resume, key)
+	}
+	sources = append(sources, backfillSources(resume, config, monitor.checkpoints)...)
+	sources = append(sources, config.Sources...)
+	for _, source := range sources {
+		monitor.sources = append(monitor.sources, newSourceRunner(source))
+	}
+
+	// Precertificates, reconnect replays and several sources repeat certificates, so
+	// deduplicate by default
+	dedupKey := config.DedupKey
+	if dedupKey != "" {
+		if _, err := ParseDedupKey(string(dedupKey)); err != nil {
+			monitor.logger.Error("Ignoring dedup setting: %v", err)
+			dedupKey = ""
+		}
+	}
+	if dedupKey == "" {
+		dedupKey = DefaultDedupKey
+	}
+	if dedupKey != DedupKeyNone {
+		monitor.dedupKey = dedupKey
+		monitor.dedup = newDedupCache(config.DedupTTL, config.DedupSize)
+	}
+
+	if config.Classify {
+		monitor.classifier = NewClassifier(DefaultClassifierSize)
+		if config.ClassifierState != "" {
+			if err := monitor.classifier.Load(config.ClassifierState); err != nil {
+				monitor.logger.Error("Ignoring classifier state: %v", err)
 			}
-			monitor.lowerDomains = append(monitor.lowerDomains, []byte(strings.ToLower(domain)))
 		}
 	}
 
 	return monitor
 }
 
+// backfillSources returns sources fetching, once, the entries logged after each
+// checkpoint while the monitor was not running. CertStream servers report the CT log
+// URL of every certificate, so the logs can be polled directly. Each holds its log's
+// checkpoint until done.
+func backfillSources(resume Checkpoints, config Config, checkpoints *checkpoints) []Source {
+	keys := make([]string, 0, len(resume))
+	for key := range resume {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sources := make([]Source, 0, len(keys))
+	for _, key := range keys {
+		log := CTLog{URL: "https://" + key, Name: "backfill:" + key}
+		if log.Validate() != nil {
+			continue
+		}
+		source := NewCTLogSource(log, config.CTPollInterval, config.CTBatchSize)
+		source.resumeAt(resume[key]+1, config.CheckpointGapLimit)
+		source.backfillOnly = true
+		source.holdCheckpoint(checkpoints)
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// websocketSources returns the sources for the configured websocket endpoints
+func websocketSources(config Config, logger Logger) []Source {
+	urls := config.WebSocketURLs
+	if len(urls) == 0 && config.WebSocketURL != "" {
+		urls = []string{config.WebSocketURL}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	if len(urls) == 1 {
+		return []Source{NewWebSocketSource(urls[0])}
+	}
+
+	switch config.WebSocketMode {
+	case WebSocketModeFanIn:
+		sources := make([]Source, len(urls))
+		for i, url := range urls {
+			sources[i] = NewWebSocketSource(url)
+		}
+		return sources
+	case WebSocketModeFailover, "":
+	default:
+		logger.Error("Unknown websocket mode %q, using %s", config.WebSocketMode, WebSocketModeFailover)
+	}
+	return []Source{NewFailoverSource(urls)}
+}
+
+// Domains returns the current watch list
+func (m *Monitor) Domains() []string {
+	m.domainsMu.Lock()
+	defer m.domainsMu.Unlock()
+	return append([]string{}, m.config.Domains...)
+}
+
+// SetDomains replaces the watch list without restarting the monitor. The new matcher is
+// built off to the side and swapped in atomically, so workers never block on the update.
+// An empty list monitors all certificates.
+func (m *Monitor) SetDomains(domains []string) {
+	m.domainsMu.Lock()
+	defer m.domainsMu.Unlock()
+	m.updateDomains(append([]string{}, domains...))
+}
+
+// AddDomains adds entries to the watch list, ignoring ones already present
+func (m *Monitor) AddDomains(domains ...string) {
+	m.domainsMu.Lock()
+	defer m.domainsMu.Unlock()
+
+	present := make(map[string]bool, len(m.config.Domains))
+	for _, domain := range m.config.Domains {
+		present[normalizeWatchEntry(domain)] = true
+	}
+	updated := append([]string{}, m.config.Domains...)
+	for _, domain := range domains {
+		key := normalizeWatchEntry(domain)
+		if key == "" || present[key] {
+			continue
+		}
+		present[key] = true
+		updated = append(updated, domain)
+	}
+	m.updateDomains(updated)
+}
+
+// RemoveDomains removes entries from the watch list
+func (m *Monitor) RemoveDomains(domains ...string) {
+	m.domainsMu.Lock()
+	defer m.domainsMu.Unlock()
+
+	remove := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		remove[normalizeWatchEntry(domain)] = true
+	}
+	updated := make([]string, 0, len(m.config.Domains))
+	for _, domain := range m.config.Domains {
+		if !remove[normalizeWatchEntry(domain)] {
+			updated = append(updated, domain)
+		}
+	}
+	m.updateDomains(updated)
+}
+
+// updateDomains builds and publishes a matcher for the new watch list; domainsMu must be held
+func (m *Monitor) updateDomains(domains []string) {
+	config := m.config
+	config.Domains = domains
+	m.matcher.Store(newMatcher(config, m.logger))
+	m.config.Domains = domains
+	m.logger.Debug("Watch list updated: %d entries", len(domains))
+}
+
+// normalizeWatchEntry returns the canonical form of a watch entry for comparisons
+func normalizeWatchEntry(domain string) string {
+	if pattern, err := ParsePattern(domain); err == nil {
+		return pattern.String()
+	}
+	return strings.TrimSpace(domain)
+}
+
 // SetLogger sets a custom logger for the monitor
 func (m *Monitor) SetLogger(logger Logger) {
 	m.mu.Lock()
@@ -92,9 +291,10 @@ func (m *Monitor) SetLogger(logger Logger) {
 	m.logger = logger
 }
 
-// Events returns the channel for certificate events
+// Events returns the channel for certificate events. It must not be read when
+// handlers are registered, see Handle.
 func (m *Monitor) Events() <-chan CertEvent {
-	return m.eventsChan
+	return m.events.ch
 }
 
 // Start starts the certificate monitoring process
@@ -113,9 +313,106 @@ func (m *Monitor) Start() {
 		go m.processWorker()
 	}
 
-	// Start main monitor goroutine
-	m.wg.Add(1)
-	go m.monitor()
+	// Hand the events to the registered handlers
+	if len(m.handlers) > 0 {
+		m.handlerDrain = make(chan struct{})
+		m.startHandlers(m.handlerDrain)
+	}
+
+	// Queue spilled messages again as room frees up
+	m.raw.logger, m.events.logger = m.logger, m.logger
+	if m.raw.spill != nil {
+		m.wg.Add(1)
+		go m.runFeed(m.raw.feed, m.stopChan)
+	}
+	if m.events.spill != nil {
+		m.wg.Add(1)
+		go m.runFeed(m.events.feed, m.stopChan)
+	}
+
+	if len(m.sources) == 0 {
+		m.logger.Error("No certificate sources configured")
+	}
+	for _, runner := range m.sources {
+		if setter, ok := runner.source.(interface{ SetLogger(Logger) }); ok {
+			setter.SetLogger(m.logger)
+		}
+		m.wg.Add(1)
+		go m.runSource(runner, m.stopChan)
+	}
+
+	if m.classifier != nil && m.config.ClassifierState != "" {
+		m.wg.Add(1)
+		go m.saveLoop(m.stopChan, classifierSaveInterval, m.saveClassifier)
+	}
+	if m.config.CheckpointFile != "" {
+		m.wg.Add(1)
+		go m.saveLoop(m.stopChan, checkpointSaveInterval, m.saveCheckpoints)
+	}
+}
+
+// runFeed runs a stage's spill feeder until the monitor stops
+func (m *Monitor) runFeed(feed func(done <-chan struct{}), stop <-chan struct{}) {
+	defer m.wg.Done()
+	feed(stop)
+}
+
+// saveLoop periodically calls save until the monitor stops
+func (m *Monitor) saveLoop(stop <-chan struct{}, interval time.Duration, save func()) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
+}
+
+// Checkpoints returns the highest processed certificate index per CT log, keyed by
+// CheckpointKey of the log URL. Pass them to WithCheckpoints, or use
+// WithCheckpointFile, to resume after a restart.
+func (m *Monitor) Checkpoints() Checkpoints {
+	return m.checkpoints.snapshot()
+}
+
+// saveCheckpoints writes the checkpoints to the checkpoint file, if configured
+func (m *Monitor) saveCheckpoints() {
+	if m.config.CheckpointFile == "" {
+		return
+	}
+	if err := SaveCheckpoints(m.config.CheckpointFile, m.Checkpoints()); err != nil {
+		m.logger.Error("%v", err)
+	}
+}
+
+// saveClassifier writes the classifier history to the state file, if configured
+func (m *Monitor) saveClassifier() {
+	if m.classifier == nil || m.config.ClassifierState == "" {
+		return
+	}
+	if err := m.classifier.Save(m.config.ClassifierState); err != nil {
+		m.logger.Error("%v", err)
+	}
+}
+
+// CTLogPositions returns, per CT log name, the index of the next entry to be delivered.
+// Logs that have not yet seen a tree head are omitted.
+func (m *Monitor) CTLogPositions() map[string]int64 {
+	positions := make(map[string]int64)
+	for _, runner := range m.sources {
+		if source, ok := runner.source.(*CTLogSource); ok {
+			if position := source.Position(); position >= 0 {
+				positions[source.Name()] = position
+			}
+		}
+	}
+	return positions
 }
 
 // Stop stops the certificate monitoring process
@@ -129,14 +426,22 @@ func (m *Monitor) Stop() {
 
 	close(m.stopChan)
 	m.wg.Wait()
+	if m.handlerDrain != nil {
+		close(m.handlerDrain)
+		m.handlerWg.Wait()
+		m.handlerDrain = nil
+	}
 	m.isRunning = false
+	m.saveClassifier()
+	m.saveCheckpoints()
 
 	// Create a new stopChan for future Start calls
 	m.stopChan = make(chan struct{})
 }
 
-// monitor is the internal monitoring loop
-func (m *Monitor) monitor() {
+// runSource consumes a source until the monitor stops or the source is exhausted,
+// restarting it with backoff after errors
+func (m *Monitor) runSource(runner *sourceRunner, stop <-chan struct{}) {
 	defer m.wg.Done()
 
 	ctx, cancel := context.WithCancel(m.config.Context)
@@ -145,61 +450,52 @@ func (m *Monitor) monitor() {
 	// Set up cancellation on stop
 	go func() {
 		select {
-		case <-m.stopChan:
+		case <-stop:
 			cancel()
 		case <-ctx.Done():
 		}
 	}()
 
+	name := runner.source.Name()
+	attempts := 0
 	for {
-		select {
-		case <-ctx.Done():
+		connected, err := m.consume(ctx, runner)
+		if ctx.Err() != nil {
 			return
-		case <-m.stopChan:
+		}
+		if connected {
+			// Only back off further while the source keeps failing to deliver
+			attempts = 0
+		}
+		if errors.Is(err, io.EOF) {
+			atomic.StoreUint32(&runner.finished, 1)
+			m.logger.Info("Source %s finished", name)
 			return
-		default:
-			if success := m.connectAndProcess(ctx); success {
-				// Reset reconnect attempts on successful connection
-				m.reconnectAttempts = 0
-			} else {
-				// Increment reconnect attempts
-				m.reconnectAttempts++
-			}
+		}
 
-			// Check if we should exit
-			select {
-			case <-ctx.Done():
-				return
-			case <-m.stopChan:
-				return
-			default:
-				// Calculate backoff with exponential increase
-				backoff := m.calculateBackoff()
-				if backoff == 0 {
-					m.logger.Info("Connection lost. Reconnecting immediately...")
-				} else {
-					m.logger.Info("Connection lost. Reconnecting in %v...", backoff)
-				}
-
-				// Use a timer so we can be interrupted by stop signal
-				timer := time.NewTimer(backoff)
-				select {
-				case <-timer.C:
-					// Backoff completed, continue to reconnect
-				case <-ctx.Done():
-					timer.Stop()
-					return
-				case <-m.stopChan:
-					timer.Stop()
-					return
-				}
-			}
+		atomic.AddUint64(&runner.restarts, 1)
+		attempts++
+		backoff := m.calculateBackoff(attempts)
+		if backoff == 0 {
+			m.logger.Info("Connection to %s lost. Reconnecting immediately...", name)
+		} else {
+			m.logger.Info("Connection to %s lost. Reconnecting in %v...", name, backoff)
+		}
+
+		// Use a timer so we can be interrupted by stop signal
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+			// Backoff completed, continue to reconnect
+		case <-ctx.Done():
+			timer.Stop()
+			return
 		}
 	}
 }
 
 // calculateBackoff computes the backoff duration using exponential strategy
-func (m *Monitor) calculateBackoff() time.Duration {
+func (m *Monitor) calculateBackoff(attempts int) time.Duration {
 	// If backoff is disabled, reconnect immediately
 	if m.config.DisableBackoff {
 		return 0
@@ -210,7 +506,7 @@ func (m *Monitor) calculateBackoff() time.Duration {
 
 	// Calculate exponential backoff with a small random jitter
 	jitter := 0.1 + 0.2*rand.Float64() // 10-30% jitter
-	calculatedBackoff := backoffSeconds * math.Pow(2, float64(m.reconnectAttempts)) * (1 + jitter)
+	calculatedBackoff := backoffSeconds * math.Pow(2, float64(attempts)) * (1 + jitter)
 
 	// Cap at maximum timeout
 	if calculatedBackoff > maxBackoffSeconds {
@@ -220,81 +516,90 @@ func (m *Monitor) calculateBackoff() time.Duration {
 	return time.Duration(calculatedBackoff) * time.Second
 }
 
-// connectAndProcess establishes the websocket connection and processes incoming certificates
-func (m *Monitor) connectAndProcess(ctx context.Context) bool {
-	m.logger.Debug("Connecting to %s", m.config.WebSocketURL)
-
-	conn, _, err := websocket.Dial(ctx, m.config.WebSocketURL, nil)
-	if err != nil {
-		m.logger.Error("Connection error: %v", err)
-		return false
+// consume starts a source and queues its messages until it fails. It reports whether
+// the source delivered anything, which resets the reconnect backoff.
+func (m *Monitor) consume(ctx context.Context, runner *sourceRunner) (connected bool, err error) {
+	source := runner.source
+	if err := source.Start(ctx); err != nil {
+		m.logger.Error("Connection error from %s: %v", source.Name(), err)
+		return false, err
 	}
-	defer conn.Close(websocket.StatusAbnormalClosure, "")
-
-	// Set message read limit to 100MB to handle large certificate messages with full chains
-	conn.SetReadLimit(100 * 1024 * 1024)
-
-	m.logger.Debug("Connected to CertStream service")
-
-	// Start ping goroutine
-	pingCtx, pingCancel := context.WithCancel(ctx)
-	defer pingCancel()
-
-	go m.pingLoop(pingCtx, conn)
-
-	return m.processMessages(ctx, conn)
-}
-
-// pingLoop sends periodic pings to keep the connection alive
-func (m *Monitor) pingLoop(ctx context.Context, conn *websocket.Conn) {
-	ticker := time.NewTicker(25 * time.Second)
-	defer ticker.Stop()
+	defer source.Close()
 
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			if err := conn.Ping(ctx); err != nil {
-				m.logger.Debug("Ping failed: %v", err)
-				return
+		data, err := source.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				m.logger.Error("Read error from %s: %v", source.Name(), err)
 			}
-			m.logger.Debug("Sent ping to server")
+			return connected, err
+		}
+		connected = true
+		m.record(source.Name(), data)
+		// Heartbeats only show that the source is alive
+		if isHeartbeat(data) {
+			atomic.AddUint64(&runner.heartbeats, 1)
+			runner.lastHeartbeat.Store(time.Now().UnixNano())
+			continue
+		}
+		if !m.queueRaw(ctx, runner, data) {
+			return connected, ctx.Err()
 		}
 	}
 }
 
-// processMessages reads certificate messages from the WebSocket and queues them for processing
-func (m *Monitor) processMessages(ctx context.Context, conn *websocket.Conn) bool {
-	for {
-		select {
-		case <-ctx.Done():
-			conn.Close(websocket.StatusNormalClosure, "")
-			return true
-		case <-m.stopChan:
-			conn.Close(websocket.StatusNormalClosure, "")
-			return true
-		default:
-			_, data, err := conn.Read(ctx)
-			if err != nil {
-				m.logger.Error("Read error: %v", err)
-				return false
-			}
-			atomic.AddUint64(&m.rawReceived, 1)
-
-			// Queue message for processing without blocking
-			select {
-			case m.rawMessageChan <- data:
-				// Successfully queued
-			default:
-				// Buffer full, drop message (should rarely happen with large buffer)
-				dropped := atomic.AddUint64(&m.droppedMessages, 1)
-				atomic.AddUint64(&m.rawDropped, 1)
-				if dropped%1000 == 0 {
-					m.logger.Error("Dropped %d messages due to processing backlog", dropped)
-				}
+// record writes a raw message to the recorder, if configured. The recorder stops at
+// its first write error, which is logged once.
+func (m *Monitor) record(source string, data []byte) {
+	recorder := m.config.Recorder
+	if recorder == nil {
+		return
+	}
+	if err := recorder.Record(source, time.Now(), data); err != nil && atomic.CompareAndSwapUint32(&m.recordFailed, 0, 1) {
+		m.logger.Error("Recording stopped: %v", err)
+	}
+}
+
+// queueRaw hands a message to the workers. Lossy sources, which cannot be paused,
+// apply the raw backpressure policy when the queue is full; others wait. It returns
+// false when the context ends while waiting.
+func (m *Monitor) queueRaw(ctx context.Context, runner *sourceRunner, data []byte) bool {
+	if runner.lossy {
+		candidate := func() bool {
+			matcher := m.matcher.Load()
+			return matcher.empty() || matcher.prefilter(data)
+		}
+		if !m.raw.push(data, candidate, ctx.Done()) {
+			atomic.AddUint64(&runner.dropped, 1)
+			dropped := atomic.AddUint64(&m.droppedMessages, 1)
+			if dropped%1000 == 0 {
+				m.logger.Error("Dropped %d messages due to processing backlog", dropped)
 			}
 		}
+		atomic.AddUint64(&runner.received, 1)
+		atomic.AddUint64(&m.rawReceived, 1)
+		return true
+	}
+
+	select {
+	case m.raw.ch <- data:
+		atomic.AddUint64(&runner.received, 1)
+		atomic.AddUint64(&m.rawReceived, 1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// rawDropped holds the checkpoint of a log below a dropped message the watch list
+// could match, so the next run backfills it
+func (m *Monitor) rawDropped(data []byte) {
+	url, index, ok := peekCheckpoint(data)
+	if !ok {
+		return
+	}
+	if matcher := m.matcher.Load(); matcher.empty() || matcher.prefilter(data) {
+		m.checkpoints.dropped(url, index)
 	}
 }
 
@@ -306,91 +611,183 @@ func (m *Monitor) processWorker() {
 		select {
 		case <-m.stopChan:
 			return
-		case data, ok := <-m.rawMessageChan:
+		case data, ok := <-m.raw.ch:
 			if !ok {
 				return
 			}
 			m.processCertificate(data)
+			atomic.AddUint64(&m.processed, 1)
 		}
 	}
 }
 
 // processCertificate parses and handles a certificate message
 func (m *Monitor) processCertificate(data []byte) {
-	if len(m.config.Domains) > 0 && !m.quickPayloadMatch(data) {
+	// Every message advances its log's checkpoint, including those the prefilter skips
+	if url, index, ok := peekCheckpoint(data); ok {
+		defer m.checkpoints.update(url, index)
+	}
+
+	// Load the watch list once so a concurrent update cannot change it mid-certificate
+	matcher := m.matcher.Load()
+
+	if !matcher.empty() && !matcher.prefilter(data) {
 		atomic.AddUint64(&m.prefilterSkips, 1)
 		return
 	}
-	if len(m.config.Domains) > 0 {
+	if !matcher.empty() {
 		atomic.AddUint64(&m.prefilterHits, 1)
 	}
 
-	var cert CertData
-	if err := json.Unmarshal(data, &cert); err != nil {
-		m.logger.Error("JSON error: %v", err)
+	cert, ok := m.decodeMessage(data)
+	if !ok {
 		return
 	}
 	atomic.AddUint64(&m.certsDecoded, 1)
 
-	if cert.MessageType != "certificate_update" {
-		return
-	}
-
 	event := m.createCertEvent(cert)
 
 	// If no domains specified, send all certificates
-	if len(m.config.Domains) == 0 {
+	if matcher.empty() {
+		if !m.exclusions.empty() && m.exclusions.excludesAll(&cert) {
+			atomic.AddUint64(&m.excluded, 1)
+			return
+		}
+		if m.duplicate(&cert) {
+			return
+		}
+		m.applyDER(&event)
+		m.classify(&event)
 		m.sendEvent(event)
 		return
 	}
 
-	// Filter by specified domains
-	matchedDomains := m.findMatchedDomains(cert)
-	if len(matchedDomains) > 0 {
-		event.MatchedDomains = matchedDomains
-		m.sendEvent(event)
+	// Filter by specified domains and certificate fields
+	matchedDomains, matches := matcher.evaluate(&cert, cert.Data.LeafCert.AllDomains)
+	if len(matchedDomains) == 0 {
+		return
 	}
+
+	// Drop known-good certificates before they reach consumers
+	if !m.exclusions.empty() {
+		kept := m.exclusions.filter(&cert, matches)
+		if kept == nil {
+			atomic.AddUint64(&m.excluded, 1)
+			return
+		}
+		if len(kept) < len(matches) {
+			domains := make([]string, len(kept))
+			for i, match := range kept {
+				domains[i] = match.Domain
+			}
+			matchedDomains, matches = matcher.evaluate(&cert, domains)
+		}
+	}
+
+	if m.duplicate(&cert) {
+		return
+	}
+	event.MatchedDomains = matchedDomains
+	event.Matches = matches
+	m.applyDER(&event)
+	m.classify(&event)
+	m.sendEvent(event)
+}
+
+// applyDER parses the DER certificate of an event about to be reported, when enabled,
+// and takes the validity and certificate type from it
+func (m *Monitor) applyDER(event *CertEvent) {
+	if !m.config.ParseDER || event.Certificate.Data.LeafCert.AsDER == "" {
+		return
+	}
+	cert, err := event.Certificate.ParseDER()
+	if err != nil {
+		m.logger.Debug("Failed to parse DER certificate: %v", err)
+		return
+	}
+	event.X509 = cert
+	event.Certificate.Data.LeafCert.NotBefore = float64(cert.NotBefore.Unix())
+	event.Certificate.Data.LeafCert.NotAfter = float64(cert.NotAfter.Unix())
+	event.CertType = certType(cert.NotBefore)
+}
+
+// classify replaces the certificate type of an event about to be reported with the
+// classifier's label, when enabled. Domains-only messages carry no certificate to compare.
+func (m *Monitor) classify(event *CertEvent) {
+	if m.classifier == nil || event.Certificate.MessageType == "dns_entries" {
+		return
+	}
+	if label := m.classifier.Classify(event); label != "" {
+		event.CertType = label
+	}
+}
+
+// duplicate reports whether the certificate was already reported within the dedup
+// window. Messages lacking the fields of the dedup key are never treated as duplicates.
+func (m *Monitor) duplicate(cert *CertData) bool {
+	if m.dedup == nil {
+		return false
+	}
+	identity := dedupIdentity(cert, m.dedupKey)
+	if identity == "" || !m.dedup.duplicate(identity, time.Now()) {
+		return false
+	}
+	atomic.AddUint64(&m.duplicates, 1)
+	return true
+}
+
+// decodeMessage decodes a certificate_update message, or a dns_entries message from a
+// domains-only endpoint into a CertData holding only the domains. Other message types
+// are ignored.
+func (m *Monitor) decodeMessage(data []byte) (CertData, bool) {
+	var cert CertData
+	err := json.Unmarshal(data, &cert)
+
+	// The data of dns_entries messages is a list of domains, which does not fit
+	// CertData; Unmarshal still fills in the message type
+	if cert.MessageType == "dns_entries" {
+		var entries struct {
+			Data []string `json:"data"`
+		}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			m.logger.Error("JSON error: %v", err)
+			return CertData{}, false
+		}
+		cert = CertData{MessageType: "dns_entries"}
+		cert.Data.LeafCert.AllDomains = entries.Data
+		cert.Data.Seen = float64(time.Now().Unix())
+		return cert, true
+	}
+
+	if err != nil {
+		m.logger.Error("JSON error: %v", err)
+		return CertData{}, false
+	}
+	return cert, cert.MessageType == "certificate_update"
 }
 
 // createCertEvent creates a CertEvent from certificate data
 func (m *Monitor) createCertEvent(cert CertData) CertEvent {
 	timestamp := time.Unix(int64(cert.Data.Seen), 0)
-	certType := "NEW"
-	if time.Unix(int64(cert.Data.LeafCert.NotBefore), 0).Add(24 * time.Hour).Before(time.Now()) {
-		certType = "RENEWAL"
+	kind := ""
+	if cert.MessageType != "dns_entries" {
+		kind = certType(time.Unix(int64(cert.Data.LeafCert.NotBefore), 0))
 	}
 
 	return CertEvent{
 		Certificate: cert,
 		Timestamp:   timestamp,
-		CertType:    certType,
-	}
-}
-
-// findMatchedDomains returns domains that match the configured watch list
-func (m *Monitor) findMatchedDomains(cert CertData) []string {
-	var matchedDomains []string
-	for _, watchDomain := range m.config.Domains {
-		for _, certDomain := range cert.Data.LeafCert.AllDomains {
-			if IsDomainMatch(certDomain, watchDomain) {
-				matchedDomains = append(matchedDomains, watchDomain)
-				break
-			}
-		}
+		CertType:    kind,
+		Chain:       cert.Data.Chain,
 	}
-	return matchedDomains
 }
 
-func (m *Monitor) quickPayloadMatch(data []byte) bool {
-	for _, domain := range m.lowerDomains {
-		if len(domain) == 0 {
-			continue
-		}
-		if bytesContainsFold(data, domain) {
-			return true
-		}
+// certType returns "RENEWAL" for certificates valid since more than a day and "NEW" otherwise
+func certType(notBefore time.Time) string {
+	if notBefore.Add(24 * time.Hour).Before(time.Now()) {
+		return "RENEWAL"
 	}
-	return false
+	return "NEW"
 }
 
 func bytesContainsFold(haystack []byte, needle []byte) bool {
@@ -426,34 +823,44 @@ func asciiLower(b byte) byte {
 	return b
 }
 
-// sendEvent sends an event to the events channel
+// sendEvent sends an event to the events channel, applying the event backpressure
+// policy when the consumer is too slow
 func (m *Monitor) sendEvent(event CertEvent) {
-	select {
-	case m.eventsChan <- event:
-		// Event sent successfully
+	if m.events.push(event, nil, m.stopChan) {
 		atomic.AddUint64(&m.eventsSent, 1)
-	default:
-		// Channel is full, skip the event (consumer is too slow)
-		atomic.AddUint64(&m.eventsDropped, 1)
-		if m.config.Debug {
-			m.logger.Debug("Event channel full, consumer too slow")
-		}
+	} else if m.config.Debug {
+		m.logger.Debug("Event channel full, consumer too slow")
 	}
 }
 
 // Stats returns a snapshot of monitor counters and queue depths.
 func (m *Monitor) Stats() MonitorStats {
+	sources := make([]SourceStats, len(m.sources))
+	for i, runner := range m.sources {
+		sources[i] = runner.stats()
+	}
+	handlers := make([]HandlerStats, len(m.handlers))
+	for i, h := range m.handlers {
+		handlers[i] = h.stats()
+	}
 	return MonitorStats{
 		RawReceived:    atomic.LoadUint64(&m.rawReceived),
-		RawDropped:     atomic.LoadUint64(&m.rawDropped),
+		RawDropped:     m.raw.dropped.Load(),
+		RawSpilled:     m.raw.spilled.Load(),
+		Processed:      atomic.LoadUint64(&m.processed),
 		PrefilterHits:  atomic.LoadUint64(&m.prefilterHits),
 		PrefilterSkips: atomic.LoadUint64(&m.prefilterSkips),
 		CertsDecoded:   atomic.LoadUint64(&m.certsDecoded),
+		Excluded:       atomic.LoadUint64(&m.excluded),
+		Duplicates:     atomic.LoadUint64(&m.duplicates),
 		EventsSent:     atomic.LoadUint64(&m.eventsSent),
-		EventsDropped:  atomic.LoadUint64(&m.eventsDropped),
-		RawQueueLen:    len(m.rawMessageChan),
-		RawQueueCap:    cap(m.rawMessageChan),
-		EventQueueLen:  len(m.eventsChan),
-		EventQueueCap:  cap(m.eventsChan),
+		EventsDropped:  m.events.dropped.Load(),
+		EventsSpilled:  m.events.spilled.Load(),
+		RawQueueLen:    len(m.raw.ch),
+		RawQueueCap:    cap(m.raw.ch),
+		EventQueueLen:  len(m.events.ch),
+		EventQueueCap:  cap(m.events.ch),
+		Sources:        sources,
+		Handlers:       handlers,
 	}
 }
@@ -0,0 +1,73 @@
+package certstream
+
+import (
+	"strings"
+	"unicode"
+)
+
+// confusables maps characters to the Latin character they are visually confusable with.
+// It is a curated subset of the Unicode confusables data (UTS #39) covering the Cyrillic,
+// Greek, Armenian, full-width and accented Latin letters commonly used in homograph attacks.
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "i", 'ї': "i", 'ј': "j", 'к': "k",
+	'ӏ': "l", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'т': "t", 'у': "y", 'х': "x",
+	'ѕ': "s", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ɡ': "g", 'ү': "y", 'ҹ': "y", 'ԍ': "g", 'ь': "b",
+	'п': "n", 'г': "r", 'ш': "w", 'щ': "w", 'ц': "u", 'ѡ': "w", 'ѵ': "v",
+	// Greek
+	'α': "a", 'β': "b", 'γ': "y", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ω': "w", 'ϲ': "c", 'ϳ': "j", 'ά': "a", 'έ': "e",
+	'ί': "i", 'ό': "o", 'ύ': "u", 'ώ': "w", 'μ': "u",
+	// Armenian
+	'օ': "o", 'ս': "u", 'ց': "g", 'հ': "h", 'ո': "n", 'զ': "q",
+	// Latin lookalikes
+	'ı': "i", 'ɑ': "a", 'ɩ': "i", 'ʟ': "l", 'ɴ': "n", 'ʀ': "r", 'ꞇ': "t", 'ŀ': "l", 'ł': "l",
+	'ø': "o", 'đ': "d", 'ħ': "h", 'ŧ': "t", 'ß': "ss", 'æ': "ae", 'œ': "oe", 'ĸ': "k",
+	// ASCII sequences and digits
+	'0': "o", '1': "l",
+}
+
+// accents folds precomposed accented Latin letters to their base letter
+var accents = map[rune]rune{
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a', 'ă': 'a', 'ą': 'a',
+	'ç': 'c', 'ć': 'c', 'ĉ': 'c', 'ċ': 'c', 'č': 'c', 'ď': 'd',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ĕ': 'e', 'ė': 'e', 'ę': 'e', 'ě': 'e',
+	'ĝ': 'g', 'ğ': 'g', 'ġ': 'g', 'ģ': 'g', 'ĥ': 'h',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ĩ': 'i', 'ī': 'i', 'ĭ': 'i', 'į': 'i',
+	'ĵ': 'j', 'ķ': 'k', 'ĺ': 'l', 'ļ': 'l', 'ľ': 'l',
+	'ñ': 'n', 'ń': 'n', 'ņ': 'n', 'ň': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ō': 'o', 'ŏ': 'o', 'ő': 'o',
+	'ŕ': 'r', 'ŗ': 'r', 'ř': 'r', 'ś': 's', 'ŝ': 's', 'ş': 's', 'š': 's', 'ţ': 't', 'ť': 't',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ũ': 'u', 'ū': 'u', 'ŭ': 'u', 'ů': 'u', 'ű': 'u', 'ų': 'u',
+	'ŵ': 'w', 'ý': 'y', 'ÿ': 'y', 'ŷ': 'y', 'ź': 'z', 'ż': 'z', 'ž': 'z',
+}
+
+// Skeleton folds a string into its confusable skeleton in the spirit of UTS #39: two
+// strings with the same skeleton are visually confusable. Punycode labels are decoded
+// first, full-width forms are narrowed, accents are dropped, confusable characters are
+// mapped to Latin and the "rn" sequence is folded to "m".
+func Skeleton(s string) string {
+	s = strings.ToLower(ToUnicode(s))
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		// Full-width ASCII variants (U+FF01..U+FF5E) map onto ASCII
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r = unicode.ToLower(r - 0xFF01 + '!')
+		}
+		// Combining marks carry no shape of their own
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if base, ok := accents[r]; ok {
+			r = base
+		}
+		if mapped, ok := confusables[r]; ok {
+			b.WriteString(mapped)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
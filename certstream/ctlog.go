@@ -0,0 +1,432 @@
+package certstream
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CT log polling defaults
+const (
+	DefaultCTPollInterval = 10 * time.Second
+	DefaultCTBatchSize    = 256
+)
+
+// RFC 6962 log entry types
+const (
+	x509LogEntryType    = 0
+	precertLogEntryType = 1
+)
+
+// CTLog is a Certificate Transparency log polled directly over the RFC 6962 API
+type CTLog struct {
+	URL  string // Log base URL, e.g. "https://ct.googleapis.com/logs/us1/argon2026h1/"
+	Name string // Reported as the certificate's source name; defaults to the URL
+	// Backfill is how many entries before the current tree head to start at. With 0 the
+	// poller starts at the tree head and only sees certificates logged from now on.
+	Backfill int64
+}
+
+// ParseCTLog parses a log in the form "url; name=argon2026h1; backfill=1000"
+func ParseCTLog(s string) (CTLog, error) {
+	parts := strings.Split(s, ";")
+	log := CTLog{URL: strings.TrimSpace(parts[0])}
+	for _, setting := range parts[1:] {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if !found {
+			return CTLog{}, fmt.Errorf("CT log %q: setting %q is not key=value", s, setting)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "name":
+			log.Name = value
+		case "backfill":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return CTLog{}, fmt.Errorf("CT log %q: invalid backfill %q", s, value)
+			}
+			log.Backfill = n
+		default:
+			return CTLog{}, fmt.Errorf("CT log %q: unknown setting %q", s, key)
+		}
+	}
+
+	if err := log.Validate(); err != nil {
+		return CTLog{}, err
+	}
+	return log, nil
+}
+
+// Validate checks that the log URL is an absolute http(s) URL and the backfill is not negative
+func (l CTLog) Validate() error {
+	u, err := url.Parse(l.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("CT log %q: URL must be an absolute http or https URL", l.URL)
+	}
+	if l.Backfill < 0 {
+		return fmt.Errorf("CT log %q: backfill must not be negative", l.URL)
+	}
+	return nil
+}
+
+// CTLogSource is a Source following one CT log. Each poll fetches everything between
+// the current position and the latest tree head in batches, then waits for the poll
+// interval before asking for a new tree head.
+type CTLogSource struct {
+	log       CTLog
+	client    *http.Client
+	interval  time.Duration
+	batchSize int64
+	logger    Logger
+
+	pending   []ctPendingEntry // fetched entries not yet returned by Next
+	fetchNext int64            // index of the next entry to fetch, -1 until the first tree head
+	treeSize  int64
+	caughtUp  bool // the last poll reached the tree head
+
+	start        int64        // index to start at instead of Backfill, -1 if unset
+	maxGap       int64        // most entries fetched from start before the tree head, 0 for no limit
+	backfillOnly bool         // stop at the first tree head instead of following the log
+	failures     int          // consecutive failed polls of a backfill
+	checkpoints  *checkpoints // held at the source's position until it first catches up
+
+	position atomic.Int64 // index of the next entry to deliver, -1 until the first tree head
+	health   sourceHealth
+}
+
+// ctPendingEntry is a converted entry waiting to be delivered
+type ctPendingEntry struct {
+	index int64
+	data  []byte
+}
+
+// NewCTLogSource creates a source polling the log every interval, requesting up to
+// batchSize entries per get-entries call. Zero values select the defaults.
+func NewCTLogSource(log CTLog, interval time.Duration, batchSize int) *CTLogSource {
+	log.URL = strings.TrimSuffix(log.URL, "/")
+	if log.Name == "" {
+		log.Name = log.URL
+	}
+	if interval <= 0 {
+		interval = DefaultCTPollInterval
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultCTBatchSize
+	}
+	s := &CTLogSource{
+		log:       log,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		interval:  interval,
+		batchSize: int64(batchSize),
+		logger:    NewDefaultLogger(false),
+		fetchNext: -1,
+		start:     -1,
+	}
+	s.position.Store(-1)
+	return s
+}
+
+// resumeAt makes the source start at index instead of Backfill, skipping ahead when more
+// than maxGap entries (if positive) lie between index and the first tree head
+func (s *CTLogSource) resumeAt(index, maxGap int64) {
+	s.start = index
+	s.maxGap = maxGap
+}
+
+// holdCheckpoint keeps the log's checkpoint at the entries the source has delivered
+// until it first reaches the tree head, so the live stream of the same log cannot
+// move it past entries still to be fetched
+func (s *CTLogSource) holdCheckpoint(c *checkpoints) {
+	s.checkpoints = c
+	c.backfilled(s.log.URL, s.start-1)
+}
+
+// Name returns the log name
+func (s *CTLogSource) Name() string {
+	return s.log.Name
+}
+
+// SetLogger sets the logger used for skipped entries
+func (s *CTLogSource) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// Start prepares the source; the log is first contacted by Next. The position is kept
+// across restarts, so a restarted source continues where it stopped.
+func (s *CTLogSource) Start(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing; the source holds no connection between polls
+func (s *CTLogSource) Close() error {
+	return nil
+}
+
+// Position returns the index of the next entry to be delivered, or -1 before the first tree head
+func (s *CTLogSource) Position() int64 {
+	return s.position.Load()
+}
+
+// Health reports whether the last poll succeeded and how far behind the tree head the source is
+func (s *CTLogSource) Health() SourceHealth {
+	health := s.health.get()
+	if position := s.position.Load(); position >= 0 {
+		health.Detail = fmt.Sprintf("position %d", position)
+	}
+	return health
+}
+
+// Next returns the next entry as a CertStream certificate_update message, polling the
+// log as needed. Entries that fail to parse are skipped.
+func (s *CTLogSource) Next(ctx context.Context) ([]byte, error) {
+	for len(s.pending) == 0 {
+		err := s.fill(ctx)
+		if err == nil {
+			s.failures = 0
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		s.health.failed(err)
+		// A backfill of a log that is gone or unreachable is not retried forever
+		if s.backfillOnly && ctx.Err() == nil {
+			if s.failures++; s.failures >= backfillRetries {
+				s.logger.Error("CT log %s: giving up backfill: %v", s.log.Name, err)
+				return nil, io.EOF
+			}
+		}
+		return nil, err
+	}
+
+	entry := s.pending[0]
+	s.pending = s.pending[1:]
+	if s.checkpoints != nil {
+		s.checkpoints.backfilled(s.log.URL, entry.index)
+	}
+	if len(s.pending) > 0 {
+		s.position.Store(s.pending[0].index)
+	} else {
+		s.position.Store(s.fetchNext)
+	}
+	s.health.received()
+	return entry.data, nil
+}
+
+// fill fetches the next batch of entries, first waiting for the poll interval when the
+// previous poll reached the tree head
+func (s *CTLogSource) fill(ctx context.Context) error {
+	if s.caughtUp && s.backfillOnly {
+		return io.EOF
+	}
+	if s.caughtUp {
+		timer := time.NewTimer(s.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if s.caughtUp || s.fetchNext < 0 {
+		treeSize, err := s.getTreeSize(ctx)
+		if err != nil {
+			return err
+		}
+		s.health.connected()
+		s.treeSize = treeSize
+		if s.fetchNext < 0 {
+			s.fetchNext = s.startIndex(treeSize)
+			s.position.Store(s.fetchNext)
+			if s.checkpoints != nil {
+				s.checkpoints.backfilled(s.log.URL, s.fetchNext-1)
+			}
+			s.logger.Debug("CT log %s: tree size %d, starting at %d", s.log.Name, treeSize, s.fetchNext)
+		}
+		s.caughtUp = false
+	}
+	if s.fetchNext >= s.treeSize {
+		s.caughtUp = true
+		if s.checkpoints != nil {
+			s.checkpoints.backfillDone(s.log.URL)
+			s.checkpoints = nil
+		}
+		return nil
+	}
+
+	start := s.fetchNext
+	end := start + s.batchSize - 1
+	if end >= s.treeSize {
+		end = s.treeSize - 1
+	}
+	entries, err := s.getEntries(ctx, start, end)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("get-entries %d-%d returned no entries", start, end)
+	}
+
+	for i, entry := range entries {
+		index := start + int64(i)
+		data, err := s.convert(index, entry)
+		if err != nil {
+			s.logger.Debug("CT log %s: skipping entry %d: %v", s.log.Name, index, err)
+			continue
+		}
+		s.pending = append(s.pending, ctPendingEntry{index: index, data: data})
+	}
+	s.fetchNext = start + int64(len(entries))
+	if len(s.pending) == 0 {
+		s.position.Store(s.fetchNext)
+	}
+	return nil
+}
+
+// startIndex returns the index of the first entry to fetch, given the first tree size
+func (s *CTLogSource) startIndex(treeSize int64) int64 {
+	start := treeSize - s.log.Backfill
+	if s.start >= 0 {
+		start = s.start
+		if s.maxGap > 0 && treeSize-start > s.maxGap {
+			s.logger.Error("CT log %s: %d entries since the checkpoint, only backfilling the last %d", s.log.Name, treeSize-start, s.maxGap)
+			start = treeSize - s.maxGap
+		}
+	}
+	if start > treeSize {
+		start = treeSize
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start
+}
+
+// getTreeSize returns the tree size of the log's latest signed tree head
+func (s *CTLogSource) getTreeSize(ctx context.Context) (int64, error) {
+	var sth struct {
+		TreeSize int64 `json:"tree_size"`
+	}
+	if err := s.getJSON(ctx, "/ct/v1/get-sth", &sth); err != nil {
+		return 0, fmt.Errorf("get-sth: %w", err)
+	}
+	return sth.TreeSize, nil
+}
+
+// ctLogEntry is one element of a get-entries response
+type ctLogEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// getEntries fetches the entries in [start, end]; logs may return fewer than requested
+func (s *CTLogSource) getEntries(ctx context.Context, start, end int64) ([]ctLogEntry, error) {
+	var response struct {
+		Entries []ctLogEntry `json:"entries"`
+	}
+	path := fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", start, end)
+	if err := s.getJSON(ctx, path, &response); err != nil {
+		return nil, fmt.Errorf("get-entries %d-%d: %w", start, end, err)
+	}
+	return response.Entries, nil
+}
+
+func (s *CTLogSource) getJSON(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.log.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// convert parses a log entry and encodes it as a CertStream certificate_update message
+func (s *CTLogSource) convert(index int64, entry ctLogEntry) ([]byte, error) {
+	cert, updateType, err := parseLogEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	data := certDataFromX509(cert, updateType)
+	data.Data.CertIndex = index
+	data.Data.CertLink = fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", s.log.URL, index, index)
+	data.Data.Source.URL = s.log.URL
+	data.Data.Source.Name = s.log.Name
+	return json.Marshal(data)
+}
+
+// parseLogEntry decodes the MerkleTreeLeaf of an entry and returns its certificate. For
+// precertificate entries the full precertificate is taken from extra_data.
+func parseLogEntry(entry ctLogEntry) (*x509.Certificate, string, error) {
+	leaf := entry.LeafInput
+	// MerkleTreeLeaf: version(1) leaf_type(1) timestamp(8) entry_type(2)
+	if len(leaf) < 12 {
+		return nil, "", errors.New("leaf too short")
+	}
+	if leaf[0] != 0 || leaf[1] != 0 {
+		return nil, "", fmt.Errorf("unsupported leaf version %d or type %d", leaf[0], leaf[1])
+	}
+
+	switch binary.BigEndian.Uint16(leaf[10:12]) {
+	case x509LogEntryType:
+		der, _, err := readUint24Prefixed(leaf[12:])
+		if err != nil {
+			return nil, "", fmt.Errorf("x509 entry: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, "", fmt.Errorf("x509 entry: %w", err)
+		}
+		return cert, "X509LogEntry", nil
+
+	case precertLogEntryType:
+		// PrecertChainEntry: pre_certificate followed by its chain
+		der, _, err := readUint24Prefixed(entry.ExtraData)
+		if err != nil {
+			return nil, "", fmt.Errorf("precert entry: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, "", fmt.Errorf("precert entry: %w", err)
+		}
+		return cert, "PrecertLogEntry", nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown entry type %d", binary.BigEndian.Uint16(leaf[10:12]))
+	}
+}
+
+// readUint24Prefixed reads a TLS opaque<0..2^24-1> value and returns it with the rest
+func readUint24Prefixed(b []byte) ([]byte, []byte, error) {
+	if len(b) < 3 {
+		return nil, nil, errors.New("truncated length")
+	}
+	n := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	if len(b) < 3+n {
+		return nil, nil, fmt.Errorf("truncated value: need %d bytes, have %d", n, len(b)-3)
+	}
+	return b[3 : 3+n], b[3+n:], nil
+}
@@ -0,0 +1,146 @@
+package certstream
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduplication defaults
+const (
+	DefaultDedupTTL  = 10 * time.Minute
+	DefaultDedupSize = 100000
+)
+
+// DedupKey selects the identity under which certificates are deduplicated
+type DedupKey string
+
+// DefaultDedupKey is the identity certificates are deduplicated by without WithDedup
+const DefaultDedupKey = DedupKeySerialIssuer
+
+// Dedup keys accepted by WithDedup
+const (
+	// DedupKeyNone disables deduplication
+	DedupKeyNone DedupKey = "none"
+	// DedupKeySHA256 treats only byte-identical certificates as duplicates, such as the
+	// same entry delivered by two sources or replayed after a reconnect
+	DedupKeySHA256 DedupKey = "sha256"
+	// DedupKeySerialIssuer also folds a precertificate and its final certificate into
+	// one event, as they share serial number and issuer
+	DedupKeySerialIssuer DedupKey = "serial_issuer"
+	// DedupKeySANs treats certificates for the same set of domains issued at the same
+	// time as duplicates, also across issuers and serial numbers
+	DedupKeySANs DedupKey = "sans"
+)
+
+// ParseDedupKey parses a dedup key name
+func ParseDedupKey(s string) (DedupKey, error) {
+	switch key := DedupKey(strings.ToLower(strings.TrimSpace(s))); key {
+	case DedupKeyNone, DedupKeySHA256, DedupKeySerialIssuer, DedupKeySANs:
+		return key, nil
+	}
+	return "", fmt.Errorf("unknown dedup key %q (supported: %s, %s, %s, %s)", s, DedupKeySHA256, DedupKeySerialIssuer, DedupKeySANs, DedupKeyNone)
+}
+
+// dedupIdentity returns the identity of a certificate under key, or "" when the
+// message lacks the fields it needs, e.g. domains-only messages have no fingerprint
+func dedupIdentity(cert *CertData, key DedupKey) string {
+	leaf := &cert.Data.LeafCert
+	switch key {
+	case DedupKeySHA256:
+		return leaf.Sha256
+	case DedupKeySerialIssuer:
+		if leaf.SerialNumber == "" {
+			return ""
+		}
+		return strings.ToUpper(strings.TrimLeft(leaf.SerialNumber, "0")) + "|" + leaf.Issuer.Aggregated
+	case DedupKeySANs:
+		if len(leaf.AllDomains) == 0 {
+			return ""
+		}
+		domains := make([]string, len(leaf.AllDomains))
+		for i, domain := range leaf.AllDomains {
+			domains[i] = strings.ToLower(domain)
+		}
+		sort.Strings(domains)
+		return fmt.Sprintf("%s|%d", strings.Join(slices.Compact(domains), ","), int64(leaf.NotBefore))
+	}
+	return ""
+}
+
+// dedupCache remembers certificate identities for a fixed time, so a certificate
+// delivered by several sources, or again after a reconnect, produces a single event.
+// The cache holds at most size keys; the oldest are evicted first.
+type dedupCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	seen  map[string]time.Time // key -> expiry
+	order []dedupEntry         // keys in insertion order, so expiries are ascending
+	head  int                  // index of the oldest entry in order
+}
+
+type dedupEntry struct {
+	key    string
+	expiry time.Time
+}
+
+func newDedupCache(ttl time.Duration, size int) *dedupCache {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	return &dedupCache{ttl: ttl, size: size, seen: make(map[string]time.Time)}
+}
+
+// duplicate records key and reports whether it was already seen within the TTL
+func (c *dedupCache) duplicate(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evict(now, -1)
+	if _, ok := c.seen[key]; ok {
+		return true
+	}
+
+	c.evict(now, c.size-1)
+	expiry := now.Add(c.ttl)
+	c.seen[key] = expiry
+	c.order = append(c.order, dedupEntry{key: key, expiry: expiry})
+	return false
+}
+
+// evict drops expired entries, then the oldest ones until at most keep remain. A
+// negative keep only drops expired entries.
+func (c *dedupCache) evict(now time.Time, keep int) {
+	for c.head < len(c.order) {
+		oldest := c.order[c.head]
+		if now.Before(oldest.expiry) && (keep < 0 || len(c.seen) <= keep) {
+			break
+		}
+		// The key may have been re-added after expiring; only the latest entry owns it
+		if c.seen[oldest.key].Equal(oldest.expiry) {
+			delete(c.seen, oldest.key)
+		}
+		c.order[c.head] = dedupEntry{}
+		c.head++
+	}
+
+	// Reclaim the consumed prefix once it dominates the slice
+	if c.head > 1024 && c.head > len(c.order)/2 {
+		c.order = append(c.order[:0], c.order[c.head:]...)
+		c.head = 0
+	}
+}
+
+// len returns the number of remembered keys
+func (c *dedupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.seen)
+}
@@ -0,0 +1,206 @@
+package certstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExcludeRule suppresses known-good certificates after matching. Every field that is set
+// must hold for the rule to apply. A rule with a Domain pattern removes only the matched
+// domains covered by that pattern; the event is dropped once no matches remain. A rule
+// without a Domain drops the whole certificate.
+type ExcludeRule struct {
+	Domain   string // Watch pattern for matched domains to suppress
+	IssuerO  string // Issuer organization, compared case-insensitively
+	IssuerCN string // Issuer common name, compared case-insensitively
+	MinSANs  int    // Applies only to certificates with at least this many SANs
+	MaxSANs  int    // Applies only to certificates with at most this many SANs
+	SHA256   string // Certificate SHA-256 fingerprint; colons and case are ignored
+}
+
+// ParseExcludeRule parses a rule written as ';'-separated conditions, for example
+// "domain=*.nhn.no; issuer.o=Let's Encrypt" or "san_count>100". Supported keys are
+// domain, issuer.o, issuer.cn, sha256 and san_count (with =, <, <=, > or >=).
+func ParseExcludeRule(s string) (ExcludeRule, error) {
+	var rule ExcludeRule
+	for _, condition := range strings.Split(s, ";") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+
+		if rest, ok := strings.CutPrefix(condition, "san_count"); ok {
+			if err := rule.parseSANCount(strings.TrimSpace(rest)); err != nil {
+				return ExcludeRule{}, fmt.Errorf("exclude rule %q: %w", s, err)
+			}
+			continue
+		}
+
+		key, value, found := strings.Cut(condition, "=")
+		if !found {
+			return ExcludeRule{}, fmt.Errorf("exclude rule %q: condition %q is not key=value", s, condition)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "domain":
+			rule.Domain = value
+		case "issuer.o":
+			rule.IssuerO = value
+		case "issuer.cn":
+			rule.IssuerCN = value
+		case "sha256":
+			rule.SHA256 = value
+		default:
+			return ExcludeRule{}, fmt.Errorf("exclude rule %q: unknown key %q", s, key)
+		}
+	}
+
+	if rule == (ExcludeRule{}) {
+		return ExcludeRule{}, fmt.Errorf("exclude rule %q has no conditions", s)
+	}
+	if err := rule.Validate(); err != nil {
+		return ExcludeRule{}, err
+	}
+	return rule, nil
+}
+
+// parseSANCount parses the operator and bound following "san_count"
+func (r *ExcludeRule) parseSANCount(expr string) error {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		rest, ok := strings.CutPrefix(expr, op)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(rest))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid SAN count %q", rest)
+		}
+		switch op {
+		case ">=":
+			r.MinSANs = n
+		case ">":
+			r.MinSANs = n + 1
+		case "<=":
+			r.MaxSANs = n
+		case "<":
+			r.MaxSANs = n - 1
+		case "=":
+			r.MinSANs, r.MaxSANs = n, n
+		}
+		if op != ">" && op != ">=" && r.MaxSANs < 1 {
+			// Certificates always carry at least one SAN, and 0 means "no upper bound"
+			return fmt.Errorf("upper SAN count bound must be at least 1")
+		}
+		return nil
+	}
+	return fmt.Errorf("san_count needs one of =, <, <=, >, >=")
+}
+
+// Validate checks that the rule's domain pattern is well-formed
+func (r ExcludeRule) Validate() error {
+	if r.Domain == "" {
+		return nil
+	}
+	if _, err := ParsePattern(r.Domain); err != nil {
+		return fmt.Errorf("exclude rule: %w", err)
+	}
+	return nil
+}
+
+// compiledExclusion is an ExcludeRule with its domain pattern parsed
+type compiledExclusion struct {
+	rule   ExcludeRule
+	domain *Pattern
+	sha256 string
+}
+
+// exclusions evaluates exclude rules against matched certificates
+type exclusions struct {
+	rules []compiledExclusion
+}
+
+// newExclusions compiles the rules, logging and skipping invalid entries
+func newExclusions(rules []ExcludeRule, logger Logger) *exclusions {
+	ex := &exclusions{}
+	for _, rule := range rules {
+		compiled := compiledExclusion{rule: rule, sha256: normalizeFingerprint(rule.SHA256)}
+		if rule.Domain != "" {
+			pattern, err := ParsePattern(rule.Domain)
+			if err != nil {
+				logger.Error("Ignoring exclude rule: %v", err)
+				continue
+			}
+			compiled.domain = &pattern
+		}
+		ex.rules = append(ex.rules, compiled)
+	}
+	return ex
+}
+
+// empty reports whether there are no exclude rules
+func (ex *exclusions) empty() bool {
+	return len(ex.rules) == 0
+}
+
+// filter returns the matches that survive the exclude rules. A nil result means the
+// whole certificate is excluded.
+func (ex *exclusions) filter(cert *CertData, matches []Match) []Match {
+	kept := matches
+	for _, rule := range ex.rules {
+		if !rule.appliesTo(cert) {
+			continue
+		}
+		if rule.domain == nil {
+			return nil
+		}
+		remaining := kept[:0:0]
+		for _, match := range kept {
+			if !rule.domain.Match(match.Domain) {
+				remaining = append(remaining, match)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+		kept = remaining
+	}
+	return kept
+}
+
+// excludesAll reports whether the rules drop an unfiltered certificate, which happens
+// when a rule applies and its domain pattern (if any) covers every certificate domain
+func (ex *exclusions) excludesAll(cert *CertData) bool {
+	matches := make([]Match, len(cert.Data.LeafCert.AllDomains))
+	for i, domain := range cert.Data.LeafCert.AllDomains {
+		matches[i] = Match{Domain: domain}
+	}
+	return ex.filter(cert, matches) == nil
+}
+
+// appliesTo checks the certificate-level conditions of a rule
+func (r compiledExclusion) appliesTo(cert *CertData) bool {
+	leaf := &cert.Data.LeafCert
+	if r.rule.IssuerO != "" && !strings.EqualFold(r.rule.IssuerO, leaf.Issuer.O) {
+		return false
+	}
+	if r.rule.IssuerCN != "" && !strings.EqualFold(r.rule.IssuerCN, leaf.Issuer.CN) {
+		return false
+	}
+	sans := len(leaf.AllDomains)
+	if r.rule.MinSANs > 0 && sans < r.rule.MinSANs {
+		return false
+	}
+	if r.rule.MaxSANs > 0 && sans > r.rule.MaxSANs {
+		return false
+	}
+	if r.sha256 != "" && r.sha256 != normalizeFingerprint(leaf.Sha256) {
+		return false
+	}
+	return true
+}
+
+// normalizeFingerprint strips colons and uppercases a hex fingerprint
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
@@ -0,0 +1,230 @@
+package certstream
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fieldPrefix marks field rules in CertEvent.MatchedDomains
+const fieldPrefix = "field:"
+
+// Certificate fields selectable by a FieldRule
+const (
+	FieldSubjectCN          = "subject.cn"
+	FieldSubjectO           = "subject.o"
+	FieldSubjectAggregated  = "subject.aggregated"
+	FieldIssuerO            = "issuer.o"
+	FieldIssuerCN           = "issuer.cn"
+	FieldSignatureAlgorithm = "signature_algorithm"
+	FieldSAN                = "san"       // every subjectAltName entry, without its type
+	FieldSANDNS             = "san.dns"   // DNS subjectAltName entries
+	FieldSANEmail           = "san.email" // email subjectAltName entries
+	FieldSANIP              = "san.ip"    // IP address subjectAltName entries
+	FieldSourceName         = "source.name"
+)
+
+// knownFields lists the selectable fields in the order they are documented
+var knownFields = []string{
+	FieldSubjectCN, FieldSubjectO, FieldSubjectAggregated, FieldIssuerO, FieldIssuerCN,
+	FieldSignatureAlgorithm, FieldSAN, FieldSANDNS, FieldSANEmail, FieldSANIP, FieldSourceName,
+}
+
+// FieldOp is the comparison applied by a FieldRule
+type FieldOp string
+
+// Comparisons supported by field rules. All but FieldOpMatches ignore case.
+const (
+	FieldOpEquals   FieldOp = "equals"
+	FieldOpContains FieldOp = "contains"
+	FieldOpPrefix   FieldOp = "prefix"
+	FieldOpSuffix   FieldOp = "suffix"
+	FieldOpMatches  FieldOp = "matches" // RE2 expression
+)
+
+// FieldMode controls how field rules combine with the domain rules (watch patterns,
+// regex and keyword rules) and with each other
+type FieldMode string
+
+// Field rule composition modes
+const (
+	// FieldModeAnd reports a certificate only when the domain rules match (if any are
+	// configured) and every field rule holds
+	FieldModeAnd FieldMode = "and"
+	// FieldModeOr reports a certificate when the domain rules or any field rule match
+	FieldModeOr FieldMode = "or"
+)
+
+// FieldRule selects a certificate field and compares it with a value, for example
+// issuer.o contains "Sectigo". Multi-valued fields such as san match when any value does.
+type FieldRule struct {
+	Field string
+	Op    FieldOp
+	Value string
+}
+
+// ParseFieldRule parses a rule written as `<field> <op> <value>`, where the value may be
+// double-quoted, e.g. `issuer.o contains "Sectigo"` or `san.ip prefix 10.`
+func ParseFieldRule(s string) (FieldRule, error) {
+	field, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	op, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return FieldRule{}, fmt.Errorf("field rule %q: invalid quoted value %s", s, value)
+		}
+		value = unquoted
+	}
+
+	rule := FieldRule{Field: strings.ToLower(field), Op: FieldOp(strings.ToLower(op)), Value: value}
+	if err := rule.Validate(); err != nil {
+		return FieldRule{}, err
+	}
+	return rule, nil
+}
+
+// String returns the rule in the syntax accepted by ParseFieldRule
+func (r FieldRule) String() string {
+	return fmt.Sprintf("%s %s %q", r.Field, r.Op, r.Value)
+}
+
+// Validate checks the field, operator and value
+func (r FieldRule) Validate() error {
+	_, err := compileFieldRule(r)
+	return err
+}
+
+// fieldRule is a compiled FieldRule
+type fieldRule struct {
+	rule  FieldRule
+	value string         // lowercased comparison value
+	re    *regexp.Regexp // set for FieldOpMatches
+}
+
+// compileFieldRule checks the rule and prepares its comparison
+func compileFieldRule(rule FieldRule) (*fieldRule, error) {
+	known := false
+	for _, field := range knownFields {
+		known = known || rule.Field == field
+	}
+	if !known {
+		return nil, fmt.Errorf("field rule %q: unknown field %q (supported: %s)", rule.String(), rule.Field, strings.Join(knownFields, ", "))
+	}
+	if rule.Value == "" {
+		return nil, fmt.Errorf("field rule %q has no value", rule.String())
+	}
+
+	compiled := &fieldRule{rule: rule, value: strings.ToLower(rule.Value)}
+	switch rule.Op {
+	case FieldOpEquals, FieldOpContains, FieldOpPrefix, FieldOpSuffix:
+	case FieldOpMatches:
+		re, err := regexp.Compile(rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("field rule %q: %w", rule.String(), err)
+		}
+		compiled.re = re
+	default:
+		return nil, fmt.Errorf("field rule %q: unknown operator %q (supported: equals, contains, prefix, suffix, matches)", rule.String(), rule.Op)
+	}
+	return compiled, nil
+}
+
+// name returns the rule as reported in CertEvent.MatchedDomains
+func (r *fieldRule) name() string {
+	return fieldPrefix + r.rule.String()
+}
+
+// matchCert reports whether any value of the selected field satisfies the comparison
+func (r *fieldRule) matchCert(cert *CertData) bool {
+	for _, value := range fieldValues(cert, r.rule.Field) {
+		if r.compare(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare applies the rule's operator to a single value
+func (r *fieldRule) compare(value string) bool {
+	if r.re != nil {
+		return r.re.MatchString(value)
+	}
+	value = strings.ToLower(value)
+	switch r.rule.Op {
+	case FieldOpEquals:
+		return value == r.value
+	case FieldOpContains:
+		return strings.Contains(value, r.value)
+	case FieldOpPrefix:
+		return strings.HasPrefix(value, r.value)
+	case FieldOpSuffix:
+		return strings.HasSuffix(value, r.value)
+	}
+	return false
+}
+
+// fieldValues returns the values of a certificate field
+func fieldValues(cert *CertData, field string) []string {
+	leaf := &cert.Data.LeafCert
+	switch field {
+	case FieldSubjectCN:
+		return []string{leaf.Subject.CN}
+	case FieldSubjectO:
+		return stringValues(leaf.Subject.O)
+	case FieldSubjectAggregated:
+		return []string{leaf.Subject.Aggregated}
+	case FieldIssuerO:
+		return []string{leaf.Issuer.O}
+	case FieldIssuerCN:
+		return []string{leaf.Issuer.CN}
+	case FieldSignatureAlgorithm:
+		return []string{leaf.SignatureAlgorithm}
+	case FieldSAN:
+		return subjectAltNames(leaf.Extensions.SubjectAltName, "")
+	case FieldSANDNS:
+		return subjectAltNames(leaf.Extensions.SubjectAltName, "dns")
+	case FieldSANEmail:
+		return subjectAltNames(leaf.Extensions.SubjectAltName, "email")
+	case FieldSANIP:
+		return subjectAltNames(leaf.Extensions.SubjectAltName, "ip address")
+	case FieldSourceName:
+		return []string{cert.Data.Source.Name}
+	}
+	return nil
+}
+
+// stringValues flattens a subject attribute, which CertStream sends as null, a string or a list
+func stringValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// subjectAltNames splits the extension text ("DNS:a.example, email:x@example, IP Address:10.0.0.1")
+// into entry values, keeping only entries of the given lowercase type when one is set
+func subjectAltNames(extension, kind string) []string {
+	var values []string
+	for _, entry := range strings.Split(extension, ",") {
+		typ, value, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found {
+			continue
+		}
+		if kind != "" && strings.ToLower(strings.TrimSpace(typ)) != kind {
+			continue
+		}
+		values = append(values, strings.TrimSpace(value))
+	}
+	return values
+}
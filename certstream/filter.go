@@ -0,0 +1,686 @@
+package certstream
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// filterPrefix marks a filter expression in CertEvent.MatchedDomains
+const filterPrefix = "filter:"
+
+// FilterExpression is a compiled boolean expression over a certificate, for example
+//
+//	domain ~ "*.nhn.no" && !issuer.o in ["Let's Encrypt"] && san_count > 50
+//
+// Operators, from lowest to highest precedence:
+//
+//	||                  logical or
+//	&&                  logical and
+//	!                   logical not, applied to a whole comparison
+//	== != < <= > >=     comparisons; < and friends need numbers
+//	~                   watch pattern match (see Pattern), e.g. domain ~ "**.nhn.*"
+//	=~                  RE2 match, e.g. subject.cn =~ "^vpn[0-9]+\\."
+//	in                  membership in a list literal, e.g. issuer.cn in ["R10", "R11"]
+//	contains            substring match
+//
+// String comparisons other than =~ ignore case. Multi-valued fields such as domain and
+// san hold when any value matches; != is the negation of ==. && and || short-circuit.
+// See FilterFields for the available fields.
+type FilterExpression struct {
+	source     string
+	eval       func(in *filterInput) bool
+	usesDomain bool // the expression tests the domain field
+}
+
+// FilterError reports a problem in a filter expression at a 1-based column
+type FilterError struct {
+	Column  int
+	Message string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter column %d: %s", e.Column, e.Message)
+}
+
+// ParseFilterExpression parses and type checks an expression
+func ParseFilterExpression(source string) (*FilterExpression, error) {
+	return parseFilterExpression(source, filterFields)
+}
+
+// parseFilterExpression parses and type checks an expression against a field table
+func parseFilterExpression(source string, fields map[string]filterField) (*FilterExpression, error) {
+	tokens, err := lexFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &FilterError{Column: tok.col, Message: fmt.Sprintf("unexpected %s", tok)}
+	}
+
+	compiler := &filterCompiler{fields: fields}
+	compiled, err := compiler.compile(root)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ != typeBool {
+		return nil, &FilterError{Column: root.col, Message: fmt.Sprintf("expression is a %s, not a condition", compiled.typ)}
+	}
+	return &FilterExpression{source: source, eval: compiled.boolean, usesDomain: compiler.usesDomain}, nil
+}
+
+// String returns the expression source
+func (f *FilterExpression) String() string {
+	return f.source
+}
+
+// Match reports whether the certificate satisfies the expression
+func (f *FilterExpression) Match(cert *CertData) bool {
+	return f.eval(&filterInput{cert: cert})
+}
+
+// matchingDomain returns the first certificate domain that satisfies the expression as
+// the only value of the domain field, or "" when there is none or the expression does
+// not test domains
+func (f *FilterExpression) matchingDomain(cert *CertData) string {
+	if !f.usesDomain {
+		return ""
+	}
+	for _, domain := range cert.Data.LeafCert.AllDomains {
+		if domain != "" && f.eval(&filterInput{cert: cert, domain: domain}) {
+			return domain
+		}
+	}
+	return ""
+}
+
+// filterInput is what an expression is evaluated against: a certificate, optionally
+// with the domain field narrowed to one of its domains
+type filterInput struct {
+	cert   *CertData
+	domain string
+}
+
+// filterType is the static type of an expression
+type filterType int
+
+const (
+	typeBool filterType = iota
+	typeNumber
+	typeString // one or more string values
+	typeList   // list literal
+)
+
+func (t filterType) String() string {
+	switch t {
+	case typeBool:
+		return "boolean"
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	}
+	return "list"
+}
+
+// filterField resolves a field name to its values; exactly one accessor is set
+type filterField struct {
+	strings func(cert *CertData) []string
+	number  func(cert *CertData) float64
+	boolean func(cert *CertData) bool
+}
+
+// filterFields holds the fields available to filter expressions
+var filterFields = map[string]filterField{
+	"domain":        {strings: func(c *CertData) []string { return c.Data.LeafCert.AllDomains }},
+	"san_count":     {number: func(c *CertData) float64 { return float64(len(c.Data.LeafCert.AllDomains)) }},
+	"is_ca":         {boolean: func(c *CertData) bool { return c.Data.LeafCert.IsCA }},
+	"not_before":    {number: func(c *CertData) float64 { return c.Data.LeafCert.NotBefore }},
+	"not_after":     {number: func(c *CertData) float64 { return c.Data.LeafCert.NotAfter }},
+	"validity_days": {number: func(c *CertData) float64 { return (c.Data.LeafCert.NotAfter - c.Data.LeafCert.NotBefore) / 86400 }},
+	"cert_index":    {number: func(c *CertData) float64 { return float64(c.Data.CertIndex) }},
+	"sha256":        {strings: func(c *CertData) []string { return []string{normalizeFingerprint(c.Data.LeafCert.Sha256)} }},
+	"serial_number": {strings: func(c *CertData) []string { return []string{c.Data.LeafCert.SerialNumber} }},
+	"source.url":    {strings: func(c *CertData) []string { return []string{c.Data.Source.URL} }},
+}
+
+func init() {
+	// Every field rule selector is also a string field
+	for _, name := range knownFields {
+		filterFields[name] = filterField{strings: func(c *CertData) []string { return fieldValues(c, name) }}
+	}
+}
+
+// FilterFields returns the names of the fields available to filter expressions
+func FilterFields() []string {
+	names := make([]string, 0, len(filterFields))
+	for name := range filterFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string // identifier, operator or unquoted string
+	num  float64
+	col  int
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// filterOperators lists the punctuation operators, longest first
+var filterOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!", "<", ">", "~", "(", ")", "[", "]", ","}
+
+// lexFilter splits the source into tokens with 1-based rune columns
+func lexFilter(source string) ([]filterToken, error) {
+	var tokens []filterToken
+	col := 1
+	for i := 0; i < len(source); {
+		r, size := utf8.DecodeRuneInString(source[i:])
+		start := col
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			col++
+			continue
+
+		case r == '"':
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, &FilterError{Column: start, Message: "unterminated string"}
+			}
+			text, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, &FilterError{Column: start, Message: "invalid string escape"}
+			}
+			tokens = append(tokens, filterToken{kind: tokString, text: text, col: start})
+			col += utf8.RuneCountInString(source[i : end+1])
+			i = end + 1
+			continue
+
+		case r >= '0' && r <= '9':
+			end := i
+			for end < len(source) && (source[end] >= '0' && source[end] <= '9' || source[end] == '.') {
+				end++
+			}
+			num, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, &FilterError{Column: start, Message: fmt.Sprintf("invalid number %q", source[i:end])}
+			}
+			tokens = append(tokens, filterToken{kind: tokNumber, text: source[i:end], num: num, col: start})
+			col += end - i
+			i = end
+			continue
+
+		case r == '_' || unicode.IsLetter(r):
+			end := i
+			for end < len(source) {
+				c := source[end]
+				if c != '_' && c != '.' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+					break
+				}
+				end++
+			}
+			if end == i {
+				return nil, &FilterError{Column: start, Message: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, filterToken{kind: tokIdent, text: strings.ToLower(source[i:end]), col: start})
+			col += end - i
+			i = end
+			continue
+		}
+
+		matched := false
+		for _, op := range filterOperators {
+			if strings.HasPrefix(source[i:], op) {
+				tokens = append(tokens, filterToken{kind: tokOp, text: op, col: start})
+				i += len(op)
+				col += len(op)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, &FilterError{Column: start, Message: fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	return append(tokens, filterToken{kind: tokEOF, col: col}), nil
+}
+
+type astKind int
+
+const (
+	astOr astKind = iota
+	astAnd
+	astNot
+	astCompare
+	astField
+	astString
+	astNumber
+	astBool
+	astList
+)
+
+// filterAST is a node of the parsed expression
+type filterAST struct {
+	kind        astKind
+	col         int
+	op          string // comparison operator
+	text        string // field name or string literal
+	num         float64
+	boolean     bool
+	left, right *filterAST
+	items       []*filterAST // list literal elements
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token when it is the given operator or keyword
+func (p *filterParser) accept(text string) (filterToken, bool) {
+	tok := p.peek()
+	if (tok.kind == tokOp || tok.kind == tokIdent) && tok.text == text {
+		p.pos++
+		return tok, true
+	}
+	return tok, false
+}
+
+func (p *filterParser) parseOr() (*filterAST, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.accept("||")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAST{kind: astOr, col: tok.col, left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseAnd() (*filterAST, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.accept("&&")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAST{kind: astAnd, col: tok.col, left: left, right: right}
+	}
+}
+
+func (p *filterParser) parseUnary() (*filterAST, error) {
+	if tok, ok := p.accept("!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterAST{kind: astNot, col: tok.col, left: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// comparisonOperators are the operators accepted between two operands
+var comparisonOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"~": true, "=~": true, "in": true, "contains": true,
+}
+
+func (p *filterParser) parseComparison() (*filterAST, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if (tok.kind != tokOp && tok.kind != tokIdent) || !comparisonOperators[tok.text] {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return &filterAST{kind: astCompare, col: tok.col, op: tok.text, left: left, right: right}, nil
+}
+
+func (p *filterParser) parsePrimary() (*filterAST, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &filterAST{kind: astString, col: tok.col, text: tok.text}, nil
+	case tokNumber:
+		return &filterAST{kind: astNumber, col: tok.col, num: tok.num}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			return &filterAST{kind: astBool, col: tok.col, boolean: tok.text == "true"}, nil
+		case "in", "contains":
+			return nil, &FilterError{Column: tok.col, Message: fmt.Sprintf("expected a value, found %s", tok)}
+		}
+		return &filterAST{kind: astField, col: tok.col, text: tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if closing, ok := p.accept(")"); !ok {
+				return nil, &FilterError{Column: closing.col, Message: fmt.Sprintf("expected \")\", found %s", closing)}
+			}
+			return inner, nil
+		case "[":
+			return p.parseList(tok)
+		}
+	}
+	return nil, &FilterError{Column: tok.col, Message: fmt.Sprintf("expected a value, found %s", tok)}
+}
+
+// parseList parses the elements of a list literal after its opening bracket
+func (p *filterParser) parseList(open filterToken) (*filterAST, error) {
+	list := &filterAST{kind: astList, col: open.col}
+	if _, ok := p.accept("]"); ok {
+		return list, nil
+	}
+	for {
+		tok := p.next()
+		switch tok.kind {
+		case tokString:
+			list.items = append(list.items, &filterAST{kind: astString, col: tok.col, text: tok.text})
+		case tokNumber:
+			list.items = append(list.items, &filterAST{kind: astNumber, col: tok.col, num: tok.num})
+		default:
+			return nil, &FilterError{Column: tok.col, Message: fmt.Sprintf("list elements must be strings or numbers, found %s", tok)}
+		}
+		if _, ok := p.accept("]"); ok {
+			return list, nil
+		}
+		if tok, ok := p.accept(","); !ok {
+			return nil, &FilterError{Column: tok.col, Message: fmt.Sprintf("expected \",\" or \"]\", found %s", tok)}
+		}
+	}
+}
+
+// filterCompiler type checks expressions against a field table
+type filterCompiler struct {
+	fields     map[string]filterField
+	usesDomain bool
+}
+
+// compiledFilter is a type checked node turned into a closure; only the accessor
+// matching typ is set
+type compiledFilter struct {
+	typ     filterType
+	boolean func(cert *filterInput) bool
+	number  func(cert *filterInput) float64
+	strings func(cert *filterInput) []string
+	list    *filterAST
+}
+
+// compile type checks a node and builds its evaluator
+func (fc *filterCompiler) compile(node *filterAST) (compiledFilter, error) {
+	switch node.kind {
+	case astBool:
+		value := node.boolean
+		return compiledFilter{typ: typeBool, boolean: func(*filterInput) bool { return value }}, nil
+
+	case astNumber:
+		value := node.num
+		return compiledFilter{typ: typeNumber, number: func(*filterInput) float64 { return value }}, nil
+
+	case astString:
+		values := []string{node.text}
+		return compiledFilter{typ: typeString, strings: func(*filterInput) []string { return values }}, nil
+
+	case astList:
+		return compiledFilter{typ: typeList, list: node}, nil
+
+	case astField:
+		field, ok := fc.fields[node.text]
+		if !ok {
+			return compiledFilter{}, &FilterError{Column: node.col, Message: fmt.Sprintf("unknown field %q", node.text)}
+		}
+		switch {
+		case field.boolean != nil:
+			return compiledFilter{typ: typeBool, boolean: func(in *filterInput) bool { return field.boolean(in.cert) }}, nil
+		case field.number != nil:
+			return compiledFilter{typ: typeNumber, number: func(in *filterInput) float64 { return field.number(in.cert) }}, nil
+		case node.text == "domain":
+			fc.usesDomain = true
+			return compiledFilter{typ: typeString, strings: func(in *filterInput) []string {
+				if in.domain != "" {
+					return []string{in.domain}
+				}
+				return field.strings(in.cert)
+			}}, nil
+		}
+		return compiledFilter{typ: typeString, strings: func(in *filterInput) []string { return field.strings(in.cert) }}, nil
+
+	case astNot:
+		operand, err := fc.condition(node.left, "!")
+		if err != nil {
+			return compiledFilter{}, err
+		}
+		return compiledFilter{typ: typeBool, boolean: func(c *filterInput) bool { return !operand(c) }}, nil
+
+	case astAnd, astOr:
+		op := "&&"
+		if node.kind == astOr {
+			op = "||"
+		}
+		left, err := fc.condition(node.left, op)
+		if err != nil {
+			return compiledFilter{}, err
+		}
+		right, err := fc.condition(node.right, op)
+		if err != nil {
+			return compiledFilter{}, err
+		}
+		if node.kind == astAnd {
+			return compiledFilter{typ: typeBool, boolean: func(c *filterInput) bool { return left(c) && right(c) }}, nil
+		}
+		return compiledFilter{typ: typeBool, boolean: func(c *filterInput) bool { return left(c) || right(c) }}, nil
+	}
+	return fc.comparison(node)
+}
+
+// condition compiles an operand of a logical operator, which must be boolean
+func (fc *filterCompiler) condition(node *filterAST, op string) (func(*filterInput) bool, error) {
+	compiled, err := fc.compile(node)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.typ != typeBool {
+		return nil, &FilterError{Column: node.col, Message: fmt.Sprintf("operand of %s must be a condition, found a %s", op, compiled.typ)}
+	}
+	return compiled.boolean, nil
+}
+
+// comparison type checks a comparison and builds its evaluator
+func (fc *filterCompiler) comparison(node *filterAST) (compiledFilter, error) {
+	left, err := fc.compile(node.left)
+	if err != nil {
+		return compiledFilter{}, err
+	}
+	right, err := fc.compile(node.right)
+	if err != nil {
+		return compiledFilter{}, err
+	}
+	mismatch := func(want string) error {
+		return &FilterError{Column: node.col, Message: fmt.Sprintf("operator %s needs %s, found %s and %s", node.op, want, left.typ, right.typ)}
+	}
+	condition := func(fn func(*filterInput) bool) (compiledFilter, error) {
+		return compiledFilter{typ: typeBool, boolean: fn}, nil
+	}
+
+	switch node.op {
+	case "in":
+		if right.typ != typeList {
+			return compiledFilter{}, mismatch("a list on the right")
+		}
+		switch left.typ {
+		case typeString:
+			set := make(map[string]bool, len(right.list.items))
+			for _, item := range right.list.items {
+				if item.kind != astString {
+					return compiledFilter{}, &FilterError{Column: item.col, Message: "list must contain only strings to compare with a string"}
+				}
+				set[strings.ToLower(item.text)] = true
+			}
+			return condition(func(c *filterInput) bool {
+				return anyString(left.strings(c), func(v string) bool { return set[strings.ToLower(v)] })
+			})
+		case typeNumber:
+			set := make(map[float64]bool, len(right.list.items))
+			for _, item := range right.list.items {
+				if item.kind != astNumber {
+					return compiledFilter{}, &FilterError{Column: item.col, Message: "list must contain only numbers to compare with a number"}
+				}
+				set[item.num] = true
+			}
+			return condition(func(c *filterInput) bool { return set[left.number(c)] })
+		}
+		return compiledFilter{}, mismatch("a string or number on the left")
+
+	case "~", "=~":
+		if left.typ != typeString || node.right.kind != astString {
+			return compiledFilter{}, mismatch("a string on the left and a string literal on the right")
+		}
+		if node.op == "~" {
+			pattern, err := ParsePattern(node.right.text)
+			if err != nil {
+				return compiledFilter{}, &FilterError{Column: node.right.col, Message: err.Error()}
+			}
+			return condition(func(c *filterInput) bool { return anyString(left.strings(c), pattern.Match) })
+		}
+		re, err := regexp.Compile(node.right.text)
+		if err != nil {
+			return compiledFilter{}, &FilterError{Column: node.right.col, Message: err.Error()}
+		}
+		return condition(func(c *filterInput) bool { return anyString(left.strings(c), re.MatchString) })
+
+	case "contains":
+		if left.typ != typeString || right.typ != typeString {
+			return compiledFilter{}, mismatch("strings")
+		}
+		return condition(func(c *filterInput) bool {
+			needles := right.strings(c)
+			return anyString(left.strings(c), func(v string) bool {
+				v = strings.ToLower(v)
+				return anyString(needles, func(n string) bool { return strings.Contains(v, strings.ToLower(n)) })
+			})
+		})
+
+	case "==", "!=":
+		var equal func(*filterInput) bool
+		switch {
+		case left.typ == typeString && right.typ == typeString:
+			equal = func(c *filterInput) bool {
+				others := right.strings(c)
+				return anyString(left.strings(c), func(v string) bool {
+					return anyString(others, func(o string) bool { return strings.EqualFold(v, o) })
+				})
+			}
+		case left.typ == typeNumber && right.typ == typeNumber:
+			equal = func(c *filterInput) bool { return left.number(c) == right.number(c) }
+		case left.typ == typeBool && right.typ == typeBool:
+			equal = func(c *filterInput) bool { return left.boolean(c) == right.boolean(c) }
+		default:
+			return compiledFilter{}, mismatch("operands of the same type")
+		}
+		if node.op == "!=" {
+			return condition(func(c *filterInput) bool { return !equal(c) })
+		}
+		return condition(equal)
+	}
+
+	// Ordering comparisons
+	if left.typ != typeNumber || right.typ != typeNumber {
+		return compiledFilter{}, mismatch("numbers")
+	}
+	var holds func(a, b float64) bool
+	switch node.op {
+	case "<":
+		holds = func(a, b float64) bool { return a < b }
+	case "<=":
+		holds = func(a, b float64) bool { return a <= b }
+	case ">":
+		holds = func(a, b float64) bool { return a > b }
+	default:
+		holds = func(a, b float64) bool { return a >= b }
+	}
+	return condition(func(c *filterInput) bool { return holds(left.number(c), right.number(c)) })
+}
+
+// anyString reports whether pred holds for any of the values
+func anyString(values []string, pred func(string) bool) bool {
+	for _, v := range values {
+		if pred(v) {
+			return true
+		}
+	}
+	return false
+}
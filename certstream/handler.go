@@ -0,0 +1,293 @@
+package certstream
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// DefaultHandlerBuffer is the number of events queued for a handler before it holds
+// up the events channel
+const DefaultHandlerBuffer = 1000
+
+// Handler handles certificate events, as an alternative to reading Monitor.Events.
+// See Monitor.Handle.
+//
+// Every handler gets the same event, so handlers must not modify its slices or the
+// parsed certificate.
+type Handler interface {
+	HandleEvent(ctx context.Context, event CertEvent) error
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(ctx context.Context, event CertEvent) error
+
+// HandleEvent calls f(ctx, event)
+func (f HandlerFunc) HandleEvent(ctx context.Context, event CertEvent) error {
+	return f(ctx, event)
+}
+
+// HandlerOption configures a handler registered with Monitor.Handle
+type HandlerOption func(*handlerConfig)
+
+// handlerConfig holds the settings of a registered handler
+type handlerConfig struct {
+	name        string
+	concurrency int
+	buffer      int
+	key         func(CertEvent) string
+	onError     func(CertEvent, error)
+}
+
+// WithHandlerName sets the name a handler is logged and reported with in
+// MonitorStats.Handlers (default: handler-1, handler-2, ...)
+func WithHandlerName(name string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.name = name
+	}
+}
+
+// WithConcurrency sets how many events a handler handles in parallel (default: 1).
+// Events are then handled in no particular order, unless WithOrderingKey is used.
+func WithConcurrency(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.concurrency = n
+	}
+}
+
+// WithOrderingKey keeps events with the same key in order when the handler runs
+// concurrently: they are handled one at a time, in the order they were reported,
+// while events with other keys are handled in parallel. See PatternKey.
+func WithOrderingKey(key func(CertEvent) string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.key = key
+	}
+}
+
+// WithHandlerBuffer sets how many events are queued for a handler before it holds up
+// the events channel, where the event backpressure policy applies
+// (default: DefaultHandlerBuffer)
+func WithHandlerBuffer(size int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.buffer = size
+	}
+}
+
+// WithErrorHandler sets the function called with the events a handler returned an
+// error for or panicked on. Panics are reported as a *PanicError. By default the
+// errors are logged.
+func WithErrorHandler(onError func(event CertEvent, err error)) HandlerOption {
+	return func(c *handlerConfig) {
+		c.onError = onError
+	}
+}
+
+// PatternKey is an ordering key for WithOrderingKey that keeps the events of each
+// watch pattern in order
+func PatternKey(event CertEvent) string {
+	if len(event.MatchedDomains) == 0 {
+		return ""
+	}
+	return event.MatchedDomains[0]
+}
+
+// PanicError is the error reported for an event a handler panicked on
+type PanicError struct {
+	Value interface{} // Value passed to panic
+	Stack []byte      // Stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// HandlerStats holds the counters of one handler, see MonitorStats.Handlers
+type HandlerStats struct {
+	Name    string
+	Handled uint64 // Events the handler is done with, including failed ones
+	Failed  uint64 // Events the handler returned an error for or panicked on
+	Panics  uint64 // Panics recovered from the handler
+	Queued  int    // Events waiting for the handler
+}
+
+// registeredHandler is a handler with its queues. Without an ordering key its workers
+// share one queue; with one, every worker has its own queue and an event goes to the
+// queue its key hashes to.
+type registeredHandler struct {
+	handler Handler
+	config  handlerConfig
+	queues  []chan CertEvent
+	handled atomic.Uint64
+	failed  atomic.Uint64
+	panics  atomic.Uint64
+}
+
+// newRegisteredHandler applies the options and creates the queues of a handler
+func newRegisteredHandler(handler Handler, name string, options []HandlerOption) *registeredHandler {
+	config := handlerConfig{name: name, concurrency: 1, buffer: DefaultHandlerBuffer}
+	for _, option := range options {
+		option(&config)
+	}
+	if config.concurrency < 1 {
+		config.concurrency = 1
+	}
+	if config.buffer < 1 {
+		config.buffer = DefaultHandlerBuffer
+	}
+
+	h := &registeredHandler{handler: handler, config: config}
+	if config.key == nil || config.concurrency == 1 {
+		h.queues = []chan CertEvent{make(chan CertEvent, config.buffer)}
+	} else {
+		size := max(config.buffer/config.concurrency, 1)
+		for i := 0; i < config.concurrency; i++ {
+			h.queues = append(h.queues, make(chan CertEvent, size))
+		}
+	}
+	return h
+}
+
+// queue returns the queue an event is handed to
+func (h *registeredHandler) queue(event CertEvent) chan CertEvent {
+	if len(h.queues) == 1 {
+		return h.queues[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(h.config.key(event)))
+	return h.queues[hash.Sum32()%uint32(len(h.queues))]
+}
+
+// run handles the events of a queue until done is closed and the queue is empty
+func (h *registeredHandler) run(ctx context.Context, queue <-chan CertEvent, done <-chan struct{}, logger Logger) {
+	for {
+		select {
+		case event := <-queue:
+			h.handle(ctx, event, logger)
+		case <-done:
+			for {
+				select {
+				case event := <-queue:
+					h.handle(ctx, event, logger)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handle passes an event to the handler and reports its error, if any
+func (h *registeredHandler) handle(ctx context.Context, event CertEvent, logger Logger) {
+	err := h.call(ctx, event)
+	h.handled.Add(1)
+	if err == nil {
+		return
+	}
+	failed := h.failed.Add(1)
+	if h.config.onError != nil {
+		h.config.onError(event, err)
+	} else if failed == 1 || failed%100 == 0 {
+		logger.Error("Handler %s failed (total failures: %d): %v", h.config.name, failed, err)
+	}
+}
+
+// call runs the handler, turning a panic into a *PanicError
+func (h *registeredHandler) call(ctx context.Context, event CertEvent) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			h.panics.Add(1)
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return h.handler.HandleEvent(ctx, event)
+}
+
+func (h *registeredHandler) stats() HandlerStats {
+	stats := HandlerStats{
+		Name:    h.config.name,
+		Handled: h.handled.Load(),
+		Failed:  h.failed.Load(),
+		Panics:  h.panics.Load(),
+	}
+	for _, queue := range h.queues {
+		stats.Queued += len(queue)
+	}
+	return stats
+}
+
+// Handle registers a handler for the certificate events, as an alternative to reading
+// Monitor.Events. Once a handler is registered the monitor reads the events channel
+// itself and hands every event to each handler, so Events must not be read as well.
+// Handlers are registered before Start.
+//
+// A handler handles one event at a time, in the order the events arrive on the events
+// channel, unless WithConcurrency and WithOrderingKey say otherwise. The context
+// passed to it is the monitor's, see WithContext. A handler that falls behind holds
+// up the events channel, where the event backpressure policy applies. Errors and
+// panics are logged, or reported to WithErrorHandler. Stop waits for the handlers to
+// finish the events already reported.
+func (m *Monitor) Handle(handler Handler, options ...HandlerOption) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isRunning {
+		m.logger.Error("Ignoring handler registered after Start")
+		return
+	}
+	name := fmt.Sprintf("handler-%d", len(m.handlers)+1)
+	m.handlers = append(m.handlers, newRegisteredHandler(handler, name, options))
+}
+
+// HandleFunc registers a function as a handler, see Handle
+func (m *Monitor) HandleFunc(handle func(ctx context.Context, event CertEvent) error, options ...HandlerOption) {
+	m.Handle(HandlerFunc(handle), options...)
+}
+
+// startHandlers starts the handler workers and the dispatcher handing them the events
+// until drain is closed
+func (m *Monitor) startHandlers(drain <-chan struct{}) {
+	done := make(chan struct{})
+	for _, h := range m.handlers {
+		for i := 0; i < h.config.concurrency; i++ {
+			m.handlerWg.Add(1)
+			go func(h *registeredHandler, queue <-chan CertEvent) {
+				defer m.handlerWg.Done()
+				h.run(m.config.Context, queue, done, m.logger)
+			}(h, h.queues[i%len(h.queues)])
+		}
+	}
+	m.handlerWg.Add(1)
+	go func() {
+		defer m.handlerWg.Done()
+		defer close(done)
+		m.dispatch(drain)
+	}()
+}
+
+// dispatch hands events to the handlers. Once drain is closed, when the workers are
+// done, it hands over the events left in the channel and returns.
+func (m *Monitor) dispatch(drain <-chan struct{}) {
+	for {
+		select {
+		case event := <-m.events.ch:
+			m.deliver(event)
+		case <-drain:
+			for {
+				select {
+				case event := <-m.events.ch:
+					m.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver hands an event to every handler, waiting for room in their queues
+func (m *Monitor) deliver(event CertEvent) {
+	for _, h := range m.handlers {
+		h.queue(event) <- event
+	}
+}
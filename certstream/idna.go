@@ -0,0 +1,158 @@
+package certstream
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// acePrefix marks an IDNA A-label (punycode encoded label)
+const acePrefix = "xn--"
+
+// Punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// IsIDN reports whether a domain contains any punycode encoded labels
+func IsIDN(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		if hasACEPrefix(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeIDN converts every punycode encoded label ("xn--...") of a domain into its
+// Unicode form. Labels without the ACE prefix are returned unchanged.
+func DecodeIDN(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if !hasACEPrefix(label) {
+			continue
+		}
+		decoded, err := decodePunycode(label[len(acePrefix):])
+		if err != nil {
+			return "", fmt.Errorf("label %q: %w", label, err)
+		}
+		labels[i] = decoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicode returns the Unicode form of a domain, or the domain itself when it
+// contains no valid punycode labels
+func ToUnicode(domain string) string {
+	if !IsIDN(domain) {
+		return domain
+	}
+	decoded, err := DecodeIDN(domain)
+	if err != nil {
+		return domain
+	}
+	return decoded
+}
+
+func hasACEPrefix(label string) bool {
+	return len(label) > len(acePrefix) && strings.EqualFold(label[:len(acePrefix)], acePrefix)
+}
+
+// decodePunycode implements the RFC 3492 decoding procedure
+func decodePunycode(encoded string) (string, error) {
+	encoded = strings.ToLower(encoded)
+
+	var output []rune
+	pos := 0
+	if delim := strings.LastIndexByte(encoded, '-'); delim >= 0 {
+		for _, r := range encoded[:delim] {
+			if r >= utf8.RuneSelf {
+				return "", fmt.Errorf("non-ASCII basic code point")
+			}
+			output = append(output, r)
+		}
+		pos = delim + 1
+	}
+
+	n, bias, i := rune(punyInitialN), int32(punyInitialBias), int32(0)
+	for pos < len(encoded) {
+		oldI, w := i, int32(1)
+		for k := int32(punyBase); ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", fmt.Errorf("truncated input")
+			}
+			digit, ok := punyDigit(encoded[pos])
+			if !ok {
+				return "", fmt.Errorf("invalid character %q", encoded[pos])
+			}
+			pos++
+			if digit > (math.MaxInt32-i)/w {
+				return "", fmt.Errorf("overflow")
+			}
+			i += digit * w
+
+			t := k - bias
+			if t < punyTMin {
+				t = punyTMin
+			} else if t > punyTMax {
+				t = punyTMax
+			}
+			if digit < t {
+				break
+			}
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", fmt.Errorf("overflow")
+			}
+			w *= punyBase - t
+		}
+
+		length := int32(len(output) + 1)
+		bias = punyAdapt(i-oldI, length, oldI == 0)
+		if i/length > utf8.MaxRune-n {
+			return "", fmt.Errorf("invalid code point")
+		}
+		n += rune(i / length)
+		i %= length
+		if !utf8.ValidRune(n) {
+			return "", fmt.Errorf("invalid code point")
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+func punyDigit(c byte) (int32, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int32(c - 'a'), true
+	case c >= '0' && c <= '9':
+		return int32(c-'0') + 26, true
+	}
+	return 0, false
+}
+
+func punyAdapt(delta, numPoints int32, firstTime bool) int32 {
+	if firstTime {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := int32(0)
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
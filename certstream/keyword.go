@@ -0,0 +1,169 @@
+package certstream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keywordPrefix marks keyword rules in CertEvent.MatchedDomains
+const keywordPrefix = "keyword:"
+
+// KeywordRule matches certificate domains containing a term anywhere inside a label,
+// such as "helsenorge" in "helsenorge-login.info". Terms never span a dot.
+type KeywordRule struct {
+	Term string
+	// MinBoundaries is how many sides of the term (0, 1 or 2) must fall on a label
+	// boundary: the start or end of the label or a hyphen. With 1, "helsenorge" matches
+	// "helsenorge-login" and "myhelsenorge" but not "xhelsenorgex"; with 2 it only
+	// matches whole hyphen-separated words.
+	MinBoundaries int
+	// Ignore lists watch patterns for domains that never trigger the rule, such as the
+	// brand's own domains
+	Ignore []string
+}
+
+// ParseKeywordRule parses a rule written as the term followed by optional ';'-separated
+// settings, for example "helsenorge; boundaries=1; ignore=helsenorge.no,*.nhn.no"
+func ParseKeywordRule(s string) (KeywordRule, error) {
+	parts := strings.Split(s, ";")
+	rule := KeywordRule{Term: strings.TrimSpace(parts[0])}
+	for _, setting := range parts[1:] {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, found := strings.Cut(setting, "=")
+		if !found {
+			return KeywordRule{}, fmt.Errorf("keyword rule %q: setting %q is not key=value", s, setting)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "boundaries":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return KeywordRule{}, fmt.Errorf("keyword rule %q: invalid boundaries %q", s, value)
+			}
+			rule.MinBoundaries = n
+		case "ignore":
+			for _, entry := range strings.Split(value, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					rule.Ignore = append(rule.Ignore, entry)
+				}
+			}
+		default:
+			return KeywordRule{}, fmt.Errorf("keyword rule %q: unknown setting %q", s, key)
+		}
+	}
+
+	if err := rule.Validate(); err != nil {
+		return KeywordRule{}, err
+	}
+	return rule, nil
+}
+
+// Validate checks the term, boundary count and ignore patterns
+func (r KeywordRule) Validate() error {
+	_, err := compileKeywordRule(r)
+	return err
+}
+
+// keywordRule is a compiled KeywordRule
+type keywordRule struct {
+	term          string
+	minBoundaries int
+	ignore        *patternIndex
+	ascii         bool // the term can be found in the raw payload by the prefilter
+}
+
+// compileKeywordRule normalizes the term and parses the ignore patterns
+func compileKeywordRule(rule KeywordRule) (*keywordRule, error) {
+	term := strings.ToLower(strings.TrimSpace(rule.Term))
+	if term == "" {
+		return nil, fmt.Errorf("keyword rule has no term")
+	}
+	if strings.Contains(term, ".") {
+		return nil, fmt.Errorf("keyword %q: terms match inside a single label and cannot contain '.'", rule.Term)
+	}
+	if rule.MinBoundaries < 0 || rule.MinBoundaries > 2 {
+		return nil, fmt.Errorf("keyword %q: boundaries must be 0, 1 or 2, got %d", rule.Term, rule.MinBoundaries)
+	}
+
+	ignore := make([]Pattern, 0, len(rule.Ignore))
+	for _, entry := range rule.Ignore {
+		pattern, err := ParsePattern(entry)
+		if err != nil {
+			return nil, fmt.Errorf("keyword %q: ignore: %w", rule.Term, err)
+		}
+		ignore = append(ignore, pattern)
+	}
+
+	return &keywordRule{
+		term:          term,
+		minBoundaries: rule.MinBoundaries,
+		ignore:        newPatternIndex(ignore),
+		ascii:         isASCII(term),
+	}, nil
+}
+
+// name returns the rule as reported in CertEvent.MatchedDomains
+func (r *keywordRule) name() string {
+	return keywordPrefix + r.term
+}
+
+// matchDomain reports whether a label of the domain contains the term. Punycode labels
+// are also searched in their decoded form so Unicode terms can match.
+func (r *keywordRule) matchDomain(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" || len(r.ignore.lookup(domain, nil)) > 0 {
+		return false
+	}
+	if r.matchLabels(domain) {
+		return true
+	}
+	if IsIDN(domain) {
+		return r.matchLabels(strings.ToLower(ToUnicode(domain)))
+	}
+	return false
+}
+
+// matchLabels checks each label of a lowercase domain for a sufficiently bounded hit
+func (r *keywordRule) matchLabels(domain string) bool {
+	for _, label := range strings.Split(domain, ".") {
+		for offset := 0; ; {
+			i := strings.Index(label[offset:], r.term)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			end := start + len(r.term)
+			if labelBoundaries(label, start, end) >= r.minBoundaries {
+				return true
+			}
+			offset = start + 1
+		}
+	}
+	return false
+}
+
+// labelBoundaries counts the sides of label[start:end] that touch the label edge or a hyphen
+func labelBoundaries(label string, start, end int) int {
+	n := 0
+	if start == 0 || label[start-1] == '-' {
+		n++
+	}
+	if end == len(label) || label[end] == '-' {
+		n++
+	}
+	return n
+}
+
+// isASCII reports whether s contains only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+package certstream
+
+import "strings"
+
+// DefaultLookalikeThreshold is the minimum similarity score reported as a lookalike
+const DefaultLookalikeThreshold = 0.8
+
+// Watch entry prefixes selecting a matching mode
+const (
+	lookalikePrefix = "lookalike:" // lookalike detection, e.g. "lookalike:nhn.no"
+	brandPrefix     = "brand:"     // brand label on any public suffix, e.g. "brand:nhn"
+)
+
+// Edit costs used by the weighted distance. Mistakes typical of typosquatting are cheaper
+// than arbitrary edits so that they score closer to the brand.
+const (
+	costEdit          = 1.0  // arbitrary insertion or substitution
+	costOmission      = 0.75 // character left out
+	costDoubling      = 0.5  // character repeated
+	costAdjacent      = 0.5  // substitution with a neighbouring key or lookalike glyph
+	costTransposition = 0.5  // two neighbouring characters swapped
+)
+
+// brand is the part of a watched domain that lookalikes imitate
+type brand struct {
+	domain string // watched domain, e.g. "nhn.no"
+	label  string // brand label, e.g. "nhn"
+	suffix string // suffix after the brand label, e.g. "no"
+}
+
+// newBrand splits a watched domain into its brand label and public suffix
+func newBrand(domain string) brand {
+	if label, suffix := splitRegistrable(domain); label != "" {
+		return brand{domain: domain, label: label, suffix: suffix}
+	}
+	return brand{domain: domain, label: domain}
+}
+
+// LookalikeScore returns how closely a certificate domain imitates a watched domain,
+// from 0 (unrelated) to 1. The domain itself and its subdomains score 0 since they are
+// regular matches rather than lookalikes.
+func LookalikeScore(certDomain, watchDomain string) float64 {
+	certDomain = strings.TrimSuffix(strings.ToLower(certDomain), ".")
+	watchDomain = strings.TrimSuffix(strings.ToLower(watchDomain), ".")
+	if certDomain == "" || watchDomain == "" {
+		return 0
+	}
+	return newBrand(watchDomain).score(certDomain)
+}
+
+// score rates a lowercased certificate domain against the brand
+func (b brand) score(domain string) float64 {
+	if domain == b.domain || strings.HasSuffix(domain, "."+b.domain) {
+		return 0
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return 0
+	}
+	best := 0.0
+	raise := func(score float64) {
+		if score > best {
+			best = score
+		}
+	}
+
+	// Brand domain embedded as leading labels: nhn.no.secure-login.xyz
+	if strings.HasPrefix(domain, b.domain+".") || strings.Contains(domain, "."+b.domain+".") {
+		raise(0.95)
+	}
+
+	sld, suffix := splitRegistrable(domain)
+	if sld == "" {
+		return best
+	}
+
+	// TLD swap: nhn.com or nhn.co.uk for nhn.no
+	if sld == b.label && suffix != b.suffix {
+		raise(0.95)
+	}
+	// Suffix folded into the label: nhn-no.com, nhnno.com
+	if b.suffix != "" {
+		folded := strings.ReplaceAll(b.suffix, ".", "-")
+		if sld == b.label+"-"+folded || sld == b.label+strings.ReplaceAll(b.suffix, ".", "") {
+			raise(0.95)
+		}
+	}
+
+	// Only labels left of the public suffix can carry the brand
+	for _, label := range labels[:len(labels)-strings.Count(suffix, ".")-1] {
+		raise(b.scoreToken(label))
+		if strings.Contains(label, "-") {
+			for _, token := range strings.Split(label, "-") {
+				raise(b.scoreToken(token))
+			}
+		}
+		// Brand embedded in a longer label: mynhn.no, nhnlogin.com
+		if len(b.label) >= 3 && label != b.label && strings.Contains(label, b.label) {
+			raise(0.8)
+		}
+	}
+	return best
+}
+
+// scoreToken rates a single label or hyphen-separated token against the brand label
+func (b brand) scoreToken(token string) float64 {
+	if token == "" {
+		return 0
+	}
+	if token == b.label {
+		return 0.9
+	}
+	cost := weightedDistance(b.label, token)
+	score := 1 - cost/float64(len(b.label))
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// weightedDistance computes an optimal string alignment distance from the brand to a
+// candidate, with reduced costs for omissions, doubled characters, keyboard or glyph
+// neighbours and transpositions.
+func weightedDistance(brand, candidate string) float64 {
+	a, b := brand, candidate
+	prev2 := make([]float64, len(b)+1)
+	prev := make([]float64, len(b)+1)
+	cur := make([]float64, len(b)+1)
+
+	for j := 0; j <= len(b); j++ {
+		prev[j] = float64(j) * costEdit
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = float64(i) * costOmission
+		for j := 1; j <= len(b); j++ {
+			// Character from the brand left out of the candidate
+			best := prev[j] + costOmission
+
+			// Extra character in the candidate, cheaper when it repeats its neighbour
+			insert := costEdit
+			if (j >= 2 && b[j-1] == b[j-2]) || b[j-1] == a[i-1] {
+				insert = costDoubling
+			}
+			if v := cur[j-1] + insert; v < best {
+				best = v
+			}
+
+			substitute := costEdit
+			if a[i-1] == b[j-1] {
+				substitute = 0
+			} else if isNeighbour(a[i-1], b[j-1]) {
+				substitute = costAdjacent
+			}
+			if v := prev[j-1] + substitute; v < best {
+				best = v
+			}
+
+			if i >= 2 && j >= 2 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				if v := prev2[j-2] + costTransposition; v < best {
+					best = v
+				}
+			}
+			cur[j] = best
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// keyboardRows is the QWERTY layout used for adjacency
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// glyphPairs lists ASCII characters commonly swapped because they look alike
+var glyphPairs = []string{"0o", "1l", "1i", "il", "5s", "vu", "mn", "gq", "8b"}
+
+// neighbours maps each character to its keyboard and glyph neighbours
+var neighbours = buildNeighbours()
+
+func buildNeighbours() map[byte]string {
+	n := make(map[byte]string)
+	for r, row := range keyboardRows {
+		for c := 0; c < len(row); c++ {
+			ch := row[c]
+			if c > 0 {
+				n[ch] += string(row[c-1])
+			}
+			if c < len(row)-1 {
+				n[ch] += string(row[c+1])
+			}
+			// Keys above and below, allowing for the row stagger
+			for _, other := range []int{r - 1, r + 1} {
+				if other < 0 || other >= len(keyboardRows) {
+					continue
+				}
+				adjacentRow := keyboardRows[other]
+				for _, k := range []int{c - 1, c, c + 1} {
+					if k >= 0 && k < len(adjacentRow) {
+						n[ch] += string(adjacentRow[k])
+					}
+				}
+			}
+		}
+	}
+	for _, pair := range glyphPairs {
+		n[pair[0]] += string(pair[1])
+		n[pair[1]] += string(pair[0])
+	}
+	return n
+}
+
+// isNeighbour reports whether two characters are easily confused
+func isNeighbour(a, b byte) bool {
+	return strings.IndexByte(neighbours[a], b) >= 0
+}
@@ -1,15 +1,27 @@
 package certstream
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
-// IsDomainMatch checks if a certificate domain matches a monitored domain
-// Only matches exact domain or subdomains (e.g., nhn.no matches nhn.no or www.nhn.no, but NOT mynhn.no)
+// IsDomainMatch checks if a certificate domain matches a monitored domain or pattern
+// Plain domains match exactly or as subdomains (e.g., nhn.no matches nhn.no or www.nhn.no, but NOT mynhn.no).
+// Patterns containing wildcards or a mode prefix are evaluated as described on Pattern.
 func IsDomainMatch(certDomain, watchDomain string) bool {
 	// Check for empty domains first
 	if certDomain == "" || watchDomain == "" {
 		return false
 	}
 
+	if strings.ContainsAny(watchDomain, "*?:") {
+		pattern, err := ParsePattern(watchDomain)
+		if err != nil {
+			return false
+		}
+		return pattern.Match(certDomain)
+	}
+
 	certDomain = strings.ToLower(certDomain)
 	watchDomain = strings.ToLower(watchDomain)
 
@@ -26,3 +38,387 @@ func IsDomainMatch(certDomain, watchDomain string) bool {
 
 	return false
 }
+
+// matcher holds the compiled watch list used by the monitor workers
+type matcher struct {
+	patterns   []Pattern
+	index      *patternIndex
+	skeletons  *patternIndex // confusable skeletons of patterns, only set with homoglyph matching
+	regexes    []*regexRule
+	keywords   []*keywordRule
+	fields     []*fieldRule
+	fieldMode  FieldMode
+	expression *FilterExpression // gate applied after all other rules
+	lookalikes []lookalikeWatch
+	threshold  float64        // minimum lookalike score
+	filter     *payloadFilter // literal fragments for the payload prefilter
+	noFilter   bool           // at least one pattern has no literal, so every payload must be decoded
+}
+
+// lookalikeWatch links a brand to the index of the pattern that opted in to lookalike detection
+type lookalikeWatch struct {
+	brand   brand
+	pattern int
+}
+
+// newMatcher compiles the watch list and rules, logging and skipping invalid entries
+func newMatcher(config Config, logger Logger) *matcher {
+	m := &matcher{threshold: config.LookalikeThreshold}
+	if m.threshold <= 0 {
+		m.threshold = DefaultLookalikeThreshold
+	}
+
+	var needles [][]byte
+	for _, entry := range config.Domains {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, err := ParsePattern(entry)
+		if err != nil {
+			logger.Error("Ignoring watch pattern: %v", err)
+			continue
+		}
+		m.patterns = append(m.patterns, pattern)
+
+		if pattern.IsLookalike() {
+			// Lookalikes by definition do not contain the watched literal
+			m.lookalikes = append(m.lookalikes, lookalikeWatch{brand: newBrand(pattern.Domain()), pattern: len(m.patterns) - 1})
+			m.noFilter = true
+		}
+
+		literal := pattern.Literal()
+		if literal == "" {
+			m.noFilter = true
+			continue
+		}
+		needles = append(needles, []byte(literal))
+	}
+	m.index = newPatternIndex(m.patterns)
+
+	if config.HomoglyphMatching && len(m.patterns) > 0 {
+		skeletons := make([]Pattern, len(m.patterns))
+		for i, pattern := range m.patterns {
+			skeletons[i] = pattern.skeleton()
+		}
+		m.skeletons = newPatternIndex(skeletons)
+		// Homoglyph candidates are IDNs, which always travel as A-labels
+		needles = append(needles, []byte(acePrefix))
+	}
+
+	for _, rule := range config.RegexRules {
+		compiled, err := compileRegexRule(rule)
+		if err != nil {
+			logger.Error("Ignoring regex rule: %v", err)
+			continue
+		}
+		m.regexes = append(m.regexes, compiled)
+
+		if compiled.literals == nil {
+			m.noFilter = true
+			continue
+		}
+		for _, literal := range compiled.literals {
+			needles = append(needles, []byte(literal))
+		}
+	}
+
+	for _, rule := range config.KeywordRules {
+		compiled, err := compileKeywordRule(rule)
+		if err != nil {
+			logger.Error("Ignoring keyword rule: %v", err)
+			continue
+		}
+		m.keywords = append(m.keywords, compiled)
+
+		if !compiled.ascii {
+			// Unicode terms only appear in the payload as punycode
+			m.noFilter = true
+			continue
+		}
+		needles = append(needles, []byte(compiled.term))
+	}
+
+	m.fieldMode = config.FieldMode
+	if m.fieldMode == "" {
+		m.fieldMode = FieldModeAnd
+	}
+	if m.fieldMode != FieldModeAnd && m.fieldMode != FieldModeOr {
+		logger.Error("Unknown field mode %q, using %q", config.FieldMode, FieldModeAnd)
+		m.fieldMode = FieldModeAnd
+	}
+	for _, rule := range config.FieldRules {
+		compiled, err := compileFieldRule(rule)
+		if err != nil {
+			logger.Error("Ignoring field rule: %v", err)
+			continue
+		}
+		m.fields = append(m.fields, compiled)
+	}
+	if len(m.fields) > 0 && (m.fieldMode == FieldModeOr || !m.hasDomainRules()) {
+		// Field rules alone can report a certificate, and field values are not domain literals
+		m.noFilter = true
+	}
+
+	if strings.TrimSpace(config.FilterExpression) != "" {
+		expression, err := ParseFilterExpression(config.FilterExpression)
+		if err != nil {
+			logger.Error("Ignoring filter expression: %v", err)
+		} else {
+			m.expression = expression
+			if !m.hasDomainRules() && len(m.fields) == 0 {
+				m.noFilter = true
+			}
+		}
+	}
+
+	m.filter = newPayloadFilter(needles)
+	return m
+}
+
+// empty reports whether the matcher has no patterns or rules (monitor everything)
+func (m *matcher) empty() bool {
+	return !m.hasDomainRules() && len(m.fields) == 0 && m.expression == nil
+}
+
+// hasDomainRules reports whether any watch patterns, regex or keyword rules are configured
+func (m *matcher) hasDomainRules() bool {
+	return len(m.patterns) > 0 || len(m.regexes) > 0 || len(m.keywords) > 0
+}
+
+// prefilter reports whether the raw payload may contain a match
+func (m *matcher) prefilter(data []byte) bool {
+	return m.noFilter || m.filter.contains(data)
+}
+
+// evaluate applies the domain rules to the given certificate domains, combines the result
+// with the field rules according to the field mode and finally applies the filter
+// expression. When only field rules decide, the certificate's primary domain is reported
+// with kind MatchKindField; when only the expression decides, the first domain that
+// satisfies it is reported with kind MatchKindFilter, or the primary domain when the
+// expression does not test domains.
+func (m *matcher) evaluate(cert *CertData, domains []string) ([]string, []Match) {
+	if m.expression == nil {
+		return m.evaluateRules(cert, domains)
+	}
+	if !m.hasDomainRules() && len(m.fields) == 0 {
+		if !m.expression.Match(cert) {
+			return nil, nil
+		}
+		pattern := m.expression.String()
+		if domain := m.expression.matchingDomain(cert); domain != "" {
+			return []string{filterPrefix + pattern}, []Match{domainMatch(domain, pattern, "", MatchKindFilter)}
+		}
+		return []string{filterPrefix + pattern}, primaryMatch(cert, pattern, "", MatchKindFilter)
+	}
+
+	fired, matches := m.evaluateRules(cert, domains)
+	if len(fired) == 0 || !m.expression.Match(cert) {
+		return nil, nil
+	}
+	return fired, matches
+}
+
+// evaluateRules applies the domain rules and field rules
+func (m *matcher) evaluateRules(cert *CertData, domains []string) ([]string, []Match) {
+	fired, matches := m.match(domains)
+	if len(m.fields) == 0 {
+		return fired, matches
+	}
+	if m.fieldMode == FieldModeAnd && m.hasDomainRules() && len(matches) == 0 {
+		return nil, nil
+	}
+
+	var fieldHits []*fieldRule
+	for _, rule := range m.fields {
+		if rule.matchCert(cert) {
+			fieldHits = append(fieldHits, rule)
+		} else if m.fieldMode == FieldModeAnd {
+			return nil, nil
+		}
+	}
+	if len(fieldHits) == 0 {
+		return fired, matches
+	}
+
+	for _, rule := range fieldHits {
+		fired = append(fired, rule.name())
+	}
+	if len(matches) == 0 {
+		matches = primaryMatch(cert, fieldHits[0].rule.String(), fieldHits[0].rule.Field, MatchKindField)
+		for i := range matches {
+			for _, rule := range fieldHits {
+				matches[i].Keys = append(matches[i].Keys, rule.name())
+			}
+		}
+	}
+	return fired, matches
+}
+
+// primaryMatch reports the certificate's subject common name, or its first SAN when the
+// name is empty, for rules that are not about a particular domain
+func primaryMatch(cert *CertData, pattern, rule string, kind MatchKind) []Match {
+	domain := cert.Data.LeafCert.Subject.CN
+	if domain == "" && len(cert.Data.LeafCert.AllDomains) > 0 {
+		domain = cert.Data.LeafCert.AllDomains[0]
+	}
+	if domain == "" {
+		return nil
+	}
+	return []Match{domainMatch(domain, pattern, rule, kind)}
+}
+
+// domainMatch reports a certificate domain selected by a rule that is not a watch pattern
+func domainMatch(domain, pattern, rule string, kind MatchKind) Match {
+	return Match{
+		Domain:            domain,
+		RegistrableDomain: RegistrableDomain(domain),
+		Pattern:           pattern,
+		Rule:              rule,
+		Kind:              kind,
+		Score:             1,
+	}
+}
+
+// match returns the patterns and rules that fired and the certificate domains behind them.
+// Matches are reported in certificate order, each with the first pattern or rule it hit
+// and, in Keys, every pattern and rule it hit.
+func (m *matcher) match(domains []string) ([]string, []Match) {
+	var matches []Match
+	var patternHits, domainHits []int
+	regexHit := make([]bool, len(m.regexes))
+	keywordHit := make([]bool, len(m.keywords))
+
+	for _, certDomain := range domains {
+		var first *Match
+		var keys []string
+
+		domainHits = m.index.lookup(certDomain, domainHits[:0])
+		if len(domainHits) > 0 {
+			pattern := m.patterns[minIndex(domainHits)]
+			first = &Match{Domain: certDomain, Pattern: pattern.String(), Kind: pattern.MatchKind(certDomain), Score: 1}
+			patternHits = append(patternHits, domainHits...)
+			keys = m.patternKeys(domainHits, keys)
+		}
+		for i, rule := range m.regexes {
+			if !rule.matchDomain(certDomain) {
+				continue
+			}
+			regexHit[i] = true
+			keys = append(keys, "regex:"+rule.name)
+			if first == nil {
+				first = &Match{Domain: certDomain, Pattern: rule.re.String(), Rule: rule.name, Kind: MatchKindRegex, Score: 1}
+			}
+		}
+		for i, rule := range m.keywords {
+			if !rule.matchDomain(certDomain) {
+				continue
+			}
+			keywordHit[i] = true
+			keys = append(keys, rule.name())
+			if first == nil {
+				first = &Match{Domain: certDomain, Pattern: rule.name(), Rule: rule.term, Kind: MatchKindKeyword, Score: 1}
+			}
+		}
+		if first == nil && m.skeletons != nil && IsIDN(certDomain) {
+			domainHits = m.skeletons.lookup(Skeleton(certDomain), domainHits[:0])
+			if len(domainHits) > 0 {
+				pattern := m.patterns[minIndex(domainHits)]
+				first = &Match{Domain: certDomain, Pattern: pattern.String(), Kind: MatchKindHomoglyph, Score: 1}
+				patternHits = append(patternHits, domainHits...)
+				keys = m.patternKeys(domainHits, keys)
+			}
+		}
+		if first == nil && len(m.lookalikes) > 0 {
+			before := len(patternHits)
+			first, patternHits = m.matchLookalike(certDomain, patternHits)
+			keys = m.patternKeys(patternHits[before:], keys)
+		}
+		if first != nil {
+			if IsIDN(certDomain) {
+				first.UnicodeDomain = ToUnicode(certDomain)
+			}
+			first.RegistrableDomain = RegistrableDomain(certDomain)
+			first.Keys = primaryKeyFirst(keys, first.Key())
+			matches = append(matches, *first)
+		}
+	}
+
+	var fired []string
+	sort.Ints(patternHits)
+	for i, index := range patternHits {
+		if i == 0 || patternHits[i-1] != index {
+			fired = append(fired, m.patterns[index].String())
+		}
+	}
+	for i, rule := range m.regexes {
+		if regexHit[i] {
+			fired = append(fired, "regex:"+rule.name)
+		}
+	}
+	for i, rule := range m.keywords {
+		if keywordHit[i] {
+			fired = append(fired, rule.name())
+		}
+	}
+	return fired, matches
+}
+
+// patternKeys appends the watch patterns behind the given indexes, in watch list order
+func (m *matcher) patternKeys(hits []int, keys []string) []string {
+	if len(hits) == 0 {
+		return keys
+	}
+	sorted := append([]int(nil), hits...)
+	sort.Ints(sorted)
+	for i, index := range sorted {
+		if i == 0 || sorted[i-1] != index {
+			keys = append(keys, m.patterns[index].String())
+		}
+	}
+	return keys
+}
+
+// primaryKeyFirst moves the key of the reported pattern or rule to the front
+func primaryKeyFirst(keys []string, primary string) []string {
+	for i, key := range keys {
+		if key == primary {
+			copy(keys[1:i+1], keys[:i])
+			keys[0] = primary
+			return keys
+		}
+	}
+	return append([]string{primary}, keys...)
+}
+
+// matchLookalike returns the best scoring lookalike match above the threshold, if any
+func (m *matcher) matchLookalike(certDomain string, patternHits []int) (*Match, []int) {
+	domain := strings.TrimSuffix(strings.ToLower(certDomain), ".")
+	var best *Match
+	for _, watch := range m.lookalikes {
+		score := watch.brand.score(domain)
+		if score < m.threshold {
+			continue
+		}
+		patternHits = append(patternHits, watch.pattern)
+		if best == nil || score > best.Score {
+			best = &Match{
+				Domain:  certDomain,
+				Pattern: m.patterns[watch.pattern].String(),
+				Kind:    MatchKindLookalike,
+				Score:   score,
+			}
+		}
+	}
+	return best, patternHits
+}
+
+// minIndex returns the smallest value of a non-empty slice
+func minIndex(indexes []int) int {
+	lowest := indexes[0]
+	for _, i := range indexes[1:] {
+		if i < lowest {
+			lowest = i
+		}
+	}
+	return lowest
+}
@@ -0,0 +1,206 @@
+package certstream
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pattern is a compiled watch pattern.
+//
+// A pattern without wildcards keeps the classic suffix semantics: it matches the
+// domain itself and any of its subdomains. Patterns containing wildcards are
+// anchored globs evaluated label by label:
+//   - "*" as a whole label matches exactly one label ("*.example.com" matches only direct children)
+//   - "**" as a whole label matches one or more labels ("**.example.com" matches any depth)
+//   - "*" inside a label matches any run of characters within that label ("vpn-*.example.com")
+//   - "?" matches exactly one character within a label
+//
+// A plain domain prefixed with "lookalike:" additionally opts in to lookalike detection
+// for that domain, see LookalikeScore.
+//
+// A single label prefixed with "brand:" matches that label as the registrable name under
+// any public suffix: "brand:nhn" matches nhn.no, www.nhn.com and nhn.co.uk, see RegistrableDomain.
+type Pattern struct {
+	raw       string
+	labels    []string
+	glob      bool
+	lookalike bool
+	brand     bool
+}
+
+// ParsePattern validates and compiles a watch pattern
+func ParsePattern(s string) (Pattern, error) {
+	raw := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	lookalike, brand := false, false
+	if rest, ok := strings.CutPrefix(raw, lookalikePrefix); ok {
+		raw, lookalike = rest, true
+	} else if rest, ok := strings.CutPrefix(raw, brandPrefix); ok {
+		raw, brand = rest, true
+	}
+	if raw == "" {
+		return Pattern{}, fmt.Errorf("empty pattern")
+	}
+
+	labels := strings.Split(raw, ".")
+	glob := false
+	for _, label := range labels {
+		if label == "" {
+			return Pattern{}, fmt.Errorf("pattern %q contains an empty label", s)
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case c == '*' || c == '?':
+				glob = true
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c >= 0x80:
+			default:
+				return Pattern{}, fmt.Errorf("pattern %q contains invalid character %q", s, c)
+			}
+		}
+		if strings.Contains(label, "**") && label != "**" {
+			return Pattern{}, fmt.Errorf("pattern %q: \"**\" must be a whole label", s)
+		}
+	}
+
+	if lookalike && glob {
+		return Pattern{}, fmt.Errorf("pattern %q: lookalike detection requires a plain domain", s)
+	}
+	if brand && (glob || len(labels) != 1) {
+		return Pattern{}, fmt.Errorf("pattern %q: brand patterns take a single label without wildcards", s)
+	}
+
+	return Pattern{raw: raw, labels: labels, glob: glob, lookalike: lookalike, brand: brand}, nil
+}
+
+// String returns the normalized pattern text
+func (p Pattern) String() string {
+	switch {
+	case p.lookalike:
+		return lookalikePrefix + p.raw
+	case p.brand:
+		return brandPrefix + p.raw
+	}
+	return p.raw
+}
+
+// Domain returns the pattern without any mode prefix
+func (p Pattern) Domain() string {
+	return p.raw
+}
+
+// IsLookalike reports whether lookalike detection is enabled for the pattern
+func (p Pattern) IsLookalike() bool {
+	return p.lookalike
+}
+
+// IsGlob reports whether the pattern contains wildcards
+func (p Pattern) IsGlob() bool {
+	return p.glob
+}
+
+// Match reports whether a certificate domain matches the pattern
+func (p Pattern) Match(domain string) bool {
+	return p.MatchKind(domain) != ""
+}
+
+// MatchKind reports how a certificate domain matches the pattern, or "" if it does not.
+// Lookalike scoring is not part of this check.
+func (p Pattern) MatchKind(domain string) MatchKind {
+	if domain == "" || p.raw == "" {
+		return ""
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	switch {
+	case p.brand:
+		if label, _ := splitRegistrable(domain); label == p.raw {
+			return MatchKindBrand
+		}
+	case p.glob:
+		if matchLabels(p.labels, strings.Split(domain, ".")) {
+			return MatchKindPattern
+		}
+	case domain == p.raw:
+		return MatchKindExact
+	case strings.HasSuffix(domain, "."+p.raw):
+		return MatchKindSubdomain
+	}
+	return ""
+}
+
+// IsBrand reports whether the pattern matches a brand label under any public suffix
+func (p Pattern) IsBrand() bool {
+	return p.brand
+}
+
+// Literal returns the longest wildcard-free fragment of the pattern.
+// Every domain matching the pattern contains this fragment, which makes it
+// usable as a byte-level prefilter. An empty result means no such fragment exists.
+func (p Pattern) Literal() string {
+	if !p.glob {
+		return p.raw
+	}
+	longest := ""
+	for _, part := range strings.FieldsFunc(p.raw, func(r rune) bool { return r == '*' || r == '?' }) {
+		if len(part) > len(longest) {
+			longest = part
+		}
+	}
+	return longest
+}
+
+// skeleton returns the pattern with its text folded by Skeleton, keeping its mode
+func (p Pattern) skeleton() Pattern {
+	folded := p
+	folded.raw = Skeleton(p.raw)
+	folded.labels = strings.Split(folded.raw, ".")
+	return folded
+}
+
+// matchLabels matches domain labels against pattern labels, expanding "**" as needed
+func matchLabels(pattern, labels []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			// "**" consumes at least one label
+			for i := 1; i <= len(labels); i++ {
+				if matchLabels(rest, labels[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(labels) == 0 || !matchLabel(pattern[0], labels[0]) {
+			return false
+		}
+		pattern = pattern[1:]
+		labels = labels[1:]
+	}
+	return len(labels) == 0
+}
+
+// matchLabel matches a single label against a glob with "*" and "?"
+func matchLabel(glob, label string) bool {
+	star, mark := -1, 0
+	g, l := 0, 0
+	for l < len(label) {
+		switch {
+		case g < len(glob) && (glob[g] == '?' || glob[g] == label[l]):
+			g++
+			l++
+		case g < len(glob) && glob[g] == '*':
+			star, mark = g, l
+			g++
+		case star >= 0:
+			g = star + 1
+			mark++
+			l = mark
+		default:
+			return false
+		}
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
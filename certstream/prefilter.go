@@ -0,0 +1,160 @@
+package certstream
+
+import "sort"
+
+// smallNeedleSet is the largest needle count scanned with bytesContainsFold directly;
+// beyond it a single Aho–Corasick pass over the payload is cheaper
+const smallNeedleSet = 4
+
+// payloadFilter answers whether a raw payload contains any of a set of lowercase needles,
+// ignoring ASCII case in the payload
+type payloadFilter struct {
+	needles [][]byte
+	ac      *ahoCorasick
+}
+
+// newPayloadFilter builds the filter once for the lifetime of a matcher
+func newPayloadFilter(needles [][]byte) *payloadFilter {
+	f := &payloadFilter{needles: needles}
+	if len(needles) > smallNeedleSet {
+		f.ac = newAhoCorasick(needles)
+	}
+	return f
+}
+
+// contains reports whether any needle occurs in the payload
+func (f *payloadFilter) contains(data []byte) bool {
+	if f.ac != nil {
+		return f.ac.contains(data)
+	}
+	for _, needle := range f.needles {
+		if bytesContainsFold(data, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// ahoCorasick is a multi-pattern automaton over lowercase bytes. Transitions are stored
+// in compressed sparse rows so that very large watch lists stay compact.
+type ahoCorasick struct {
+	root      [256]int32 // transitions out of the root, 0 when absent
+	edgeStart []int32    // edges of state s are edgeByte/edgeNext[edgeStart[s]:edgeStart[s+1]]
+	edgeByte  []byte
+	edgeNext  []int32
+	fail      []int32
+	out       []bool // a needle ends at this state or one of its suffixes
+}
+
+// acEdge is a transition used while building the automaton
+type acEdge struct {
+	b    byte
+	next int32
+}
+
+// newAhoCorasick builds the automaton from lowercase needles
+func newAhoCorasick(needles [][]byte) *ahoCorasick {
+	// Build the trie with per-state edge lists
+	edges := [][]acEdge{nil}
+	out := []bool{false}
+	for _, needle := range needles {
+		if len(needle) == 0 {
+			continue
+		}
+		state := int32(0)
+		for _, b := range needle {
+			next, ok := findEdge(edges[state], b)
+			if !ok {
+				next = int32(len(edges))
+				edges[state] = append(edges[state], acEdge{b: b, next: next})
+				edges = append(edges, nil)
+				out = append(out, false)
+			}
+			state = next
+		}
+		out[state] = true
+	}
+
+	// Breadth-first pass to compute failure links
+	fail := make([]int32, len(edges))
+	queue := make([]int32, 0, len(edges))
+	for _, e := range edges[0] {
+		queue = append(queue, e.next)
+	}
+	for head := 0; head < len(queue); head++ {
+		state := queue[head]
+		for _, e := range edges[state] {
+			f := fail[state]
+			for {
+				if next, ok := findEdge(edges[f], e.b); ok {
+					fail[e.next] = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = fail[f]
+			}
+			out[e.next] = out[e.next] || out[fail[e.next]]
+			queue = append(queue, e.next)
+		}
+	}
+
+	// Compact the edge lists into sorted sparse rows
+	ac := &ahoCorasick{
+		edgeStart: make([]int32, len(edges)+1),
+		fail:      fail,
+		out:       out,
+	}
+	for state, list := range edges {
+		sort.Slice(list, func(i, j int) bool { return list[i].b < list[j].b })
+		ac.edgeStart[state] = int32(len(ac.edgeByte))
+		for _, e := range list {
+			ac.edgeByte = append(ac.edgeByte, e.b)
+			ac.edgeNext = append(ac.edgeNext, e.next)
+		}
+	}
+	ac.edgeStart[len(edges)] = int32(len(ac.edgeByte))
+	for _, e := range edges[0] {
+		ac.root[e.b] = e.next
+	}
+	return ac
+}
+
+func findEdge(list []acEdge, b byte) (int32, bool) {
+	for _, e := range list {
+		if e.b == b {
+			return e.next, true
+		}
+	}
+	return 0, false
+}
+
+// step follows the transition for b, falling back along failure links
+func (ac *ahoCorasick) step(state int32, b byte) int32 {
+	for state != 0 {
+		start, end := ac.edgeStart[state], ac.edgeStart[state+1]
+		for i := start; i < end; i++ {
+			if ac.edgeByte[i] == b {
+				return ac.edgeNext[i]
+			}
+			if ac.edgeByte[i] > b {
+				break
+			}
+		}
+		state = ac.fail[state]
+	}
+	return ac.root[b]
+}
+
+// contains reports whether any needle occurs in the haystack, ignoring ASCII case
+func (ac *ahoCorasick) contains(haystack []byte) bool {
+	state := int32(0)
+	for _, b := range haystack {
+		state = ac.step(state, asciiLower(b))
+		if ac.out[state] {
+			return true
+		}
+	}
+	return false
+}
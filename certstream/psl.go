@@ -0,0 +1,164 @@
+package certstream
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+//go:embed data/public_suffix_list.dat
+var embeddedPublicSuffixList string
+
+// PublicSuffixList holds the rules of a Public Suffix List (https://publicsuffix.org/)
+type PublicSuffixList struct {
+	rules      map[string]struct{} // normal rules, e.g. "co.uk"
+	wildcards  map[string]struct{} // parents of wildcard rules, e.g. "ck" for "*.ck"
+	exceptions map[string]struct{} // exception rules without the "!", e.g. "www.ck"
+}
+
+// activeSuffixList is the list used by RegistrableDomain and PublicSuffix
+var activeSuffixList atomic.Pointer[PublicSuffixList]
+
+func init() {
+	list, err := ParsePublicSuffixList(strings.NewReader(embeddedPublicSuffixList))
+	if err != nil {
+		panic(fmt.Sprintf("certstream: invalid embedded public suffix list: %v", err))
+	}
+	activeSuffixList.Store(list)
+}
+
+// ParsePublicSuffixList reads a list in the publicsuffix.org format
+func ParsePublicSuffixList(r io.Reader) (*PublicSuffixList, error) {
+	list := &PublicSuffixList{
+		rules:      make(map[string]struct{}),
+		wildcards:  make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Rules end at the first whitespace; anything after is a comment
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			list.exceptions[rule[1:]] = struct{}{}
+		case strings.HasPrefix(rule, "*."):
+			list.wildcards[rule[2:]] = struct{}{}
+		default:
+			list.rules[rule] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(list.rules) == 0 && len(list.wildcards) == 0 {
+		return nil, fmt.Errorf("no rules found")
+	}
+	return list, nil
+}
+
+// LoadPublicSuffixList replaces the embedded snapshot with a list read from a local
+// file, such as a fresh copy of https://publicsuffix.org/list/public_suffix_list.dat
+func LoadPublicSuffixList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	list, err := ParsePublicSuffixList(f)
+	if err != nil {
+		return fmt.Errorf("public suffix list %s: %w", path, err)
+	}
+	activeSuffixList.Store(list)
+	return nil
+}
+
+// PublicSuffix returns the public suffix (eTLD) of a domain using the active list
+func PublicSuffix(domain string) string {
+	return activeSuffixList.Load().PublicSuffix(domain)
+}
+
+// RegistrableDomain returns the registrable domain (eTLD+1) of a domain using the
+// active list, e.g. "www.nhn.co.uk" yields "nhn.co.uk". It returns "" when the domain
+// is itself a public suffix.
+func RegistrableDomain(domain string) string {
+	return activeSuffixList.Load().RegistrableDomain(domain)
+}
+
+// PublicSuffix returns the public suffix (eTLD) of a domain
+func (l *PublicSuffixList) PublicSuffix(domain string) string {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return ""
+	}
+	labels := strings.Split(domain, ".")
+
+	// Internationalized suffixes are listed in their Unicode form, while certificates
+	// carry them punycode encoded
+	keys := labels
+	if IsIDN(domain) {
+		if decoded, err := DecodeIDN(domain); err == nil && strings.Count(decoded, ".") == len(labels)-1 {
+			keys = strings.Split(decoded, ".")
+		}
+	}
+
+	// Walk from the longest candidate to the shortest; the first hit is the longest rule
+	for i := range labels {
+		candidate := strings.Join(keys[i:], ".")
+		if _, ok := l.exceptions[candidate]; ok {
+			// An exception rule makes its parent the suffix
+			return strings.Join(labels[i+1:], ".")
+		}
+		if _, ok := l.rules[candidate]; ok {
+			return strings.Join(labels[i:], ".")
+		}
+		if i+1 < len(labels) {
+			if _, ok := l.wildcards[strings.Join(keys[i+1:], ".")]; ok {
+				return strings.Join(labels[i:], ".")
+			}
+		}
+	}
+	// The implicit "*" rule makes an unknown TLD a public suffix
+	return labels[len(labels)-1]
+}
+
+// RegistrableDomain returns the registrable domain (eTLD+1) of a domain, or "" when
+// the domain is itself a public suffix
+func (l *PublicSuffixList) RegistrableDomain(domain string) string {
+	domain = normalizeDomain(domain)
+	suffix := l.PublicSuffix(domain)
+	if suffix == "" || len(domain) <= len(suffix) {
+		return ""
+	}
+	rest := domain[:len(domain)-len(suffix)-1]
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest + "." + suffix
+}
+
+// splitRegistrable splits a domain into the label left of its public suffix and the suffix
+func splitRegistrable(domain string) (label, suffix string) {
+	registrable := RegistrableDomain(domain)
+	if registrable == "" {
+		return "", ""
+	}
+	label, suffix, _ = strings.Cut(registrable, ".")
+	return label, suffix
+}
+
+// normalizeDomain lowercases a domain and strips a trailing dot and wildcard label
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	return strings.TrimPrefix(domain, "*.")
+}
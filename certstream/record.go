@@ -0,0 +1,258 @@
+package certstream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captureLineLimit bounds a capture line, matching the websocket read limit
+const captureLineLimit = 100 * 1024 * 1024
+
+// captureFlushInterval is how often the recorder flushes the capture file, bounding
+// what a crash loses; ReplaySource plays a capture cut short up to its last flush
+const captureFlushInterval = 10 * time.Second
+
+// captureRecord is one line of a capture file. Messages that are not valid JSON are
+// kept in Raw, which encodes as base64.
+type captureRecord struct {
+	Time    time.Time       `json:"time"`
+	Source  string          `json:"source,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Raw     []byte          `json:"raw,omitempty"`
+}
+
+// Recorder writes raw messages with their receive time to a gzip-compressed NDJSON
+// capture file, which ReplaySource can play back. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	file     *os.File
+	gz       *gzip.Writer
+	buf      *bufio.Writer
+	messages uint64
+	flushed  time.Time // receive time of the record the file was last flushed at
+	err      error     // first write error; later records are not attempted
+}
+
+// NewRecorder creates, or truncates, the capture file at path
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+	gz := gzip.NewWriter(file)
+	return &Recorder{file: file, gz: gz, buf: bufio.NewWriter(gz)}, nil
+}
+
+// Record appends a message received from source at the given time
+func (r *Recorder) Record(source string, at time.Time, data []byte) error {
+	record := captureRecord{Time: at.UTC(), Source: source}
+	if json.Valid(data) {
+		record.Message = data
+	} else {
+		record.Raw = data
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if _, err := r.buf.Write(append(line, '\n')); err != nil {
+		r.err = fmt.Errorf("failed to write capture file: %w", err)
+		return r.err
+	}
+	r.messages++
+	if r.flushed.IsZero() {
+		r.flushed = at
+	} else if at.Sub(r.flushed) >= captureFlushInterval {
+		if err := r.flush(); err != nil {
+			r.err = fmt.Errorf("failed to write capture file: %w", err)
+			return r.err
+		}
+		r.flushed = at
+	}
+	return nil
+}
+
+// flush writes the buffered records as a complete deflate block; r.mu must be held
+func (r *Recorder) flush() error {
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+	return r.gz.Flush()
+}
+
+// Messages returns the number of messages recorded
+func (r *Recorder) Messages() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages
+}
+
+// Close flushes the capture and closes the file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.buf.Flush()
+	if closeErr := r.gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write capture file: %w", err)
+	}
+	return nil
+}
+
+// ReplaySource is a Source playing back a capture file written by a Recorder. With
+// speed 1 messages are delivered with their original spacing, with 10 ten times as
+// fast, and with 0 as fast as the workers take them. Replay waits for the queue
+// instead of dropping messages, so a replay always yields the same certificates.
+type ReplaySource struct {
+	path   string
+	speed  float64
+	logger Logger
+
+	file    *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+
+	delivered int64     // lines delivered, skipped when the source is restarted
+	first     time.Time // receive time of the first replayed message
+	started   time.Time // when the first message was replayed
+	line      atomic.Int64
+	health    sourceHealth
+}
+
+// NewReplaySource creates a source replaying the capture at path at the given speed
+func NewReplaySource(path string, speed float64) *ReplaySource {
+	if speed < 0 {
+		speed = 0
+	}
+	return &ReplaySource{path: path, speed: speed, logger: NewDefaultLogger(false)}
+}
+
+// SetLogger sets the logger used for a capture cut short
+func (s *ReplaySource) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// Name returns the capture path
+func (s *ReplaySource) Name() string {
+	return "replay:" + s.path
+}
+
+// Start opens the capture, continuing after the messages already delivered
+func (s *ReplaySource) Start(ctx context.Context) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		s.health.failed(err)
+		return err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		err = fmt.Errorf("capture %s: %w", s.path, err)
+		s.health.failed(err)
+		return err
+	}
+	s.file, s.gz = file, gz
+	s.scanner = bufio.NewScanner(gz)
+	s.scanner.Buffer(make([]byte, 64*1024), captureLineLimit)
+	for i := int64(0); i < s.delivered && s.scanner.Scan(); i++ {
+	}
+	s.health.connected()
+	return nil
+}
+
+// Next returns the next recorded message, waiting for its time unless replaying as
+// fast as possible. It returns io.EOF at the end of the capture, including a capture
+// cut short by a crash, which ends at its last complete record.
+func (s *ReplaySource) Next(ctx context.Context) ([]byte, error) {
+	for s.scanner.Scan() {
+		s.delivered++
+		s.line.Store(s.delivered)
+		var record captureRecord
+		if err := json.Unmarshal(s.scanner.Bytes(), &record); err != nil {
+			err = fmt.Errorf("capture %s line %d: %w", s.path, s.delivered, err)
+			s.health.failed(err)
+			return nil, err
+		}
+		if err := s.wait(ctx, record.Time); err != nil {
+			return nil, err
+		}
+		s.health.received()
+		if record.Message != nil {
+			return record.Message, nil
+		}
+		return record.Raw, nil
+	}
+	err := s.scanner.Err()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		s.logger.Error("Capture %s is truncated, ending the replay after line %d", s.path, s.delivered)
+		return nil, io.EOF
+	}
+	if err != nil {
+		err = fmt.Errorf("capture %s: %w", s.path, err)
+		s.health.failed(err)
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// wait sleeps until a message received at t is due
+func (s *ReplaySource) wait(ctx context.Context, t time.Time) error {
+	if s.started.IsZero() {
+		s.first, s.started = t, time.Now()
+		return nil
+	}
+	if s.speed == 0 {
+		return nil
+	}
+	due := s.started.Add(time.Duration(float64(t.Sub(s.first)) / s.speed))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Close closes the capture
+func (s *ReplaySource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := errors.Join(s.gz.Close(), s.file.Close())
+	s.file, s.gz, s.scanner = nil, nil, nil
+	s.health.disconnected()
+	return err
+}
+
+// Health reports the replay position
+func (s *ReplaySource) Health() SourceHealth {
+	health := s.health.get()
+	health.Detail = fmt.Sprintf("line %d", s.line.Load())
+	return health
+}
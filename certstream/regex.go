@@ -0,0 +1,116 @@
+package certstream
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// regexRule is a compiled RegexRule
+type regexRule struct {
+	name     string
+	re       *regexp.Regexp
+	literals []string // at least one of these occurs in every match; nil when none could be extracted
+}
+
+// Validate checks that the rule has a name and a valid RE2 expression
+func (r RegexRule) Validate() error {
+	_, err := compileRegexRule(r)
+	return err
+}
+
+// compileRegexRule compiles the expression and extracts its prefilter literals
+func compileRegexRule(rule RegexRule) (*regexRule, error) {
+	if strings.TrimSpace(rule.Name) == "" {
+		return nil, fmt.Errorf("regex rule %q has no name", rule.Pattern)
+	}
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regex rule %q: %w", rule.Name, err)
+	}
+	parsed, err := syntax.Parse(rule.Pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("regex rule %q: %w", rule.Name, err)
+	}
+
+	return &regexRule{
+		name:     rule.Name,
+		re:       re,
+		literals: requiredLiterals(parsed.Simplify()),
+	}, nil
+}
+
+// matchDomain reports whether a certificate domain matches the rule
+func (r *regexRule) matchDomain(domain string) bool {
+	return r.re.MatchString(strings.ToLower(domain))
+}
+
+// requiredLiterals returns a set of lowercase strings such that every string matched
+// by re contains at least one of them. It returns nil when no such set can be derived.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{strings.ToLower(string(re.Rune))}
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min < 1 {
+			return nil
+		}
+		return requiredLiterals(re.Sub[0])
+
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			lits := requiredLiterals(sub)
+			if lits == nil {
+				return nil
+			}
+			all = append(all, lits...)
+		}
+		return all
+
+	case syntax.OpConcat:
+		// Merge runs of adjacent literals, then keep the most selective requirement
+		var best []string
+		var run strings.Builder
+		consider := func(lits []string) {
+			if lits != nil && minLen(lits) > minLen(best) {
+				best = lits
+			}
+		}
+		for _, sub := range re.Sub {
+			if sub.Op == syntax.OpLiteral {
+				run.WriteString(strings.ToLower(string(sub.Rune)))
+				continue
+			}
+			if run.Len() > 0 {
+				consider([]string{run.String()})
+				run.Reset()
+			}
+			consider(requiredLiterals(sub))
+		}
+		if run.Len() > 0 {
+			consider([]string{run.String()})
+		}
+		return best
+	}
+	return nil
+}
+
+// minLen returns the length of the shortest string, or 0 for an empty set
+func minLen(set []string) int {
+	if len(set) == 0 {
+		return 0
+	}
+	shortest := len(set[0])
+	for _, s := range set[1:] {
+		if len(s) < shortest {
+			shortest = len(s)
+		}
+	}
+	return shortest
+}
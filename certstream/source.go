@@ -0,0 +1,392 @@
+package certstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Source produces raw CertStream messages for the monitor's worker pool.
+//
+// The monitor calls Start, then Next until it returns an error, then Close. After an
+// error other than io.EOF the source is restarted with backoff, so Start must work
+// again after Close. io.EOF means the source is exhausted and is not restarted.
+// Next is only called from one goroutine at a time; Name and Health may be called
+// concurrently with the other methods.
+type Source interface {
+	Name() string
+	Start(ctx context.Context) error
+	Next(ctx context.Context) ([]byte, error)
+	Close() error
+	Health() SourceHealth
+}
+
+// SourceHealth describes the state of a source as reported by the source itself
+type SourceHealth struct {
+	Connected   bool      // Connected, or the last poll succeeded
+	LastMessage time.Time // When the source last produced a message
+	LastError   string    // Most recent error, empty if none
+	Detail      string    // Source specific state, e.g. a CT log position
+}
+
+// SourceStats holds the counters of one source, see MonitorStats.Sources
+type SourceStats struct {
+	Name          string
+	Received      uint64    // Messages queued for the workers
+	Dropped       uint64    // Messages dropped because the queue was full
+	Heartbeats    uint64    // Heartbeat messages, which are not queued
+	LastHeartbeat time.Time // When the last heartbeat arrived; servers send one every few seconds when idle
+	Restarts      uint64    // Restarts after an error
+	Finished      bool      // The source reported io.EOF and is not restarted
+	Health        SourceHealth
+}
+
+// sourceHealth is the mutex-protected SourceHealth kept by the built-in sources
+type sourceHealth struct {
+	mu     sync.Mutex
+	health SourceHealth
+}
+
+func (h *sourceHealth) get() SourceHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+func (h *sourceHealth) connected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.Connected = true
+}
+
+func (h *sourceHealth) disconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.Connected = false
+}
+
+func (h *sourceHealth) received() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.LastMessage = time.Now()
+}
+
+func (h *sourceHealth) failed(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.health.Connected = false
+	h.health.LastError = err.Error()
+}
+
+// websocketDialTimeout bounds the websocket handshake
+const websocketDialTimeout = 30 * time.Second
+
+// WebSocketSource is a Source reading from a CertStream websocket
+type WebSocketSource struct {
+	url    string
+	logger Logger
+	conn   *websocket.Conn
+	cancel context.CancelFunc
+	health sourceHealth
+}
+
+// NewWebSocketSource creates a source connecting to a CertStream websocket URL
+func NewWebSocketSource(url string) *WebSocketSource {
+	return &WebSocketSource{url: url, logger: NewDefaultLogger(false)}
+}
+
+// Name returns the websocket URL
+func (s *WebSocketSource) Name() string {
+	return s.url
+}
+
+// SetLogger sets the logger used for connection messages
+func (s *WebSocketSource) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// Start connects to the websocket and starts the keepalive pings
+func (s *WebSocketSource) Start(ctx context.Context) error {
+	s.logger.Debug("Connecting to %s", s.url)
+
+	dialCtx, cancelDial := context.WithTimeout(ctx, websocketDialTimeout)
+	defer cancelDial()
+	conn, _, err := websocket.Dial(dialCtx, s.url, nil)
+	if err != nil {
+		s.health.failed(err)
+		return err
+	}
+
+	// Set message read limit to 100MB to handle large certificate messages with full chains
+	conn.SetReadLimit(100 * 1024 * 1024)
+
+	s.logger.Debug("Connected to CertStream service")
+	s.health.connected()
+
+	pingCtx, cancel := context.WithCancel(ctx)
+	s.conn = conn
+	s.cancel = cancel
+	go s.pingLoop(pingCtx, conn)
+	return nil
+}
+
+// Next reads the next message
+func (s *WebSocketSource) Next(ctx context.Context) ([]byte, error) {
+	_, data, err := s.conn.Read(ctx)
+	if err != nil {
+		s.health.failed(err)
+		return nil, err
+	}
+	s.health.received()
+	return data, nil
+}
+
+// Close stops the pings and closes the connection
+func (s *WebSocketSource) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	s.cancel()
+	err := s.conn.Close(websocket.StatusNormalClosure, "")
+	s.conn = nil
+	s.health.disconnected()
+	return err
+}
+
+// Health reports the connection state
+func (s *WebSocketSource) Health() SourceHealth {
+	return s.health.get()
+}
+
+// pingLoop sends periodic pings to keep the connection alive
+func (s *WebSocketSource) pingLoop(ctx context.Context, conn *websocket.Conn) {
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.Ping(ctx); err != nil {
+				s.logger.Debug("Ping failed: %v", err)
+				return
+			}
+			s.logger.Debug("Sent ping to server")
+		}
+	}
+}
+
+// sourceRunner holds a source with its counters
+type sourceRunner struct {
+	source        Source
+	received      uint64
+	dropped       uint64
+	heartbeats    uint64
+	lastHeartbeat atomic.Int64 // unix nanoseconds
+	restarts      uint64
+	finished      uint32
+	// lossy sources drop messages when the queue is full instead of waiting. The
+	// websocket cannot be paused without the server disconnecting us; pull-based
+	// sources such as CT logs simply wait.
+	lossy bool
+}
+
+func newSourceRunner(source Source) *sourceRunner {
+	runner := &sourceRunner{source: source}
+	switch source.(type) {
+	case *WebSocketSource, *FailoverSource:
+		runner.lossy = true
+	}
+	return runner
+}
+
+// stats returns a snapshot of the runner's counters
+func (r *sourceRunner) stats() SourceStats {
+	stats := SourceStats{
+		Name:       r.source.Name(),
+		Received:   atomic.LoadUint64(&r.received),
+		Dropped:    atomic.LoadUint64(&r.dropped),
+		Heartbeats: atomic.LoadUint64(&r.heartbeats),
+		Restarts:   atomic.LoadUint64(&r.restarts),
+		Finished:   atomic.LoadUint32(&r.finished) == 1,
+		Health:     r.source.Health(),
+	}
+	if last := r.lastHeartbeat.Load(); last != 0 {
+		stats.LastHeartbeat = time.Unix(0, last)
+	}
+	return stats
+}
+
+// heartbeatSizeLimit bounds the messages inspected for heartbeats; real heartbeats are
+// about 60 bytes and certificate messages are far larger
+const heartbeatSizeLimit = 256
+
+// isHeartbeat reports whether a raw message is a heartbeat
+func isHeartbeat(data []byte) bool {
+	if len(data) > heartbeatSizeLimit || !bytes.Contains(data, []byte(`"heartbeat"`)) {
+		return false
+	}
+	var message struct {
+		MessageType string `json:"message_type"`
+	}
+	return json.Unmarshal(data, &message) == nil && message.MessageType == "heartbeat"
+}
+
+// failbackInterval is how often a failover source on a backup endpoint tries to
+// reconnect to a higher priority one
+const failbackInterval = time.Minute
+
+// FailoverSource is a Source reading from the first reachable of several websocket
+// endpoints, in priority order. While on a backup endpoint it periodically tries the
+// higher priority ones in the background and switches back once one accepts a connection.
+type FailoverSource struct {
+	urls     []string
+	sources  []*WebSocketSource
+	logger   Logger
+	current  atomic.Int32 // index of the endpoint in use, -1 while disconnected
+	lastTry  time.Time
+	probing  atomic.Bool
+	probes   sync.WaitGroup
+	failback chan int // a higher priority endpoint that is connected and ready
+	health   sourceHealth
+}
+
+// NewFailoverSource creates a failover source over the given websocket URLs, highest priority first
+func NewFailoverSource(urls []string) *FailoverSource {
+	s := &FailoverSource{
+		urls:     urls,
+		logger:   NewDefaultLogger(false),
+		failback: make(chan int, 1),
+	}
+	for _, url := range urls {
+		s.sources = append(s.sources, NewWebSocketSource(url))
+	}
+	s.current.Store(-1)
+	return s
+}
+
+// Name lists the endpoints in priority order
+func (s *FailoverSource) Name() string {
+	return "failover:" + strings.Join(s.urls, ",")
+}
+
+// SetLogger sets the logger used for connection messages
+func (s *FailoverSource) SetLogger(logger Logger) {
+	s.logger = logger
+	for _, source := range s.sources {
+		source.SetLogger(logger)
+	}
+}
+
+// Start connects to the highest priority endpoint that accepts a connection
+func (s *FailoverSource) Start(ctx context.Context) error {
+	var errs []error
+	for i, source := range s.sources {
+		if err := source.Start(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
+		}
+		if i > 0 {
+			s.logger.Info("Failing over to %s", source.Name())
+		}
+		s.use(i)
+		return nil
+	}
+	err := errors.Join(errs...)
+	s.health.failed(err)
+	return err
+}
+
+// Next reads from the endpoint in use, switching to a higher priority endpoint first
+// when one has become reachable
+func (s *FailoverSource) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case i := <-s.failback:
+		s.sources[s.current.Load()].Close()
+		s.logger.Info("Switching back to %s", s.sources[i].Name())
+		s.use(i)
+		s.probing.Store(false)
+	default:
+	}
+
+	current := int(s.current.Load())
+	if current > 0 && time.Since(s.lastTry) >= failbackInterval && !s.probing.Load() {
+		s.lastTry = time.Now()
+		s.probing.Store(true)
+		s.probes.Add(1)
+		go s.probe(ctx, current)
+	}
+
+	data, err := s.sources[current].Next(ctx)
+	if err != nil {
+		s.health.failed(err)
+		return nil, err
+	}
+	s.health.received()
+	return data, nil
+}
+
+// Close closes the endpoint in use and any connection a probe left behind
+func (s *FailoverSource) Close() error {
+	s.probes.Wait()
+	s.discardFailback()
+	current := s.current.Load()
+	s.current.Store(-1)
+	s.health.disconnected()
+	if current < 0 {
+		return nil
+	}
+	return s.sources[current].Close()
+}
+
+// Health reports the state of the endpoint in use
+func (s *FailoverSource) Health() SourceHealth {
+	health := s.health.get()
+	if current := s.current.Load(); current >= 0 {
+		health.Detail = "using " + s.urls[current]
+	}
+	return health
+}
+
+// use makes endpoint i the one in use
+func (s *FailoverSource) use(i int) {
+	s.current.Store(int32(i))
+	s.lastTry = time.Now()
+	s.health.connected()
+}
+
+// probe tries the endpoints ranked above current and hands the first one that
+// connects to Next
+func (s *FailoverSource) probe(ctx context.Context, current int) {
+	defer s.probes.Done()
+	for i := 0; i < current; i++ {
+		if err := s.sources[i].Start(ctx); err == nil {
+			// probing stays set until the connection is taken from the channel
+			s.failback <- i
+			return
+		}
+	}
+	s.probing.Store(false)
+}
+
+// discardFailback closes a connection made by a probe that was never switched to
+func (s *FailoverSource) discardFailback() {
+	select {
+	case i := <-s.failback:
+		s.sources[i].Close()
+		s.probing.Store(false)
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package certstream
+
+import "strings"
+
+// labelTrie indexes plain suffix patterns by their labels in reverse order
+// ("nhn.no" is stored as no -> nhn) so a domain is matched in one walk
+// regardless of the size of the watch list
+type labelTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	patterns []int // indexes of patterns ending at this node
+}
+
+// insert adds a plain domain pattern under the given index
+func (t *labelTrie) insert(domain string, index int) {
+	node := &t.root
+	rest := domain
+	for {
+		i := strings.LastIndexByte(rest, '.')
+		label := rest[i+1:]
+		if node.children == nil {
+			node.children = make(map[string]*trieNode)
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = &trieNode{}
+			node.children[label] = child
+		}
+		node = child
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+	node.patterns = append(node.patterns, index)
+}
+
+// lookup appends the indexes of all patterns that equal the domain or one of its parents
+func (t *labelTrie) lookup(domain string, hits []int) []int {
+	node := &t.root
+	rest := domain
+	for {
+		i := strings.LastIndexByte(rest, '.')
+		node = node.children[rest[i+1:]]
+		if node == nil {
+			return hits
+		}
+		hits = append(hits, node.patterns...)
+		if i < 0 {
+			return hits
+		}
+		rest = rest[:i]
+	}
+}
+
+// patternIndex finds the patterns matching a domain, using the label trie for plain
+// suffix patterns and checking globs and brand patterns one by one
+type patternIndex struct {
+	patterns []Pattern
+	trie     labelTrie
+	linear   []int
+}
+
+func newPatternIndex(patterns []Pattern) *patternIndex {
+	ix := &patternIndex{patterns: patterns}
+	for i, pattern := range patterns {
+		if pattern.IsGlob() || pattern.IsBrand() {
+			ix.linear = append(ix.linear, i)
+			continue
+		}
+		ix.trie.insert(pattern.Domain(), i)
+	}
+	return ix
+}
+
+// lookup appends the indexes of all patterns matching the domain
+func (ix *patternIndex) lookup(domain string, hits []int) []int {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return hits
+	}
+	hits = ix.trie.lookup(domain, hits)
+	for _, i := range ix.linear {
+		if ix.patterns[i].Match(domain) {
+			hits = append(hits, i)
+		}
+	}
+	return hits
+}
@@ -3,6 +3,7 @@ package certstream
 
 import (
 	"context"
+	"crypto/x509"
 	"time"
 )
 
@@ -53,9 +54,11 @@ type CertData struct {
 				Aggregated   string      `json:"aggregated"`
 				EmailAddress interface{} `json:"email_address"`
 			} `json:"issuer"`
-			IsCA bool `json:"is_ca"`
+			IsCA  bool   `json:"is_ca"`
+			AsDER string `json:"as_der,omitempty"` // Base64 DER encoding, from full-stream endpoints and CT logs
 		} `json:"leaf_cert"`
-		Seen   float64 `json:"seen"`
+		Chain  []ChainCert `json:"chain,omitempty"` // Issuing chain, only sent by full-stream endpoints
+		Seen   float64     `json:"seen"`
 		Source struct {
 			URL  string `json:"url"`
 			Name string `json:"name"`
@@ -63,38 +66,167 @@ type CertData struct {
 	} `json:"data"`
 }
 
+// ChainCert is a certificate of the issuing chain in full-stream messages, starting
+// with the issuer of the leaf
+type ChainCert struct {
+	Subject            CertName               `json:"subject"`
+	Issuer             CertName               `json:"issuer"`
+	Extensions         map[string]interface{} `json:"extensions"`
+	Fingerprint        string                 `json:"fingerprint"`
+	Sha1               string                 `json:"sha1"`
+	Sha256             string                 `json:"sha256"`
+	NotBefore          float64                `json:"not_before"`
+	NotAfter           float64                `json:"not_after"`
+	SerialNumber       string                 `json:"serial_number"`
+	SignatureAlgorithm string                 `json:"signature_algorithm"`
+	IsCA               bool                   `json:"is_ca"`
+	AsDER              string                 `json:"as_der,omitempty"` // Base64 DER encoding
+}
+
+// CertName is a subject or issuer name of a chain certificate. Attributes are null, a
+// string, or a list of strings.
+type CertName struct {
+	C            interface{} `json:"C"`
+	CN           string      `json:"CN"`
+	L            interface{} `json:"L"`
+	O            interface{} `json:"O"`
+	OU           interface{} `json:"OU"`
+	ST           interface{} `json:"ST"`
+	Aggregated   string      `json:"aggregated"`
+	EmailAddress interface{} `json:"email_address"`
+}
+
 // CertEvent represents a certificate event with additional metadata
 type CertEvent struct {
 	Certificate    CertData
 	Timestamp      time.Time
-	CertType       string // "NEW" or "RENEWAL"
-	MatchedDomains []string
+	CertType       string            // "NEW" or "RENEWAL", or a CertType* label with WithClassifier; empty for dns_entries messages, which carry no validity
+	X509           *x509.Certificate // Parsed leaf certificate; only set with WithParseDER when the message carries as_der
+	Chain          []ChainCert       // Issuing chain, leaf issuer first; only from full-stream endpoints
+	MatchedDomains []string          // Watch patterns that fired; rules appear as "regex:<name>", "keyword:<term>", "field:<rule>" or "filter:<expression>"
+	Matches        []Match           // Certificate domains that matched, with the pattern that fired
+}
+
+// MatchKind describes how a certificate domain matched
+type MatchKind string
+
+// Match kinds reported in Match.Kind
+const (
+	MatchKindExact     MatchKind = "exact"     // domain equals the watched domain
+	MatchKindSubdomain MatchKind = "subdomain" // domain is a subdomain of the watched domain
+	MatchKindPattern   MatchKind = "pattern"   // domain matched a glob pattern
+	MatchKindBrand     MatchKind = "brand"     // registrable name equals a watched brand label
+	MatchKindRegex     MatchKind = "regex"     // domain matched a regex rule
+	MatchKindKeyword   MatchKind = "keyword"   // a label of the domain contains a keyword rule's term
+	MatchKindField     MatchKind = "field"     // only a field rule fired; Domain is the certificate's primary domain
+	MatchKindFilter    MatchKind = "filter"    // only the filter expression decided; Domain is the certificate's primary domain
+	MatchKindLookalike MatchKind = "lookalike" // domain imitates a watched domain
+	MatchKindHomoglyph MatchKind = "homoglyph" // decoded IDN domain renders like a watched domain
+)
+
+// Match describes a certificate domain that triggered a watch pattern or rule
+type Match struct {
+	Domain            string    // Domain from the certificate
+	UnicodeDomain     string    // Decoded Unicode form when Domain contains punycode labels
+	RegistrableDomain string    // Registrable domain (eTLD+1) of Domain, for grouping
+	Pattern           string    // Watch pattern or expression that fired
+	Rule              string    // Name of the rule that fired, empty for watch patterns
+	Kind              MatchKind // How the domain matched
+	Score             float64   // Similarity to the watched domain, 1 for non-lookalike matches
+	Keys              []string  // Every watch entry and rule that fired for Domain, as listed in CertEvent.MatchedDomains; Key() comes first
+}
+
+// Key returns the watch entry or rule behind the match as it is listed in
+// CertEvent.MatchedDomains, e.g. "*.nhn.no" or "regex:phish"
+func (m Match) Key() string {
+	switch m.Kind {
+	case MatchKindRegex:
+		return "regex:" + m.Rule
+	case MatchKindField:
+		return fieldPrefix + m.Pattern
+	case MatchKindFilter:
+		return filterPrefix + m.Pattern
+	}
+	return m.Pattern
 }
 
+// RegexRule is a named RE2 expression matched against every certificate domain.
+// Domains are lowercased before matching.
+type RegexRule struct {
+	Name    string
+	Pattern string
+}
+
+// WebSocketMode selects how a monitor with several websocket endpoints uses them
+type WebSocketMode string
+
+// Websocket modes accepted by WithWebSocketMode
+const (
+	// WebSocketModeFailover reads from the first reachable endpoint in priority order,
+	// switching back to a higher priority endpoint once it is reachable again
+	WebSocketModeFailover WebSocketMode = "failover"
+	// WebSocketModeFanIn reads from all endpoints concurrently; certificates seen on
+	// more than one endpoint are reported once
+	WebSocketModeFanIn WebSocketMode = "fanin"
+)
+
 // MonitorStats provides counters and queue depths for monitoring throughput.
 type MonitorStats struct {
 	RawReceived    uint64
 	RawDropped     uint64
+	RawSpilled     uint64 // Raw messages written to the spill file, see BackpressureSpill
+	Processed      uint64 // Queued messages the workers are done with
 	PrefilterHits  uint64
 	PrefilterSkips uint64
 	CertsDecoded   uint64
+	Excluded       uint64
+	Duplicates     uint64 // Matched certificates suppressed as duplicates
 	EventsSent     uint64
 	EventsDropped  uint64
+	EventsSpilled  uint64 // Events written to the spill file, see BackpressureSpill
 	RawQueueLen    int
 	RawQueueCap    int
 	EventQueueLen  int
 	EventQueueCap  int
+	Sources        []SourceStats  // Per-source counters, in the order the sources were added
+	Handlers       []HandlerStats // Per-handler counters, in the order the handlers were registered
 }
 
 // Config holds the configuration for the certificate monitor
 type Config struct {
-	WebSocketURL        string          // URL of the CertStream service
-	Domains             []string        // Domains to monitor (empty means monitor all)
+	WebSocketURL        string          // URL of the CertStream service; empty disables the websocket
+	WebSocketURLs       []string        // Several CertStream endpoints, used instead of WebSocketURL; see WebSocketMode
+	WebSocketMode       WebSocketMode   // How several endpoints are used (default: failover)
+	CTLogs              []CTLog         // Certificate Transparency logs polled directly over RFC 6962
+	CTPollInterval      time.Duration   // Time between get-sth polls of each CT log (default: 10s)
+	CTBatchSize         int             // Entries requested per get-entries call (default: 256)
+	Sources             []Source        // Additional message sources, consumed next to the websocket and CT logs
+	ParseDER            bool            // Parse as_der into CertEvent.X509 for reported certificates
+	DedupKey            DedupKey        // Identity duplicate certificates are recognised by (default: DefaultDedupKey)
+	DedupTTL            time.Duration   // How long a certificate identity is remembered (default: 10m)
+	DedupSize           int             // Maximum number of remembered identities (default: 100000)
+	Classify            bool            // Label CertType by comparing certificates with those seen before, see Classifier
+	ClassifierState     string          // File the classifier history is loaded from and saved to; empty keeps it in memory
+	Checkpoints         Checkpoints     // Last processed certificate index per CT log to resume from, see Monitor.Checkpoints
+	CheckpointFile      string          // File checkpoints are loaded from and saved to
+	CheckpointGapLimit  int64           // Most entries backfilled per CT log when resuming (default: 100000)
+	Recorder            *Recorder       // Records every raw message from every source, see WithRecorder
+	Domains             []string        // Domains or glob patterns to monitor (empty means monitor all)
+	RegexRules          []RegexRule     // Named regular expressions matched against certificate domains
+	KeywordRules        []KeywordRule   // Terms matched anywhere inside certificate domain labels
+	FieldRules          []FieldRule     // Rules on certificate fields other than the domain list
+	FieldMode           FieldMode       // How field rules combine with the domain rules (default: and)
+	FilterExpression    string          // Boolean expression every reported certificate must satisfy, see FilterExpression
+	LookalikeThreshold  float64         // Minimum similarity score reported for lookalike patterns (default: 0.8)
+	HomoglyphMatching   bool            // Also match decoded IDN domains by their confusable skeleton
+	ExcludeRules        []ExcludeRule   // Rules suppressing known-good certificates after matching
 	Debug               bool            // Enable debug logging
 	ReconnectTimeout    time.Duration   // Base time to wait before reconnecting after a failure
 	MaxReconnectTimeout time.Duration   // Maximum reconnection timeout
 	DisableBackoff      bool            // Disable exponential backoff for immediate reconnection
 	BufferSize          int             // Size of the internal event buffer (default: 50000)
+	RawBackpressure     Backpressure    // What websocket sources do when the raw queue is full (default: drop-newest)
+	EventBackpressure   Backpressure    // What the workers do when the events channel is full (default: drop-newest)
 	WorkerCount         int             // Number of parallel workers for processing (default: 4)
 	Context             context.Context // Context to control the monitor
 }
@@ -109,13 +241,211 @@ func WithWebSocketURL(url string) Option {
 	}
 }
 
-// WithDomains sets the domains to monitor
+// WithWebSocketURLs sets several CertStream endpoints, highest priority first, replacing
+// WithWebSocketURL. See WithWebSocketMode for how they are used.
+func WithWebSocketURLs(urls ...string) Option {
+	return func(c *Config) {
+		c.WebSocketURLs = urls
+	}
+}
+
+// WithWebSocketMode sets how several websocket endpoints are used: failover (default)
+// or fan-in
+func WithWebSocketMode(mode WebSocketMode) Option {
+	return func(c *Config) {
+		c.WebSocketMode = mode
+	}
+}
+
+// WithCTLogs adds Certificate Transparency logs that are polled directly, next to or
+// instead of the websocket (see WithWebSocketURL). Entries from all sources share the
+// worker pool, watch list and rules. Invalid logs are logged and ignored.
+func WithCTLogs(logs ...CTLog) Option {
+	return func(c *Config) {
+		c.CTLogs = append(c.CTLogs, logs...)
+	}
+}
+
+// WithSource adds a message source, such as a replay of recorded messages or a custom
+// implementation. The websocket keeps running unless it is disabled with
+// WithWebSocketURL("").
+func WithSource(source Source) Option {
+	return func(c *Config) {
+		c.Sources = append(c.Sources, source)
+	}
+}
+
+// WithParseDER parses the DER certificate of every reported event that carries one
+// (full-stream endpoints and CT logs) into CertEvent.X509. The parsed validity then
+// replaces the JSON fields and decides CertType. Unmatched certificates are never parsed.
+func WithParseDER(enabled bool) Option {
+	return func(c *Config) {
+		c.ParseDER = enabled
+	}
+}
+
+// WithDedup sets the identity under which repeated certificates are suppressed, see
+// DedupKey. Without it certificates are deduplicated by DefaultDedupKey; DedupKeyNone
+// turns deduplication off.
+func WithDedup(key DedupKey) Option {
+	return func(c *Config) {
+		c.DedupKey = key
+	}
+}
+
+// WithDedupTTL sets how long a certificate identity is remembered
+func WithDedupTTL(ttl time.Duration) Option {
+	return func(c *Config) {
+		c.DedupTTL = ttl
+	}
+}
+
+// WithDedupSize sets the maximum number of remembered certificate identities; the
+// oldest are forgotten first
+func WithDedupSize(size int) Option {
+	return func(c *Config) {
+		c.DedupSize = size
+	}
+}
+
+// WithClassifier labels reported certificates NEW_DOMAIN, NEW_NAME, RENEWAL, REISSUE or
+// ISSUER_CHANGE by comparing them with the certificates reported before for the same
+// registrable domains, instead of guessing NEW or RENEWAL from the validity.
+func WithClassifier(enabled bool) Option {
+	return func(c *Config) {
+		c.Classify = enabled
+	}
+}
+
+// WithClassifierState keeps the classifier history in a file, so labels stay accurate
+// across restarts. The file is loaded by New and saved periodically and on Stop.
+func WithClassifierState(path string) Option {
+	return func(c *Config) {
+		c.ClassifierState = path
+	}
+}
+
+// WithRecorder records every raw message, heartbeats included, with its receive time
+// before any filtering. Replay the capture with NewReplaySource. The caller closes the
+// recorder after Stop.
+func WithRecorder(recorder *Recorder) Option {
+	return func(c *Config) {
+		c.Recorder = recorder
+	}
+}
+
+// WithCheckpoints resumes from checkpoints taken with Monitor.Checkpoints. CT logs
+// added with WithCTLogs continue after their checkpoint instead of at the tree head,
+// and the gap of every other checkpointed log is backfilled once by polling the log
+// directly, up to the gap limit (see WithCheckpointGapLimit).
+func WithCheckpoints(checkpoints Checkpoints) Option {
+	return func(c *Config) {
+		c.Checkpoints = checkpoints
+	}
+}
+
+// WithCheckpointFile keeps checkpoints in a file: they are loaded by New, resumed from
+// as with WithCheckpoints, and saved periodically and on Stop
+func WithCheckpointFile(path string) Option {
+	return func(c *Config) {
+		c.CheckpointFile = path
+	}
+}
+
+// WithCheckpointGapLimit sets the most entries backfilled per CT log when resuming;
+// older entries of a longer gap are skipped
+func WithCheckpointGapLimit(limit int64) Option {
+	return func(c *Config) {
+		c.CheckpointGapLimit = limit
+	}
+}
+
+// WithCTPollInterval sets how often each CT log is checked for a new tree head
+func WithCTPollInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.CTPollInterval = interval
+	}
+}
+
+// WithCTBatchSize sets how many entries are requested per get-entries call. Logs may
+// return fewer entries than requested; the poller continues from where they stopped.
+func WithCTBatchSize(size int) Option {
+	return func(c *Config) {
+		c.CTBatchSize = size
+	}
+}
+
+// WithDomains sets the domains to monitor.
+// Entries may be plain domains (matching the domain and its subdomains) or glob patterns, see Pattern.
 func WithDomains(domains []string) Option {
 	return func(c *Config) {
 		c.Domains = domains
 	}
 }
 
+// WithRegexRules sets named RE2 rules matched against every certificate domain.
+// Invalid rules are logged and ignored.
+func WithRegexRules(rules []RegexRule) Option {
+	return func(c *Config) {
+		c.RegexRules = rules
+	}
+}
+
+// WithKeywordRules sets terms matched as substrings of certificate domain labels.
+// Invalid rules are logged and ignored.
+func WithKeywordRules(rules []KeywordRule) Option {
+	return func(c *Config) {
+		c.KeywordRules = rules
+	}
+}
+
+// WithFieldRules sets rules on certificate fields such as issuer.o or san.email.
+// Invalid rules are logged and ignored.
+func WithFieldRules(rules []FieldRule) Option {
+	return func(c *Config) {
+		c.FieldRules = rules
+	}
+}
+
+// WithFieldMode sets how field rules combine with the domain rules, see FieldMode
+func WithFieldMode(mode FieldMode) Option {
+	return func(c *Config) {
+		c.FieldMode = mode
+	}
+}
+
+// WithFilterExpression sets a boolean expression that every reported certificate must
+// satisfy, on top of the other rules; on its own it selects certificates by itself.
+// An invalid expression is logged and ignored; use ParseFilterExpression to validate it first.
+func WithFilterExpression(expression string) Option {
+	return func(c *Config) {
+		c.FilterExpression = expression
+	}
+}
+
+// WithLookalikeThreshold sets the minimum similarity score (0-1) for lookalike matches
+func WithLookalikeThreshold(threshold float64) Option {
+	return func(c *Config) {
+		c.LookalikeThreshold = threshold
+	}
+}
+
+// WithHomoglyphMatching enables matching punycode domains against the watch list by
+// their Unicode confusable skeleton, see Skeleton
+func WithHomoglyphMatching(enabled bool) Option {
+	return func(c *Config) {
+		c.HomoglyphMatching = enabled
+	}
+}
+
+// WithExcludeRules sets rules that suppress known-good certificates after matching.
+// Rules with invalid domain patterns are logged and ignored.
+func WithExcludeRules(rules []ExcludeRule) Option {
+	return func(c *Config) {
+		c.ExcludeRules = rules
+	}
+}
+
 // WithDebug enables debug logging
 func WithDebug(debug bool) Option {
 	return func(c *Config) {
@@ -144,6 +474,24 @@ func WithDisableBackoff(disable bool) Option {
 	}
 }
 
+// WithRawBackpressure sets what happens to websocket messages arriving while the
+// workers are behind and the raw queue is full. CT log, replay and archive sources are
+// paused instead, as they lose nothing by waiting.
+func WithRawBackpressure(backpressure Backpressure) Option {
+	return func(c *Config) {
+		c.RawBackpressure = backpressure
+	}
+}
+
+// WithEventBackpressure sets what happens to events while the events channel is full
+// because the consumer is behind. Blocking holds up the workers, and with them the raw
+// queue.
+func WithEventBackpressure(backpressure Backpressure) Option {
+	return func(c *Config) {
+		c.EventBackpressure = backpressure
+	}
+}
+
 // WithBufferSize sets the internal event buffer size
 func WithBufferSize(size int) Option {
 	return func(c *Config) {
@@ -5,7 +5,8 @@ import (
 	"os"
 )
 
-// GetCertificateFromFile loads a certificate from a JSON file
+// GetCertificateFromFile loads a certificate from a JSON file. To stream many
+// certificates, or PEM, DER and CT log entry files, use NewArchiveSource.
 func GetCertificateFromFile(path string) (*CertData, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,167 @@
+package certstream
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// certDataFromX509 converts a parsed certificate into the CertStream message shape, so
+// certificates read from CT logs or files take the same path as websocket messages
+func certDataFromX509(cert *x509.Certificate, updateType string) CertData {
+	var data CertData
+	data.MessageType = "certificate_update"
+	data.Data.UpdateType = updateType
+	data.Data.Seen = float64(time.Now().Unix())
+
+	leaf := &data.Data.LeafCert
+	leaf.AllDomains = certDomains(cert)
+	leaf.Extensions.SubjectAltName = subjectAltNameText(cert)
+	leaf.Extensions.BasicConstraints = basicConstraintsText(cert)
+	leaf.Extensions.SubjectKeyIdentifier = colonHex(cert.SubjectKeyId)
+	leaf.Extensions.AuthorityKeyIdentifier = colonHex(cert.AuthorityKeyId)
+
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	leaf.Sha1 = colonHex(sha1Sum[:])
+	leaf.Fingerprint = leaf.Sha1
+	leaf.Sha256 = colonHex(sha256Sum[:])
+	leaf.NotBefore = float64(cert.NotBefore.Unix())
+	leaf.NotAfter = float64(cert.NotAfter.Unix())
+	leaf.SerialNumber = strings.ToUpper(cert.SerialNumber.Text(16))
+	leaf.SignatureAlgorithm = strings.ToLower(cert.SignatureAlgorithm.String())
+	leaf.IsCA = cert.IsCA
+	leaf.AsDER = base64.StdEncoding.EncodeToString(cert.Raw)
+
+	leaf.Subject.CN = cert.Subject.CommonName
+	leaf.Subject.C = nameValue(cert.Subject.Country)
+	leaf.Subject.O = nameValue(cert.Subject.Organization)
+	leaf.Subject.OU = nameValue(cert.Subject.OrganizationalUnit)
+	leaf.Subject.L = nameValue(cert.Subject.Locality)
+	leaf.Subject.ST = nameValue(cert.Subject.Province)
+	leaf.Subject.Aggregated = aggregatedName(cert.Subject)
+
+	leaf.Issuer.CN = cert.Issuer.CommonName
+	leaf.Issuer.C = strings.Join(cert.Issuer.Country, ", ")
+	leaf.Issuer.O = strings.Join(cert.Issuer.Organization, ", ")
+	leaf.Issuer.OU = nameValue(cert.Issuer.OrganizationalUnit)
+	leaf.Issuer.L = nameValue(cert.Issuer.Locality)
+	leaf.Issuer.ST = nameValue(cert.Issuer.Province)
+	leaf.Issuer.Aggregated = aggregatedName(cert.Issuer)
+	return data
+}
+
+// certDomains lists the subject common name (when it is not already a SAN) followed by
+// the DNS SANs, as CertStream's all_domains does
+func certDomains(cert *x509.Certificate) []string {
+	domains := make([]string, 0, len(cert.DNSNames)+1)
+	cn := cert.Subject.CommonName
+	if cn != "" && strings.Contains(cn, ".") && !strings.Contains(cn, " ") {
+		domains = append(domains, cn)
+	}
+	for _, name := range cert.DNSNames {
+		if name != cn {
+			domains = append(domains, name)
+		}
+	}
+	return domains
+}
+
+// subjectAltNameText renders the SAN extension in the OpenSSL style CertStream uses
+func subjectAltNameText(cert *x509.Certificate) string {
+	var entries []string
+	for _, name := range cert.DNSNames {
+		entries = append(entries, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		entries = append(entries, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		entries = append(entries, "IP Address:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		entries = append(entries, "URI:"+uri.String())
+	}
+	return strings.Join(entries, ", ")
+}
+
+// basicConstraintsText renders the basic constraints extension, or "" when absent
+func basicConstraintsText(cert *x509.Certificate) string {
+	if !cert.BasicConstraintsValid {
+		return ""
+	}
+	if cert.IsCA {
+		return "CA:TRUE"
+	}
+	return "CA:FALSE"
+}
+
+// nameValue mirrors CertStream's encoding of name attributes: null, a string, or a list
+func nameValue(values []string) interface{} {
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		return values[0]
+	}
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = v
+	}
+	return list
+}
+
+// aggregatedName renders a name as "/C=NO/O=Example/CN=www.example.no"
+func aggregatedName(name pkix.Name) string {
+	var b strings.Builder
+	add := func(key string, values []string) {
+		for _, v := range values {
+			b.WriteString("/" + key + "=" + v)
+		}
+	}
+	add("C", name.Country)
+	add("ST", name.Province)
+	add("L", name.Locality)
+	add("O", name.Organization)
+	add("OU", name.OrganizationalUnit)
+	if name.CommonName != "" {
+		add("CN", []string{name.CommonName})
+	}
+	return b.String()
+}
+
+// colonHex formats bytes as uppercase colon-separated hex, e.g. "AB:CD:EF"
+func colonHex(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	encoded := strings.ToUpper(hex.EncodeToString(b))
+	parts := make([]string, len(b))
+	for i := range parts {
+		parts[i] = encoded[2*i : 2*i+2]
+	}
+	return strings.Join(parts, ":")
+}
+
+// ErrNoDER is returned by CertData.ParseDER for messages without as_der
+var ErrNoDER = errors.New("message has no DER certificate")
+
+// ParseDER decodes and parses the leaf certificate's as_der field. Only full-stream
+// endpoints and CT log sources provide it.
+func (c *CertData) ParseDER() (*x509.Certificate, error) {
+	if c.Data.LeafCert.AsDER == "" {
+		return nil, ErrNoDER
+	}
+	der, err := base64.StdEncoding.DecodeString(c.Data.LeafCert.AsDER)
+	if err != nil {
+		return nil, fmt.Errorf("invalid as_der encoding: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
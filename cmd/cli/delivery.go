@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/queue"
+	"github.com/jonasbg/certstream-monitor/internal/routing"
+	"github.com/jonasbg/certstream-monitor/internal/webhook"
+)
+
+// Retry delays of a sink that rejects a queued notification
+const (
+	deliveryRetryMin = time.Second
+	deliveryRetryMax = time.Minute
+)
+
+// deliveryMaxAge is how long a notification is retried after it was queued; a sink
+// still rejecting it then moves it to its dead-letter queue
+const deliveryMaxAge = 24 * time.Hour
+
+// deadLetterSuffix is appended to a sink's queue directory for its dead-letter queue
+const deadLetterSuffix = ".dead"
+
+// queueDrainTimeout is how long shutdown waits for the sink queues to empty
+const queueDrainTimeout = 5 * time.Second
+
+// queuedNotification is a notification waiting in a sink's persistent queue
+type queuedNotification struct {
+	Event  certstream.CertEvent `json:"event"`
+	Domain string               `json:"domain"`
+	Queued time.Time            `json:"queued,omitempty"`
+}
+
+// sinkQueue delivers the notifications of one sink from its persistent queue in order,
+// retrying each until the sink accepts it. Notifications the sink refuses for good,
+// or still rejects when too old, are moved to a dead-letter queue next to it, where
+// they are kept for inspection. Notifications left over from an earlier run are
+// delivered first.
+type sinkQueue struct {
+	target       routing.Target
+	queue        *queue.Queue
+	dead         *queue.Queue
+	dropped      uint64
+	errors       uint64
+	deadLettered uint64 // notifications moved to the dead-letter queue
+}
+
+// openSinkQueues opens one queue per sink, in a directory below dir named after the
+// sink, and its dead-letter queue in the same directory name with deadLetterSuffix
+func openSinkQueues(dir string, targets []routing.Target, opts queue.Options) ([]*sinkQueue, error) {
+	owners := make(map[string]string, 2*len(targets))
+	for _, target := range targets {
+		name := queueDirName(target.Name)
+		for _, dirName := range []string{name, name + deadLetterSuffix} {
+			if owner, ok := owners[dirName]; ok {
+				return nil, fmt.Errorf("sinks %q and %q would share the queue directory %s", owner, target.Name, dirName)
+			}
+			owners[dirName] = target.Name
+		}
+	}
+
+	var queues []*sinkQueue
+	for _, target := range targets {
+		q, err := openSinkQueue(dir, target, opts)
+		if err != nil {
+			for _, opened := range queues {
+				opened.close()
+			}
+			return nil, err
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// openSinkQueue opens the queue and dead-letter queue of one sink
+func openSinkQueue(dir string, target routing.Target, opts queue.Options) (*sinkQueue, error) {
+	path := filepath.Join(dir, queueDirName(target.Name))
+	q, err := queue.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	dead, err := queue.Open(path+deadLetterSuffix, opts)
+	if err != nil {
+		q.Close()
+		return nil, err
+	}
+	if pending := q.Len(); pending > 0 {
+		log.Printf("Sink %s: %d queued notifications from the last run", target.Name, pending)
+	}
+	if kept := dead.Len(); kept > 0 {
+		log.Printf("Sink %s: %d notifications in the dead-letter queue %s", target.Name, kept, path+deadLetterSuffix)
+	}
+	return &sinkQueue{target: target, queue: q, dead: dead}, nil
+}
+
+// close closes the queue and the dead-letter queue
+func (s *sinkQueue) close() error {
+	return errors.Join(s.queue.Close(), s.dead.Close())
+}
+
+// queueDirName turns a sink name into a safe directory name
+func queueDirName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// enqueue appends a notification to the queue. The parsed certificate is not queued;
+// sinks only use the certificate fields of the message.
+func (s *sinkQueue) enqueue(event certstream.CertEvent, domain string) {
+	event.X509 = nil
+	data, err := json.Marshal(queuedNotification{Event: event, Domain: domain, Queued: time.Now().UTC()})
+	if err == nil {
+		err = s.queue.Append(data)
+	}
+	if err != nil {
+		dropped := atomic.AddUint64(&s.dropped, 1)
+		if dropped%1000 == 1 {
+			log.Printf("WARNING: Sink %s queue rejected a notification (total dropped: %d): %v", s.target.Name, dropped, err)
+		}
+	}
+}
+
+// run delivers queued notifications until the context ends
+func (s *sinkQueue) run(ctx context.Context) {
+	retry := deliveryRetryMin
+	for {
+		data, err := s.queue.Peek(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, queue.ErrClosed) {
+				log.Printf("WARNING: Sink %s queue stopped: %v", s.target.Name, err)
+			}
+			return
+		}
+
+		var notification queuedNotification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			s.deadLetter(data, "an unreadable queued notification", err)
+		} else if err := s.target.Sink.Send(ctx, notification.Event, notification.Domain); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			errCount := atomic.AddUint64(&s.errors, 1)
+			if reason := undeliverable(notification, err, time.Now()); reason != "" {
+				s.deadLetter(data, fmt.Sprintf("the notification for %s: %s", notification.Domain, reason), err)
+			} else {
+				if errCount == 1 || errCount%100 == 0 {
+					log.Printf("WARNING: Sink %s error, retrying in %v with %d queued (total errors: %d): %v", s.target.Name, retry, s.queue.Len(), errCount, err)
+				}
+				select {
+				case <-time.After(retry):
+				case <-ctx.Done():
+					return
+				}
+				retry = min(retry*2, deliveryRetryMax)
+				continue
+			}
+		}
+
+		retry = deliveryRetryMin
+		if err := s.queue.Ack(); err != nil {
+			log.Printf("WARNING: Sink %s queue stopped: %v", s.target.Name, err)
+			return
+		}
+	}
+}
+
+// deadLetter moves a queued notification, described by what, to the dead-letter
+// queue. One the dead-letter queue rejects as well is lost, which is always logged.
+func (s *sinkQueue) deadLetter(data []byte, what string, cause error) {
+	if err := s.dead.Append(data); err != nil {
+		log.Printf("WARNING: Sink %s: discarding %s, the dead-letter queue rejected it (%v): %v", s.target.Name, what, err, cause)
+		return
+	}
+	dead := atomic.AddUint64(&s.deadLettered, 1)
+	if dead == 1 || dead%100 == 0 {
+		log.Printf("WARNING: Sink %s: dead-lettering %s (total dead-lettered: %d): %v", s.target.Name, what, dead, cause)
+	}
+}
+
+// undeliverable says why a notification the sink rejected is not retried, or returns
+// "" to retry it
+func undeliverable(notification queuedNotification, err error, now time.Time) string {
+	var statusErr *webhook.StatusError
+	if errors.As(err, &statusErr) && statusErr.Permanent() {
+		return "the sink refused it"
+	}
+	if now.Sub(notification.Queued) > deliveryMaxAge {
+		return fmt.Sprintf("queued more than %v ago", deliveryMaxAge)
+	}
+	return ""
+}
+
+// runSinkQueues delivers from every queue until the context ends
+func runSinkQueues(ctx context.Context, queues []*sinkQueue) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		wg.Add(1)
+		go func(q *sinkQueue) {
+			defer wg.Done()
+			q.run(ctx)
+		}(q)
+	}
+	return &wg
+}
+
+// waitForSinkQueues waits until every queue is empty or the timeout passes
+func waitForSinkQueues(queues []*sinkQueue, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		empty := true
+		for _, q := range queues {
+			empty = empty && q.queue.Len() == 0
+		}
+		if empty {
+			return
+		}
+		time.Sleep(sourcesPollInterval)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/queue"
+	"github.com/jonasbg/certstream-monitor/internal/routing"
+	"github.com/jonasbg/certstream-monitor/internal/webhook"
+)
+
+func TestUndeliverable(t *testing.T) {
+	now := time.Now()
+	fresh := queuedNotification{Queued: now.Add(-time.Minute)}
+	old := queuedNotification{Queued: now.Add(-deliveryMaxAge - time.Minute)}
+
+	tests := []struct {
+		name         string
+		notification queuedNotification
+		err          error
+		retry        bool
+	}{
+		{"refused", fresh, &webhook.StatusError{StatusCode: http.StatusUnprocessableEntity}, false},
+		{"server error", fresh, &webhook.StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"unauthorized", fresh, &webhook.StatusError{StatusCode: http.StatusUnauthorized}, true},
+		{"network error", fresh, errors.New("connection refused"), true},
+		{"too old", old, errors.New("connection refused"), false},
+		{"too old server error", old, &webhook.StatusError{StatusCode: http.StatusBadGateway}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := undeliverable(tt.notification, tt.err, now)
+			if (reason == "") != tt.retry {
+				t.Errorf("undeliverable() = %q, want retry %v", reason, tt.retry)
+			}
+		})
+	}
+}
+
+func TestSinkQueueRun(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhook.Payload
+		json.NewDecoder(r.Body).Decode(&payload)
+		switch payload.Domain {
+		case "refused.nhn.no":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case "down.nhn.no":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			mu.Lock()
+			delivered = append(delivered, payload.Domain)
+			mu.Unlock()
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	targets := []routing.Target{{Name: "hook", Sink: webhook.NewClient(server.URL, "")}}
+	queues, err := openSinkQueues(dir, targets, queue.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := queues[0]
+	q.enqueue(certstream.CertEvent{}, "refused.nhn.no")
+	stale, _ := json.Marshal(queuedNotification{Domain: "down.nhn.no", Queued: time.Now().Add(-deliveryMaxAge - time.Hour)})
+	if err := q.queue.Append(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.queue.Append([]byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	q.enqueue(certstream.CertEvent{}, "www.nhn.no")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := runSinkQueues(ctx, queues)
+	waitForSinkQueues(queues, 5*time.Second)
+	cancel()
+	wg.Wait()
+
+	if q.queue.Len() != 0 {
+		t.Errorf("%d notifications still queued", q.queue.Len())
+	}
+	if strings.Join(delivered, ",") != "www.nhn.no" {
+		t.Errorf("delivered %v; want www.nhn.no", delivered)
+	}
+	if q.deadLettered != 3 || q.dead.Len() != 3 {
+		t.Errorf("dead-lettered %d, dead-letter queue holds %d; want 3 and 3", q.deadLettered, q.dead.Len())
+	}
+
+	// The dead-letter queue keeps the records as they were queued
+	data, err := q.dead.Peek(context.Background())
+	var notification queuedNotification
+	if err != nil || json.Unmarshal(data, &notification) != nil || notification.Domain != "refused.nhn.no" {
+		t.Errorf("first dead letter = %s, %v", data, err)
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dead letters survive a restart
+	queues, err = openSinkQueues(dir, targets, queue.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept := queues[0].dead.Len(); kept != 3 {
+		t.Errorf("%d dead letters after reopening; want 3", kept)
+	}
+	queues[0].close()
+}
+
+func TestOpenSinkQueuesCollisions(t *testing.T) {
+	tests := [][]string{
+		{"a/b", "a_b"},
+		{"web", "web.dead"},
+	}
+	for _, names := range tests {
+		var targets []routing.Target
+		for _, name := range names {
+			targets = append(targets, routing.Target{Name: name})
+		}
+		if _, err := openSinkQueues(t.TempDir(), targets, queue.Options{}); err == nil {
+			t.Errorf("sinks %v: expected a shared queue directory error", names)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -15,6 +16,7 @@ import (
 	"github.com/jonasbg/certstream-monitor/certstream"
 	"github.com/jonasbg/certstream-monitor/internal/config"
 	"github.com/jonasbg/certstream-monitor/internal/output"
+	"github.com/jonasbg/certstream-monitor/internal/routing"
 	"github.com/jonasbg/certstream-monitor/internal/webhook"
 )
 
@@ -22,6 +24,14 @@ import (
 func main() {
 	// Parse configuration from flags and environment
 	cfg := config.ParseFromFlags()
+	if cfg.PSLFile != "" {
+		if err := certstream.LoadPublicSuffixList(cfg.PSLFile); err != nil {
+			log.Fatalf("Failed to load public suffix list: %v", err)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
 
 	// Create output formatter
 	formatter := output.NewFormatter(cfg.URLsOnly, cfg.Verbose)
@@ -31,8 +41,14 @@ func main() {
 	if wsURL == "" {
 		wsURL = ""
 	}
+	switch cfg.Command {
+	case config.CommandReplay:
+		wsURL = "none (replaying " + cfg.CaptureFile + ")"
+	case config.CommandScan:
+		wsURL = "none (scanning " + strings.Join(cfg.ScanInputs, ", ") + ")"
+	}
 	formatter.PrintStartupInfo(
-		cfg.Domains,
+		cfg.WatchList(),
 		wsURL,
 		certstream.DefaultWebSocketURL,
 		cfg.WebhookURL,
@@ -45,32 +61,107 @@ func main() {
 		cfg.APIToken,
 	)
 
-	// Create webhook client if configured
-	var webhookClient *webhook.Client
+	// Route matches to the sinks from the routes file, or to the webhook when configured.
+	// Recorded input is only printed, so old certificates do not notify anyone again.
+	var router *routing.Router
 	var missingWebhook, missingAPIToken bool
-	if cfg.HasWebhook() {
-		webhookClient = webhook.NewClient(cfg.WebhookURL, cfg.APIToken)
-		if cfg.APIToken == "" {
-			missingAPIToken = true
+	switch {
+	case cfg.Offline():
+		if cfg.RoutesFile != "" || cfg.HasWebhook() {
+			log.Printf("Printing matches only: sinks are not notified about recorded input")
 		}
-	} else {
+	case cfg.RoutesFile != "":
+		routes, err := routing.LoadConfig(cfg.RoutesFile)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		if router, err = routing.New(routes); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		defer router.Close()
+	case cfg.HasWebhook():
+		router = routing.NewSingle("webhook", webhook.NewClient(cfg.WebhookURL, cfg.APIToken))
+		missingAPIToken = cfg.APIToken == ""
+	default:
 		missingWebhook = true
 	}
 
 	// Build monitor options
 	options := buildMonitorOptions(cfg)
+	excludeRules, err := cfg.LoadExcludeRules()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	keywordRules, err := cfg.LoadKeywordRules()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if len(keywordRules) > 0 {
+		options = append(options, certstream.WithKeywordRules(keywordRules))
+	}
+	fieldRules, err := cfg.LoadFieldRules()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if len(fieldRules) > 0 {
+		options = append(options, certstream.WithFieldRules(fieldRules), certstream.WithFieldMode(certstream.FieldMode(strings.ToLower(cfg.FieldMode))))
+	}
+	if cfg.HasFilterExpression() {
+		options = append(options, certstream.WithFilterExpression(cfg.FilterExpression))
+	}
+	if len(excludeRules) > 0 {
+		options = append(options, certstream.WithExcludeRules(excludeRules))
+	}
+
+	// The record command keeps every raw message for later replays
+	var recorder *certstream.Recorder
+	switch cfg.Command {
+	case config.CommandRecord:
+		if recorder, err = certstream.NewRecorder(cfg.CaptureFile); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		options = append(options, certstream.WithRecorder(recorder))
+		log.Printf("Recording raw messages to %s", cfg.CaptureFile)
+	case config.CommandReplay:
+		log.Printf("Replaying %s at speed %g", cfg.CaptureFile, cfg.ReplaySpeed)
+	}
+
+	rawBackpressure, eventBackpressure, outputBackpressure, err := cfg.LoadBackpressure()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	options = append(options,
+		certstream.WithRawBackpressure(rawBackpressure),
+		certstream.WithEventBackpressure(eventBackpressure),
+	)
 
 	// Create and start the monitor
 	monitor := certstream.New(options...)
 	monitor.Start()
 
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	go reloadDomains(reloadCtx, cfg, monitor)
+
 	eventQueueSize := minInt(cfg.BufferSize, 10000)
 	eventQueue := make(chan certstream.CertEvent, eventQueueSize)
 	var droppedEvents uint64
 
+	// With a queue directory, notifications wait on disk for sinks that are down
+	var sinkQueues []*sinkQueue
+	if router != nil && cfg.QueueDir != "" {
+		queueOptions, err := cfg.QueueOptions()
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		if sinkQueues, err = openSinkQueues(cfg.QueueDir, router.Targets(), queueOptions); err != nil {
+			log.Fatalf("Failed to open sink queues: %v", err)
+		}
+	}
+
 	var webhookDispatcher *webhookDispatcher
-	if webhookClient != nil {
-		webhookDispatcher = newWebhookDispatcher(context.Background(), webhookClient, maxInt(1, cfg.WorkerCount), eventQueueSize)
+	if router != nil {
+		webhookDispatcher = newWebhookDispatcher(context.Background(), router, maxInt(1, cfg.WorkerCount), eventQueueSize, sinkQueues)
 	}
 
 	var outputWG sync.WaitGroup
@@ -114,23 +205,52 @@ func main() {
 				eventRate := float64(current.EventsSent-prev.EventsSent) / intervalSeconds
 
 				log.Printf(
-					"Stats: raw=%d (+%.0f/s) dropped=%d rawQ=%d/%d decoded=%d (+%.0f/s) prefilter hit=%d skip=%d events=%d (+%.0f/s) evDrop=%d outQ=%d/%d outDrop=%d",
+					"Stats: raw=%d (+%.0f/s) dropped=%d spilled=%d rawQ=%d/%d decoded=%d (+%.0f/s) prefilter hit=%d skip=%d excluded=%d dup=%d events=%d (+%.0f/s) evDrop=%d evSpill=%d outQ=%d/%d outDrop=%d",
 					current.RawReceived,
 					rawRate,
 					current.RawDropped,
+					current.RawSpilled,
 					current.RawQueueLen,
 					current.RawQueueCap,
 					current.CertsDecoded,
 					decodeRate,
 					current.PrefilterHits,
 					current.PrefilterSkips,
+					current.Excluded,
+					current.Duplicates,
 					current.EventsSent,
 					eventRate,
 					current.EventsDropped,
+					current.EventsSpilled,
 					len(eventQueue),
 					cap(eventQueue),
 					currentOutputDropped,
 				)
+				if len(current.Sources) > 1 {
+					for _, source := range current.Sources {
+						log.Printf(
+							"  Source %s: raw=%d dropped=%d heartbeats=%d restarts=%d connected=%t %s",
+							source.Name,
+							source.Received,
+							source.Dropped,
+							source.Heartbeats,
+							source.Restarts,
+							source.Health.Connected,
+							source.Health.Detail,
+						)
+					}
+				}
+				for _, q := range sinkQueues {
+					log.Printf(
+						"  Sink %s: queued=%d bytes=%d errors=%d dropped=%d deadLettered=%d",
+						q.target.Name,
+						q.queue.Len(),
+						q.queue.Bytes(),
+						atomic.LoadUint64(&q.errors),
+						atomic.LoadUint64(&q.dropped),
+						atomic.LoadUint64(&q.deadLettered),
+					)
+				}
 
 				prev = current
 			}
@@ -141,32 +261,127 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// A replay or scan ends with its input
+	var inputDone <-chan struct{}
+	if cfg.Offline() {
+		inputDone = waitForSources(monitor)
+	}
+
+	shutdown := func() {
+		stopReload()
+		monitor.Stop()
+		// Hand over events reported before the workers stopped
+		for drained := false; !drained; {
+			select {
+			case event := <-monitor.Events():
+				eventQueue <- event
+			default:
+				drained = true
+			}
+		}
+		close(eventQueue)
+		outputWG.Wait()
+		if webhookDispatcher != nil {
+			webhookDispatcher.closeAndWait()
+		}
+		if recorder != nil {
+			if err := recorder.Close(); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+			log.Printf("Recorded %d messages to %s", recorder.Messages(), cfg.CaptureFile)
+		}
+	}
+
 	// Process certificates
 	for {
 		select {
 		case event := <-monitor.Events():
-			select {
-			case eventQueue <- event:
-			default:
-				dropped := atomic.AddUint64(&droppedEvents, 1)
+			if n := queueOutput(eventQueue, event, outputBackpressure); n > 0 {
+				dropped := atomic.AddUint64(&droppedEvents, n)
 				if dropped%1000 == 1 {
 					log.Printf("Output backlog, dropping events. Dropped: %d\n", dropped)
 				}
 			}
 
+		case <-inputDone:
+			stats := monitor.Stats()
+			shutdown()
+			log.Printf("Finished %s: %d messages, %d certificates, %d events", cfg.Command, stats.Processed, stats.CertsDecoded, stats.EventsSent)
+			return
+
 		case <-sigChan:
 			formatter.PrintShutdown()
-			monitor.Stop()
-			close(eventQueue)
-			outputWG.Wait()
-			if webhookDispatcher != nil {
-				webhookDispatcher.closeAndWait()
-			}
+			shutdown()
 			return
 		}
 	}
 }
 
+// queueOutput hands an event to the output, applying the output backpressure policy
+// while the output is behind. It returns the number of events dropped.
+func queueOutput(queue chan certstream.CertEvent, event certstream.CertEvent, backpressure certstream.Backpressure) uint64 {
+	select {
+	case queue <- event:
+		return 0
+	default:
+	}
+
+	switch backpressure.Policy {
+	case certstream.BackpressureDropOldest:
+		var dropped uint64
+		for {
+			select {
+			case <-queue:
+				dropped++
+			default:
+			}
+			select {
+			case queue <- event:
+				return dropped
+			default:
+			}
+		}
+	case certstream.BackpressureBlock:
+		if backpressure.Timeout == 0 {
+			queue <- event
+			return 0
+		}
+		timer := time.NewTimer(backpressure.Timeout)
+		defer timer.Stop()
+		select {
+		case queue <- event:
+			return 0
+		case <-timer.C:
+		}
+	}
+	return 1
+}
+
+// sourcesPollInterval is how often a replay or scan is checked for completion
+const sourcesPollInterval = 100 * time.Millisecond
+
+// waitForSources returns a channel closed once every source has finished and the
+// workers are done with every message
+func waitForSources(monitor *certstream.Monitor) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(sourcesPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			stats := monitor.Stats()
+			finished := true
+			for _, source := range stats.Sources {
+				finished = finished && source.Finished
+			}
+			if finished && stats.Processed == stats.RawReceived {
+				return
+			}
+		}
+	}()
+	return done
+}
+
 // buildMonitorOptions creates monitor options from configuration
 func buildMonitorOptions(cfg *config.CLIConfig) []certstream.Option {
 	options := []certstream.Option{
@@ -176,49 +391,202 @@ func buildMonitorOptions(cfg *config.CLIConfig) []certstream.Option {
 		certstream.WithDisableBackoff(cfg.NoBackoff),
 		certstream.WithBufferSize(cfg.BufferSize),
 		certstream.WithWorkerCount(cfg.WorkerCount),
+		certstream.WithLookalikeThreshold(cfg.LookalikeThreshold),
+		certstream.WithHomoglyphMatching(cfg.Homoglyphs),
+		certstream.WithParseDER(cfg.ParseDER),
 	}
 
 	if cfg.HasDomains() {
-		options = append(options, certstream.WithDomains(cfg.Domains))
+		domains, err := cfg.LoadDomains()
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		options = append(options, certstream.WithDomains(domains))
 	}
 
-	if cfg.WebSocketURL != "" {
-		options = append(options, certstream.WithWebSocketURL(cfg.WebSocketURL))
+	if cfg.HasRegexRules() {
+		options = append(options, certstream.WithRegexRules(cfg.RegexRules))
+	}
+
+	if cfg.Dedup != "" {
+		key, err := certstream.ParseDedupKey(cfg.Dedup)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		options = append(options, certstream.WithDedup(key))
+	}
+	if cfg.DedupTTLSec > 0 {
+		options = append(options, certstream.WithDedupTTL(cfg.DedupTTL()))
+	}
+
+	if cfg.Classify {
+		options = append(options, certstream.WithClassifier(true))
+	}
+
+	// Recorded input must not move the checkpoints or the classifier history of the
+	// live stream
+	if cfg.Classify && cfg.ClassifyState != "" && !cfg.Offline() {
+		options = append(options, certstream.WithClassifierState(cfg.ClassifyState))
+	}
+	if cfg.CheckpointFile != "" && !cfg.Offline() {
+		options = append(options, certstream.WithCheckpointFile(cfg.CheckpointFile))
+	}
+
+	switch urls := cfg.WebSocketURLs(); {
+	case cfg.CTOnly || cfg.Offline():
+		options = append(options, certstream.WithWebSocketURL(""))
+	case len(urls) > 1:
+		options = append(options,
+			certstream.WithWebSocketURLs(urls...),
+			certstream.WithWebSocketMode(certstream.WebSocketMode(strings.ToLower(cfg.WebSocketMode))),
+		)
+	case len(urls) == 1:
+		options = append(options, certstream.WithWebSocketURL(urls[0]))
+	}
+
+	ctLogs, err := cfg.LoadCTLogs()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if len(ctLogs) > 0 && !cfg.Offline() {
+		options = append(options, certstream.WithCTLogs(ctLogs...))
+	}
+
+	switch cfg.Command {
+	case config.CommandReplay:
+		options = append(options, certstream.WithSource(certstream.NewReplaySource(cfg.CaptureFile, cfg.ReplaySpeed)))
+	case config.CommandScan:
+		files, err := certstream.ListArchiveFiles(cfg.ScanInputs)
+		if err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		log.Printf("Scanning %d files", len(files))
+		for _, source := range certstream.NewArchiveSources(files, cfg.WorkerCount) {
+			options = append(options, certstream.WithSource(source))
+		}
+		// Report every certificate found, however many sources read the files
+		if cfg.Dedup == "" {
+			options = append(options, certstream.WithDedup(certstream.DedupKeyNone))
+		}
 	}
 
 	return options
 }
 
+// domainsFilePollInterval is how often the domains file is checked for changes
+const domainsFilePollInterval = 5 * time.Second
+
+// reloadDomains swaps in a fresh watch list on SIGHUP or when the domains file changes.
+// An invalid list is logged and the current one stays in place, as is an empty list
+// when the monitor started with watch entries: that is more likely a file caught
+// half-written than a wish to report every certificate. The file is reloaded once its
+// modification time has not changed for a poll interval.
+func reloadDomains(ctx context.Context, cfg *config.CLIConfig, monitor *certstream.Monitor) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	watching := len(monitor.Domains()) > 0
+
+	var poll <-chan time.Time
+	var lastModified, changed time.Time
+	if cfg.DomainsFile != "" {
+		if info, err := os.Stat(cfg.DomainsFile); err == nil {
+			lastModified = info.ModTime()
+		}
+		ticker := time.NewTicker(domainsFilePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading watch list")
+		case <-poll:
+			info, err := os.Stat(cfg.DomainsFile)
+			if err != nil || info.ModTime().Equal(lastModified) {
+				changed = time.Time{}
+				continue
+			}
+			if !info.ModTime().Equal(changed) {
+				// Still being written, or just saved; wait until it settles
+				changed = info.ModTime()
+				continue
+			}
+			lastModified, changed = changed, time.Time{}
+			log.Printf("Domains file %s changed, reloading watch list", cfg.DomainsFile)
+		}
+
+		domains, err := cfg.LoadDomains()
+		if err != nil {
+			log.Printf("WARNING: Keeping current watch list: %v", err)
+			continue
+		}
+		if len(domains) == 0 && watching {
+			log.Printf("WARNING: Keeping current watch list of %d patterns: the reloaded list is empty", len(monitor.Domains()))
+			continue
+		}
+		monitor.SetDomains(domains)
+		if len(domains) == 0 && !cfg.HasRegexRules() && !cfg.HasKeywordRules() && !cfg.HasFieldRules() && !cfg.HasFilterExpression() {
+			log.Printf("WARNING: Watch list is empty - all certificates will be reported")
+		} else {
+			log.Printf("Watch list reloaded: %d domain patterns", len(domains))
+		}
+	}
+}
+
 type webhookJob struct {
 	event  certstream.CertEvent
 	domain string
+	target routing.Target
 }
 
 type webhookDispatcher struct {
 	jobs    chan webhookJob
 	wg      sync.WaitGroup
-	client  *webhook.Client
+	router  *routing.Router
 	ctx     context.Context
 	dropped uint64
 	errors  uint64
+
+	// Persistent per-sink queues replacing jobs, when configured
+	queues      map[string]*sinkQueue
+	stopQueues  context.CancelFunc
+	queueRunner *sync.WaitGroup
 }
 
-func newWebhookDispatcher(ctx context.Context, client *webhook.Client, workers, queueSize int) *webhookDispatcher {
+// newWebhookDispatcher starts the workers sending notifications, or with sink queues
+// one sender per queue
+func newWebhookDispatcher(ctx context.Context, router *routing.Router, workers, queueSize int, queues []*sinkQueue) *webhookDispatcher {
 	dispatcher := &webhookDispatcher{
 		jobs:   make(chan webhookJob, queueSize),
-		client: client,
+		router: router,
 		ctx:    ctx,
 	}
 
+	if len(queues) > 0 {
+		dispatcher.queues = make(map[string]*sinkQueue, len(queues))
+		for _, q := range queues {
+			dispatcher.queues[q.target.Name] = q
+		}
+		var queueCtx context.Context
+		queueCtx, dispatcher.stopQueues = context.WithCancel(ctx)
+		dispatcher.queueRunner = runSinkQueues(queueCtx, queues)
+		return dispatcher
+	}
+
 	for i := 0; i < workers; i++ {
 		dispatcher.wg.Add(1)
 		go func() {
 			defer dispatcher.wg.Done()
 			for job := range dispatcher.jobs {
-				if err := dispatcher.client.Send(dispatcher.ctx, job.event, job.domain); err != nil {
+				if err := job.target.Sink.Send(dispatcher.ctx, job.event, job.domain); err != nil {
 					errCount := atomic.AddUint64(&dispatcher.errors, 1)
 					if errCount == 1 || errCount%100 == 0 {
-						log.Printf("WARNING: Webhook error (total errors: %d): %v", errCount, err)
+						log.Printf("WARNING: Sink %s error (total errors: %d): %v", job.target.Name, errCount, err)
 					}
 				}
 			}
@@ -228,27 +596,50 @@ func newWebhookDispatcher(ctx context.Context, client *webhook.Client, workers,
 	return dispatcher
 }
 
+// enqueue queues one job per match and sink, following the route of the rule that matched
 func (d *webhookDispatcher) enqueue(event certstream.CertEvent) {
-	for _, certDomain := range event.Certificate.Data.LeafCert.AllDomains {
-		for _, watchDomain := range event.MatchedDomains {
-			if certstream.IsDomainMatch(certDomain, watchDomain) {
-				select {
-				case d.jobs <- webhookJob{event: event, domain: certDomain}:
-				default:
-					dropped := atomic.AddUint64(&d.dropped, 1)
-					if dropped%1000 == 1 {
-						log.Printf("Webhook backlog, dropping notifications. Dropped: %d\n", dropped)
-					}
+	for _, match := range event.Matches {
+		for _, target := range d.router.Route(match) {
+			if d.queues != nil {
+				d.queues[target.Name].enqueue(event, match.Domain)
+				continue
+			}
+			select {
+			case d.jobs <- webhookJob{event: event, domain: match.Domain, target: target}:
+			default:
+				dropped := atomic.AddUint64(&d.dropped, 1)
+				if dropped%1000 == 1 {
+					log.Printf("Webhook backlog, dropping notifications. Dropped: %d\n", dropped)
 				}
-				break
 			}
 		}
 	}
 }
 
+// closeAndWait waits for queued notifications to be sent. Sink queues get a few seconds
+// to empty; what is left stays on disk for the next run.
 func (d *webhookDispatcher) closeAndWait() {
 	close(d.jobs)
 	d.wg.Wait()
+	if d.queues == nil {
+		return
+	}
+
+	queues := make([]*sinkQueue, 0, len(d.queues))
+	for _, q := range d.queues {
+		queues = append(queues, q)
+	}
+	waitForSinkQueues(queues, queueDrainTimeout)
+	d.stopQueues()
+	d.queueRunner.Wait()
+	for _, q := range queues {
+		if pending := q.queue.Len(); pending > 0 {
+			log.Printf("Sink %s: %d notifications stay queued for the next run", q.target.Name, pending)
+		}
+		if err := q.close(); err != nil {
+			log.Printf("WARNING: Sink %s: %v", q.target.Name, err)
+		}
+	}
 }
 
 func minInt(a, b int) int {
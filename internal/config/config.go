@@ -2,11 +2,17 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/queue"
 )
 
 // CLIConfig holds all configuration options for the CLI application
@@ -16,26 +22,77 @@ type CLIConfig struct {
 	URLsOnly bool
 
 	// Connection options
-	WebSocketURL           string
+	WebSocketURL           string // One URL, or several separated by commas or spaces
+	WebSocketMode          string
+	CTLogs                 []string
+	CTOnly                 bool
 	ReconnectTimeoutSec    int
 	MaxReconnectTimeoutSec int
 	NoBackoff              bool
 	BufferSize             int
 	WorkerCount            int
 	StatsIntervalSec       int
+	ParseDER               bool
+	Dedup                  string
+	DedupTTLSec            int
+	Classify               bool
+	ClassifyState          string
+	CheckpointFile         string
+	RawBackpressure        string
+	EventBackpressure      string
+	OutputBackpressure     string
+
+	// Subcommand, see Commands
+	Command     string
+	CaptureFile string
+	ReplaySpeed float64
+	ScanInputs  []string
 
 	// Domain filtering
-	Domains []string
+	Domains            []string
+	DomainsFile        string
+	RegexRules         []certstream.RegexRule
+	KeywordRules       []string
+	FieldRules         []string
+	FieldMode          string
+	FilterExpression   string
+	LookalikeThreshold float64
+	Homoglyphs         bool
+	PSLFile            string
+
+	// Exclusions
+	ExcludeRules []string
+	ExcludeFile  string
+	excludes     []certstream.ExcludeRule // parsed by the first LoadExcludeRules call
 
 	// Webhook options
 	WebhookURL string
 	APIToken   string
+	RoutesFile string
+
+	// Persistent delivery queue
+	QueueDir   string
+	QueueSync  string
+	QueueMaxMB int
 }
 
+// Subcommands given before the flags
+const (
+	CommandRecord = "record" // monitor as usual while recording every raw message to --capture
+	CommandReplay = "replay" // run a --capture file through the watch list instead of the websocket
+	CommandScan   = "scan"   // run archived certificates from --input files through the watch list
+)
+
 // ParseFromFlags parses command-line flags and environment variables
 func ParseFromFlags() *CLIConfig {
 	cfg := &CLIConfig{}
 
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == CommandRecord || args[0] == CommandReplay || args[0] == CommandScan) {
+		cfg.Command = args[0]
+		args = args[1:]
+	}
+
 	// Define flags
 	verbose := flag.Bool("v", false, "Enable verbose output")
 	veryVerbose := flag.Bool("verbose", false, "Enable verbose output")
@@ -46,8 +103,44 @@ func ParseFromFlags() *CLIConfig {
 	bufferSize := flag.Int("buffer-size", 50000, "Internal event buffer size for high-volume streams")
 	workerCount := flag.Int("workers", 4, "Number of parallel workers for processing messages")
 	statsInterval := flag.Int("stats-interval", 30, "Log processing stats every N seconds (0 to disable)")
+	lookalikeThreshold := flag.Float64("lookalike-threshold", certstream.DefaultLookalikeThreshold, "Minimum similarity score (0-1) for lookalike: watch entries")
+	homoglyphs := flag.Bool("homoglyphs", false, "Match punycode domains against the watch list by their Unicode confusable skeleton")
+	pslFile := flag.String("psl-file", "", "Public Suffix List file to use instead of the embedded snapshot")
+	routesFile := flag.String("routes", "", "JSON file routing matches to named webhook, file and stdout sinks")
+	domainsFile := flag.String("domains-file", "", "File with watch patterns, one per line; reloaded on change or SIGHUP")
+	excludeFile := flag.String("exclude-file", "", "File with exclude rules, one per line")
+	parseDER := flag.Bool("parse-der", false, "Parse the DER certificate of matched full-stream and CT log certificates")
+	dedup := flag.String("dedup", "", "Suppress repeated certificates by: serial_issuer, sha256, sans, or none to turn it off (default: serial_issuer)")
+	dedupTTL := flag.Int("dedup-ttl", 600, "Seconds a certificate is remembered for deduplication")
+	classify := flag.Bool("classify", false, "Label certificates NEW_DOMAIN, NEW_NAME, RENEWAL, REISSUE or ISSUER_CHANGE from previously seen ones")
+	classifyState := flag.String("classify-state", "", "File keeping the --classify history across restarts (implies --classify)")
+	captureFile := flag.String("capture", "", "Capture file written by the record command and read by the replay command")
+	replaySpeed := flag.Float64("speed", 1, "Replay speed: 1 for the original pace, 10 for ten times as fast, 0 for as fast as possible")
+	checkpointFile := flag.String("checkpoint-file", "", "File keeping the last processed entry per CT log, to backfill what was missed while stopped")
+	rawBackpressure := flag.String("raw-backpressure", "", "What to do with websocket messages when the workers fall behind: drop-newest, drop-oldest, 'block; timeout=5s' or 'spill; dir=/var/tmp; limit=1GB'")
+	eventBackpressure := flag.String("event-backpressure", "", "What to do with matches when the output falls behind: drop-newest, drop-oldest, block or spill (default: drop-newest, block for replay and scan)")
+	outputBackpressure := flag.String("output-backpressure", "", "What to do with matches when printing and sinks fall behind: drop-newest, drop-oldest or block (default: drop-newest, block for replay and scan)")
+	queueDir := flag.String("queue-dir", "", "Directory of persistent per-sink queues, so notifications survive sink outages and restarts")
+	queueSync := flag.String("queue-sync", "interval", "When queued notifications are flushed to disk: always, never, interval or an interval such as 200ms")
+	queueMaxMB := flag.Int("queue-max-mb", 0, "Most megabytes queued per sink before notifications are dropped (0 for no limit)")
+	websocketMode := flag.String("websocket-mode", "failover", "How several CERTSTREAM_URL endpoints are used: failover, fanin")
+	ctOnly := flag.Bool("ct-only", false, "Only poll the --ct-log logs, without connecting to the CertStream websocket")
+	var scanInputs stringList
+	flag.Var(&scanInputs, "input", "File or directory scanned by the scan command: NDJSON captures, CT log entries, PEM or DER certificates (repeatable)")
+	var ctLogs stringList
+	flag.Var(&ctLogs, "ct-log", "CT log to poll directly, such as 'https://ct.googleapis.com/logs/us1/argon2026h1/; name=argon; backfill=1000' (repeatable)")
+	var excludeRules stringList
+	flag.Var(&excludeRules, "exclude", "Exclude rule such as 'domain=www.nhn.no; issuer.o=Let's Encrypt' (repeatable)")
+	filterExpression := flag.String("filter", "", "Boolean filter expression, e.g. 'domain ~ \"*.nhn.no\" && san_count > 50'")
+	fieldMode := flag.String("field-mode", "and", "How --field rules combine with the domain rules: and, or")
+	var fieldRules stringList
+	flag.Var(&fieldRules, "field", "Certificate field rule such as 'issuer.o contains \"Sectigo\"' (repeatable)")
+	var keywordRules stringList
+	flag.Var(&keywordRules, "keyword", "Keyword rule such as 'helsenorge; boundaries=1; ignore=helsenorge.no' (repeatable)")
+	var regexRules stringList
+	flag.Var(&regexRules, "regex", "Regex watch rule as name=expression (repeatable)")
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	// Parse flags
 	cfg.Verbose = *verbose || *veryVerbose
@@ -58,14 +151,65 @@ func ParseFromFlags() *CLIConfig {
 	cfg.BufferSize = *bufferSize
 	cfg.WorkerCount = *workerCount
 	cfg.StatsIntervalSec = *statsInterval
+	cfg.ParseDER = *parseDER
+	cfg.Dedup = *dedup
+	cfg.DedupTTLSec = *dedupTTL
+	cfg.Classify = *classify
+	cfg.ClassifyState = *classifyState
+	cfg.CheckpointFile = *checkpointFile
+	cfg.RawBackpressure = *rawBackpressure
+	cfg.EventBackpressure = *eventBackpressure
+	cfg.OutputBackpressure = *outputBackpressure
+	cfg.QueueDir = *queueDir
+	cfg.QueueSync = *queueSync
+	cfg.QueueMaxMB = *queueMaxMB
+	cfg.CaptureFile = *captureFile
+	cfg.ReplaySpeed = *replaySpeed
+	cfg.ScanInputs = scanInputs
+	cfg.LookalikeThreshold = *lookalikeThreshold
+	cfg.Homoglyphs = *homoglyphs
+	cfg.PSLFile = *pslFile
 
 	// Parse domains from environment or command-line args
 	cfg.Domains = parseDomains(flag.Args())
+	cfg.RegexRules = parseRegexRules(regexRules)
+	cfg.KeywordRules = parseRuleList(keywordRules, "KEYWORD_RULES")
+	cfg.FieldRules = parseRuleList(fieldRules, "FIELD_RULES")
+	cfg.FieldMode = *fieldMode
+	cfg.FilterExpression = *filterExpression
+	cfg.ExcludeRules = parseRuleList(excludeRules, "EXCLUDE_RULES")
+	cfg.ExcludeFile = *excludeFile
+	cfg.DomainsFile = *domainsFile
+	cfg.RoutesFile = *routesFile
+	cfg.CTLogs = parseRuleList(ctLogs, "CT_LOGS")
+	cfg.CTOnly = *ctOnly
+	cfg.WebSocketMode = *websocketMode
 
 	// Parse environment variables
 	cfg.WebSocketURL = os.Getenv("CERTSTREAM_URL")
 	cfg.WebhookURL = os.Getenv("WEBHOOK_URL")
 	cfg.APIToken = os.Getenv("API_TOKEN")
+	if cfg.PSLFile == "" {
+		cfg.PSLFile = os.Getenv("PSL_FILE")
+	}
+	if cfg.ExcludeFile == "" {
+		cfg.ExcludeFile = os.Getenv("EXCLUDE_FILE")
+	}
+	if cfg.DomainsFile == "" {
+		cfg.DomainsFile = os.Getenv("DOMAINS_FILE")
+	}
+	if cfg.RoutesFile == "" {
+		cfg.RoutesFile = os.Getenv("ROUTES_FILE")
+	}
+	if cfg.FilterExpression == "" {
+		cfg.FilterExpression = os.Getenv("FILTER")
+	}
+	if modeEnv := os.Getenv("WEBSOCKET_MODE"); modeEnv != "" && !isFlagSet("websocket-mode") {
+		cfg.WebSocketMode = modeEnv
+	}
+	if modeEnv := os.Getenv("FIELD_MODE"); modeEnv != "" && !isFlagSet("field-mode") {
+		cfg.FieldMode = modeEnv
+	}
 
 	// Override with environment variables if set (env vars take precedence over defaults, but not over flags)
 	if os.Getenv("NO_BACKOFF") != "" {
@@ -81,6 +225,60 @@ func ParseFromFlags() *CLIConfig {
 			cfg.WorkerCount = count
 		}
 	}
+	if os.Getenv("CT_ONLY") != "" {
+		cfg.CTOnly = cfg.CTOnly || os.Getenv("CT_ONLY") == "true" || os.Getenv("CT_ONLY") == "1"
+	}
+	if os.Getenv("PARSE_DER") != "" {
+		cfg.ParseDER = cfg.ParseDER || os.Getenv("PARSE_DER") == "true" || os.Getenv("PARSE_DER") == "1"
+	}
+	if os.Getenv("HOMOGLYPHS") != "" {
+		cfg.Homoglyphs = cfg.Homoglyphs || os.Getenv("HOMOGLYPHS") == "true" || os.Getenv("HOMOGLYPHS") == "1"
+	}
+	if thresholdEnv := os.Getenv("LOOKALIKE_THRESHOLD"); thresholdEnv != "" && !isFlagSet("lookalike-threshold") {
+		if threshold, err := strconv.ParseFloat(thresholdEnv, 64); err == nil {
+			cfg.LookalikeThreshold = threshold
+		}
+	}
+	if cfg.Dedup == "" {
+		cfg.Dedup = os.Getenv("DEDUP")
+	}
+	if ttlEnv := os.Getenv("DEDUP_TTL"); ttlEnv != "" && !isFlagSet("dedup-ttl") {
+		if ttl := parseInt(ttlEnv, cfg.DedupTTLSec); ttl > 0 {
+			cfg.DedupTTLSec = ttl
+		}
+	}
+	if os.Getenv("CLASSIFY") != "" {
+		cfg.Classify = cfg.Classify || os.Getenv("CLASSIFY") == "true" || os.Getenv("CLASSIFY") == "1"
+	}
+	if cfg.ClassifyState == "" {
+		cfg.ClassifyState = os.Getenv("CLASSIFY_STATE")
+	}
+	if cfg.ClassifyState != "" {
+		cfg.Classify = true
+	}
+	if cfg.CheckpointFile == "" {
+		cfg.CheckpointFile = os.Getenv("CHECKPOINT_FILE")
+	}
+	if cfg.RawBackpressure == "" {
+		cfg.RawBackpressure = os.Getenv("RAW_BACKPRESSURE")
+	}
+	if cfg.EventBackpressure == "" {
+		cfg.EventBackpressure = os.Getenv("EVENT_BACKPRESSURE")
+	}
+	if cfg.OutputBackpressure == "" {
+		cfg.OutputBackpressure = os.Getenv("OUTPUT_BACKPRESSURE")
+	}
+	if cfg.QueueDir == "" {
+		cfg.QueueDir = os.Getenv("QUEUE_DIR")
+	}
+	if syncEnv := os.Getenv("QUEUE_SYNC"); syncEnv != "" && !isFlagSet("queue-sync") {
+		cfg.QueueSync = syncEnv
+	}
+	if maxEnv := os.Getenv("QUEUE_MAX_MB"); maxEnv != "" && !isFlagSet("queue-max-mb") {
+		if maxMB := parseInt(maxEnv, cfg.QueueMaxMB); maxMB >= 0 {
+			cfg.QueueMaxMB = maxMB
+		}
+	}
 	if statsEnv := os.Getenv("STATS_INTERVAL"); statsEnv != "" {
 		if interval := parseInt(statsEnv, cfg.StatsIntervalSec); interval >= 0 {
 			cfg.StatsIntervalSec = interval
@@ -107,6 +305,53 @@ func parseDomains(args []string) []string {
 	return domains
 }
 
+// parseRuleList returns the flag values, or the lines of the env var when no flags were given
+func parseRuleList(flagValues []string, envName string) []string {
+	entries := flagValues
+	if len(entries) == 0 {
+		if env := os.Getenv(envName); env != "" {
+			entries = strings.Split(env, "\n")
+		}
+	}
+
+	var rules []string
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			rules = append(rules, entry)
+		}
+	}
+	return rules
+}
+
+// regexRuleName is the syntax of a rule name before the = of a regex rule
+var regexRuleName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseRegexRules builds regex rules from --regex flags or the REGEX_RULES env var (one name=expression per line)
+func parseRegexRules(flagValues []string) []certstream.RegexRule {
+	var rules []certstream.RegexRule
+	for _, entry := range parseRuleList(flagValues, "REGEX_RULES") {
+		name, pattern, found := strings.Cut(entry, "=")
+		if name = strings.TrimSpace(name); !found || !regexRuleName.MatchString(name) {
+			// Without an explicit name the expression names itself, so an = inside an
+			// unnamed expression is left alone
+			name, pattern = entry, entry
+		}
+		rules = append(rules, certstream.RegexRule{Name: name, Pattern: pattern})
+	}
+	return rules
+}
+
+// isFlagSet reports whether a flag was passed explicitly on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // parseInt safely parses an integer from a string, returning defaultValue on error
 func parseInt(s string, defaultValue int) int {
 	if val, err := strconv.Atoi(s); err == nil {
@@ -131,6 +376,255 @@ func sanitizeDomains(input string) []string {
 	return domains
 }
 
+// Validate checks that the configured watch patterns and rules are well-formed
+func (c *CLIConfig) Validate() error {
+	if _, err := c.LoadDomains(); err != nil {
+		return err
+	}
+	for _, rule := range c.RegexRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("invalid regex rule: %w", err)
+		}
+	}
+	if _, err := c.LoadKeywordRules(); err != nil {
+		return err
+	}
+	if _, err := c.LoadFieldRules(); err != nil {
+		return err
+	}
+	if mode := strings.ToLower(c.FieldMode); mode != "" && mode != string(certstream.FieldModeAnd) && mode != string(certstream.FieldModeOr) {
+		return fmt.Errorf("field mode must be %q or %q, got %q", certstream.FieldModeAnd, certstream.FieldModeOr, c.FieldMode)
+	}
+	if c.FilterExpression != "" {
+		if _, err := certstream.ParseFilterExpression(c.FilterExpression); err != nil {
+			return fmt.Errorf("invalid filter expression: %w\n  %s\n  %s", err, c.FilterExpression, filterErrorMarker(err))
+		}
+	}
+	if _, err := c.LoadExcludeRules(); err != nil {
+		return err
+	}
+	if c.LookalikeThreshold < 0 || c.LookalikeThreshold > 1 {
+		return fmt.Errorf("lookalike threshold must be between 0 and 1, got %v", c.LookalikeThreshold)
+	}
+	if mode := strings.ToLower(c.WebSocketMode); mode != "" && mode != string(certstream.WebSocketModeFailover) && mode != string(certstream.WebSocketModeFanIn) {
+		return fmt.Errorf("websocket mode must be %q or %q, got %q", certstream.WebSocketModeFailover, certstream.WebSocketModeFanIn, c.WebSocketMode)
+	}
+	if c.Dedup != "" {
+		if _, err := certstream.ParseDedupKey(c.Dedup); err != nil {
+			return err
+		}
+	}
+	if _, err := c.LoadCTLogs(); err != nil {
+		return err
+	}
+	if c.CTOnly && len(c.CTLogs) == 0 {
+		return errors.New("--ct-only needs at least one --ct-log")
+	}
+	if (c.Command == CommandRecord || c.Command == CommandReplay) && c.CaptureFile == "" {
+		return fmt.Errorf("the %s command needs --capture", c.Command)
+	}
+	if c.Command == CommandScan && len(c.ScanInputs) == 0 {
+		return errors.New("the scan command needs at least one --input")
+	}
+	if c.ReplaySpeed < 0 {
+		return fmt.Errorf("replay speed must not be negative, got %v", c.ReplaySpeed)
+	}
+	if _, _, _, err := c.LoadBackpressure(); err != nil {
+		return err
+	}
+	if _, err := c.QueueOptions(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// QueueOptions returns the options of the persistent per-sink queues
+func (c *CLIConfig) QueueOptions() (queue.Options, error) {
+	policy, interval, err := queue.ParseSync(c.QueueSync)
+	if err != nil {
+		return queue.Options{}, fmt.Errorf("invalid queue sync: %w", err)
+	}
+	if c.QueueMaxMB < 0 {
+		return queue.Options{}, fmt.Errorf("queue size limit must not be negative, got %d", c.QueueMaxMB)
+	}
+	return queue.Options{Sync: policy, SyncInterval: interval, MaxBytes: int64(c.QueueMaxMB) << 20}, nil
+}
+
+// LoadBackpressure parses the backpressure policies of the raw queue, the events
+// channel and the output queue. The events channel and output queue of a replay or
+// scan block by default, as recorded input can wait.
+func (c *CLIConfig) LoadBackpressure() (raw, event, output certstream.Backpressure, err error) {
+	parse := func(value, stage string) (certstream.Backpressure, error) {
+		if value == "" {
+			if c.Offline() && stage != "raw" {
+				return certstream.Backpressure{Policy: certstream.BackpressureBlock}, nil
+			}
+			return certstream.Backpressure{Policy: certstream.BackpressureDropNewest}, nil
+		}
+		backpressure, err := certstream.ParseBackpressure(value)
+		if err != nil {
+			return certstream.Backpressure{}, fmt.Errorf("invalid %s backpressure: %w", stage, err)
+		}
+		return backpressure, nil
+	}
+
+	if raw, err = parse(c.RawBackpressure, "raw"); err != nil {
+		return
+	}
+	if event, err = parse(c.EventBackpressure, "event"); err != nil {
+		return
+	}
+	if output, err = parse(c.OutputBackpressure, "output"); err != nil {
+		return
+	}
+	if output.Policy == certstream.BackpressureSpill {
+		err = errors.New("invalid output backpressure: spill is only supported for the raw and event stages")
+	}
+	return
+}
+
+// LoadDomains returns the watch patterns from arguments or environment plus the domains
+// file, validating each one. Lines in the file that are empty or start with '#' are ignored.
+func (c *CLIConfig) LoadDomains() ([]string, error) {
+	domains := append([]string{}, c.Domains...)
+	if c.DomainsFile != "" {
+		lines, err := readRuleFile(c.DomainsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read domains file: %w", err)
+		}
+		domains = append(domains, lines...)
+	}
+
+	for _, domain := range domains {
+		if _, err := certstream.ParsePattern(domain); err != nil {
+			return nil, fmt.Errorf("invalid domain pattern: %w", err)
+		}
+	}
+	return domains, nil
+}
+
+// filterErrorMarker returns a caret under the column a filter error points at
+func filterErrorMarker(err error) string {
+	var filterErr *certstream.FilterError
+	if !errors.As(err, &filterErr) || filterErr.Column < 1 {
+		return ""
+	}
+	return strings.Repeat(" ", filterErr.Column-1) + "^"
+}
+
+// WebSocketURLs returns the configured websocket endpoints in priority order
+func (c *CLIConfig) WebSocketURLs() []string {
+	return sanitizeDomains(c.WebSocketURL)
+}
+
+// LoadCTLogs parses the CT logs to poll from flags or environment
+func (c *CLIConfig) LoadCTLogs() ([]certstream.CTLog, error) {
+	logs := make([]certstream.CTLog, 0, len(c.CTLogs))
+	for _, entry := range c.CTLogs {
+		log, err := certstream.ParseCTLog(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CT log: %w", err)
+		}
+		logs = append(logs, log)
+	}
+	return logs, nil
+}
+
+// LoadKeywordRules parses the keyword rules from flags or environment
+func (c *CLIConfig) LoadKeywordRules() ([]certstream.KeywordRule, error) {
+	rules := make([]certstream.KeywordRule, 0, len(c.KeywordRules))
+	for _, entry := range c.KeywordRules {
+		rule, err := certstream.ParseKeywordRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyword rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// LoadFieldRules parses the certificate field rules from flags or environment
+func (c *CLIConfig) LoadFieldRules() ([]certstream.FieldRule, error) {
+	rules := make([]certstream.FieldRule, 0, len(c.FieldRules))
+	for _, entry := range c.FieldRules {
+		rule, err := certstream.ParseFieldRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// LoadExcludeRules parses the exclude rules from flags or environment plus the exclude file.
+// Lines in the file that are empty or start with '#' are ignored. The file is read once;
+// later calls, such as the one after Validate, return the rules parsed then.
+func (c *CLIConfig) LoadExcludeRules() ([]certstream.ExcludeRule, error) {
+	if c.excludes != nil {
+		return c.excludes, nil
+	}
+	entries := append([]string{}, c.ExcludeRules...)
+	if c.ExcludeFile != "" {
+		lines, err := readRuleFile(c.ExcludeFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exclude file: %w", err)
+		}
+		entries = append(entries, lines...)
+	}
+
+	rules := make([]certstream.ExcludeRule, 0, len(entries))
+	for _, entry := range entries {
+		rule, err := certstream.ParseExcludeRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	c.excludes = rules
+	return rules, nil
+}
+
+// readRuleFile returns the non-empty lines of a file that are not '#' comments
+func readRuleFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// WatchList returns the configured watch patterns and rules for display
+func (c *CLIConfig) WatchList() []string {
+	watch, err := c.LoadDomains()
+	if err != nil {
+		watch = append([]string{}, c.Domains...)
+	}
+	for _, rule := range c.RegexRules {
+		watch = append(watch, "regex:"+rule.Name)
+	}
+	if keywords, err := c.LoadKeywordRules(); err == nil {
+		for _, rule := range keywords {
+			watch = append(watch, "keyword:"+strings.ToLower(rule.Term))
+		}
+	}
+	if fields, err := c.LoadFieldRules(); err == nil {
+		for _, rule := range fields {
+			watch = append(watch, "field:"+rule.String())
+		}
+	}
+	if c.FilterExpression != "" {
+		watch = append(watch, "filter:"+c.FilterExpression)
+	}
+	return watch
+}
+
 // ReconnectTimeout returns the reconnection timeout as a Duration
 func (c *CLIConfig) ReconnectTimeout() time.Duration {
 	return time.Duration(c.ReconnectTimeoutSec) * time.Second
@@ -146,12 +640,55 @@ func (c *CLIConfig) StatsInterval() time.Duration {
 	return time.Duration(c.StatsIntervalSec) * time.Second
 }
 
+// Offline reports whether the command runs over recorded input, a capture or archive,
+// instead of live sources
+func (c *CLIConfig) Offline() bool {
+	return c.Command == CommandReplay || c.Command == CommandScan
+}
+
+// DedupTTL returns the dedup window as a duration
+func (c *CLIConfig) DedupTTL() time.Duration {
+	return time.Duration(c.DedupTTLSec) * time.Second
+}
+
 // HasDomains returns true if domains are configured
 func (c *CLIConfig) HasDomains() bool {
-	return len(c.Domains) > 0
+	return len(c.Domains) > 0 || c.DomainsFile != ""
+}
+
+// HasRegexRules returns true if regex rules are configured
+func (c *CLIConfig) HasRegexRules() bool {
+	return len(c.RegexRules) > 0
+}
+
+// HasKeywordRules returns true if keyword rules are configured
+func (c *CLIConfig) HasKeywordRules() bool {
+	return len(c.KeywordRules) > 0
+}
+
+// HasFieldRules returns true if certificate field rules are configured
+func (c *CLIConfig) HasFieldRules() bool {
+	return len(c.FieldRules) > 0
+}
+
+// HasFilterExpression returns true if a filter expression is configured
+func (c *CLIConfig) HasFilterExpression() bool {
+	return c.FilterExpression != ""
 }
 
 // HasWebhook returns true if webhook is configured
 func (c *CLIConfig) HasWebhook() bool {
 	return c.WebhookURL != ""
 }
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
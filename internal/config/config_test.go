@@ -2,8 +2,13 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/queue"
 )
 
 func TestSanitizeDomains(t *testing.T) {
@@ -130,3 +135,294 @@ func TestParseDomains(t *testing.T) {
 		})
 	}
 }
+
+func TestCLIConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		wantErr bool
+	}{
+		{"plain domains", []string{"nhn.no", "example.com"}, false},
+		{"glob patterns", []string{"*.login.nhn.*", "vpn-*.example.com", "**.example.org"}, false},
+		{"empty label", []string{"nhn..no"}, true},
+		{"partial multi-label wildcard", []string{"a**.example.com"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CLIConfig{Domains: tt.domains}
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRegexRules(t *testing.T) {
+	originalEnv := os.Getenv("REGEX_RULES")
+	defer os.Setenv("REGEX_RULES", originalEnv)
+
+	os.Setenv("REGEX_RULES", "phish=^(secure|login)[-.].*nhn\n\n^vpn-")
+	rules := parseRegexRules(nil)
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].Name != "phish" || rules[0].Pattern != "^(secure|login)[-.].*nhn" {
+		t.Errorf("unexpected first rule: %+v", rules[0])
+	}
+	if rules[1].Name != "^vpn-" || rules[1].Pattern != "^vpn-" {
+		t.Errorf("unexpected second rule: %+v", rules[1])
+	}
+
+	rules = parseRegexRules([]string{"flag=example"})
+	if len(rules) != 1 || rules[0].Name != "flag" {
+		t.Errorf("flags should override env, got %+v", rules)
+	}
+
+	// An = inside an unnamed expression does not split it
+	rules = parseRegexRules([]string{`^a=b\.`, "login-2=^login="})
+	if rules[0].Name != `^a=b\.` || rules[0].Pattern != `^a=b\.` {
+		t.Errorf("unnamed expression with '=' parsed as %+v", rules[0])
+	}
+	if rules[1].Name != "login-2" || rules[1].Pattern != "^login=" {
+		t.Errorf("named expression parsed as %+v", rules[1])
+	}
+}
+
+func TestLoadExcludeRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exclude.txt")
+	content := "# known-good hosts\n\ndomain=www.nhn.no; issuer.o=Let's Encrypt\nsan_count>100\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &CLIConfig{ExcludeRules: []string{"issuer.cn=R11"}, ExcludeFile: path}
+	rules, err := cfg.LoadExcludeRules()
+	if err != nil {
+		t.Fatalf("LoadExcludeRules: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(rules))
+	}
+	if rules[0].IssuerCN != "R11" || rules[1].Domain != "www.nhn.no" || rules[2].MinSANs != 101 {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	// The rules validated are the rules used, even if the file changes in between
+	if err := os.WriteFile(path, []byte("bogus\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := cfg.LoadExcludeRules(); err != nil || len(again) != 3 {
+		t.Errorf("second LoadExcludeRules = %d rules, %v; want the 3 rules loaded first", len(again), err)
+	}
+
+	cfg = &CLIConfig{ExcludeRules: []string{"bogus"}}
+	if _, err := cfg.LoadExcludeRules(); err == nil {
+		t.Error("expected error for invalid rule")
+	}
+}
+
+func TestLoadDomains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	content := "# production\nnhn.no\n\n*.login.example.*\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &CLIConfig{Domains: []string{"example.org"}, DomainsFile: path}
+	domains, err := cfg.LoadDomains()
+	if err != nil {
+		t.Fatalf("LoadDomains: %v", err)
+	}
+	want := []string{"example.org", "nhn.no", "*.login.example.*"}
+	if len(domains) != len(want) {
+		t.Fatalf("LoadDomains() = %v; want %v", domains, want)
+	}
+	for i := range want {
+		if domains[i] != want[i] {
+			t.Errorf("domains[%d] = %q; want %q", i, domains[i], want[i])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("nhn..no\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.LoadDomains(); err == nil {
+		t.Error("expected error for invalid pattern in domains file")
+	}
+
+	cfg = &CLIConfig{DomainsFile: filepath.Join(t.TempDir(), "missing.txt")}
+	if _, err := cfg.LoadDomains(); err == nil {
+		t.Error("expected error for missing domains file")
+	}
+}
+
+func TestLoadKeywordRules(t *testing.T) {
+	cfg := &CLIConfig{KeywordRules: []string{"helsenorge; boundaries=1; ignore=helsenorge.no,*.nhn.no", "vipps"}}
+	rules, err := cfg.LoadKeywordRules()
+	if err != nil {
+		t.Fatalf("LoadKeywordRules: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if rules[0].Term != "helsenorge" || rules[0].MinBoundaries != 1 || len(rules[0].Ignore) != 2 || rules[1].Term != "vipps" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+
+	cfg = &CLIConfig{KeywordRules: []string{"helse.norge"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for keyword containing a dot")
+	}
+}
+
+func TestWebSocketURLs(t *testing.T) {
+	cfg := &CLIConfig{WebSocketURL: "ws://localhost:9999/, wss://certstream.calidog.io/", WebSocketMode: "FanIn"}
+	urls := cfg.WebSocketURLs()
+	if len(urls) != 2 || urls[0] != "ws://localhost:9999/" || urls[1] != "wss://certstream.calidog.io/" {
+		t.Errorf("WebSocketURLs() = %v", urls)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	cfg.WebSocketMode = "roundrobin"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown websocket mode")
+	}
+}
+
+func TestValidateDedup(t *testing.T) {
+	for _, key := range []string{"", "sha256", "Serial_Issuer", "sans", "none"} {
+		if err := (&CLIConfig{Dedup: key}).Validate(); err != nil {
+			t.Errorf("Validate(%q): %v", key, err)
+		}
+	}
+	if err := (&CLIConfig{Dedup: "fingerprint"}).Validate(); err == nil {
+		t.Error("expected error for unknown dedup key")
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	if err := (&CLIConfig{Command: CommandReplay, CaptureFile: "capture.ndjson.gz", ReplaySpeed: 10}).Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if err := (&CLIConfig{Command: CommandRecord}).Validate(); err == nil {
+		t.Error("expected error for record without --capture")
+	}
+	if err := (&CLIConfig{Command: CommandReplay, CaptureFile: "capture.ndjson.gz", ReplaySpeed: -1}).Validate(); err == nil {
+		t.Error("expected error for negative replay speed")
+	}
+	if err := (&CLIConfig{Command: CommandScan}).Validate(); err == nil {
+		t.Error("expected error for scan without --input")
+	}
+	if err := (&CLIConfig{Command: CommandScan, ScanInputs: []string{"archive/"}}).Validate(); err != nil {
+		t.Errorf("Validate scan: %v", err)
+	}
+}
+
+func TestLoadBackpressure(t *testing.T) {
+	raw, event, output, err := (&CLIConfig{RawBackpressure: "spill; limit=1GB", OutputBackpressure: "block; timeout=2s"}).LoadBackpressure()
+	if err != nil {
+		t.Fatalf("LoadBackpressure: %v", err)
+	}
+	if raw.Policy != certstream.BackpressureSpill || event.Policy != certstream.BackpressureDropNewest || output.Timeout != 2*time.Second {
+		t.Errorf("unexpected policies: %+v %+v %+v", raw, event, output)
+	}
+
+	// Recorded input waits rather than losing matches
+	_, event, output, err = (&CLIConfig{Command: CommandScan, ScanInputs: []string{"archive/"}}).LoadBackpressure()
+	if err != nil || event.Policy != certstream.BackpressureBlock || output.Policy != certstream.BackpressureBlock {
+		t.Errorf("scan defaults: %+v %+v %v", event, output, err)
+	}
+
+	for _, bad := range []*CLIConfig{
+		{RawBackpressure: "drop"},
+		{EventBackpressure: "block; timeout=soon"},
+		{OutputBackpressure: "spill"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestQueueOptions(t *testing.T) {
+	opts, err := (&CLIConfig{QueueSync: "200ms", QueueMaxMB: 512}).QueueOptions()
+	if err != nil {
+		t.Fatalf("QueueOptions: %v", err)
+	}
+	if opts.Sync != queue.SyncInterval || opts.SyncInterval != 200*time.Millisecond || opts.MaxBytes != 512<<20 {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+	for _, bad := range []*CLIConfig{{QueueSync: "sometimes"}, {QueueMaxMB: -1}} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestLoadCTLogs(t *testing.T) {
+	cfg := &CLIConfig{CTLogs: []string{"https://ct.googleapis.com/logs/us1/argon2026h1/; name=argon; backfill=1000", "https://oak.ct.letsencrypt.org/2026h1/"}, CTOnly: true}
+	logs, err := cfg.LoadCTLogs()
+	if err != nil {
+		t.Fatalf("LoadCTLogs: %v", err)
+	}
+	if len(logs) != 2 || logs[0].Name != "argon" || logs[0].Backfill != 1000 || logs[1].Name != "" {
+		t.Errorf("unexpected logs: %+v", logs)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	for _, bad := range []*CLIConfig{
+		{CTLogs: []string{"ct.googleapis.com/logs/us1/argon2026h1/"}},
+		{CTLogs: []string{"https://oak.ct.letsencrypt.org/2026h1/; backfill=-1"}},
+		{CTLogs: []string{"https://oak.ct.letsencrypt.org/2026h1/; start=0"}},
+		{CTOnly: true},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestLoadFieldRules(t *testing.T) {
+	cfg := &CLIConfig{FieldRules: []string{`issuer.o contains "Sectigo"`, "san.email suffix @nhn.no"}, FieldMode: "OR"}
+	rules, err := cfg.LoadFieldRules()
+	if err != nil {
+		t.Fatalf("LoadFieldRules: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Value != "Sectigo" || rules[1].Field != "san.email" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	cfg.FieldMode = "xor"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown field mode")
+	}
+	cfg = &CLIConfig{FieldRules: []string{"issuer.x contains a"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestValidateFilterExpression(t *testing.T) {
+	cfg := &CLIConfig{FilterExpression: `domain ~ "*.nhn.no" && san_count > 50`}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	cfg.FilterExpression = `domain ~ "*.nhn.no" && san_count > "50"`
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected error for mistyped filter expression")
+	}
+	want := "\n  " + cfg.FilterExpression + "\n  " + strings.Repeat(" ", 33) + "^"
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("Validate() error = %q; want it to end with a caret under column 34", err)
+	}
+}
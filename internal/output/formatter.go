@@ -2,8 +2,12 @@
 package output
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
@@ -38,7 +42,7 @@ func (f *Formatter) FormatEvent(event certstream.CertEvent) {
 
 	// Display all domains if no specific domains were matched
 	if len(event.MatchedDomains) == 0 {
-		f.formatUnfilteredDomains(cert, timestamp, event.CertType)
+		f.formatUnfilteredDomains(event, timestamp)
 		return
 	}
 
@@ -47,14 +51,15 @@ func (f *Formatter) FormatEvent(event certstream.CertEvent) {
 }
 
 // formatUnfilteredDomains formats output when no domain filtering is active
-func (f *Formatter) formatUnfilteredDomains(cert certstream.CertData, timestamp, certType string) {
+func (f *Formatter) formatUnfilteredDomains(event certstream.CertEvent, timestamp string) {
+	cert := event.Certificate
 	for i, domain := range cert.Data.LeafCert.AllDomains {
 		if f.urlsOnly {
 			fmt.Printf("%s\n", domain)
 		} else {
-			f.printDomainLine(domain, cert.Data.LeafCert.Subject.CN, timestamp, "")
+			f.printDomainLine(displayDomain(domain, certstream.ToUnicode(domain)), cert.Data.LeafCert.Subject.CN, timestamp, "", event.CertType)
 			if f.verbose {
-				f.printVerboseDetails(cert, certType)
+				f.printVerboseDetails(event)
 			}
 		}
 
@@ -72,32 +77,47 @@ func (f *Formatter) formatUnfilteredDomains(cert certstream.CertData, timestamp,
 
 // formatMatchedDomains formats output for matched domains
 func (f *Formatter) formatMatchedDomains(cert certstream.CertData, timestamp string, event certstream.CertEvent) {
-	for _, certDomain := range cert.Data.LeafCert.AllDomains {
-		for _, watchDomain := range event.MatchedDomains {
-			if certstream.IsDomainMatch(certDomain, watchDomain) {
-				if f.urlsOnly {
-					fmt.Printf("%s\n", certDomain)
-				} else {
-					matchedWith := ""
-					if f.verbose {
-						matchedWith = watchDomain
-					}
-					f.printDomainLine(certDomain, cert.Data.LeafCert.Subject.CN, timestamp, matchedWith)
-					if f.verbose {
-						f.printVerboseDetails(cert, event.CertType)
-					}
-				}
-				break
-			}
+	for _, match := range event.Matches {
+		if f.urlsOnly {
+			fmt.Printf("%s\n", match.Domain)
+			continue
+		}
+
+		matchedWith := ""
+		if f.verbose {
+			matchedWith = match.Pattern
+		}
+		// Lookalikes are not obvious from the domain alone, so always show what they imitate
+		if match.Kind == certstream.MatchKindLookalike {
+			matchedWith = fmt.Sprintf("%s, score %.2f", match.Pattern, match.Score)
+		}
+		// Field and filter matches are not about the domain at all
+		if match.Kind == certstream.MatchKindField || match.Kind == certstream.MatchKindFilter {
+			matchedWith = match.Pattern
 		}
+		f.printDomainLine(displayDomain(match.Domain, match.UnicodeDomain), cert.Data.LeafCert.Subject.CN, timestamp, matchedWith, event.CertType)
+		if f.verbose {
+			f.printVerboseDetails(event)
+		}
+	}
+}
+
+// displayDomain shows a punycode domain together with its decoded Unicode form
+func displayDomain(domain, unicodeDomain string) string {
+	if unicodeDomain == "" || unicodeDomain == domain {
+		return domain
 	}
+	return fmt.Sprintf("%s (%s)", domain, unicodeDomain)
 }
 
 // printDomainLine prints a single domain line with timestamp and common name
-func (f *Formatter) printDomainLine(domain, cn, timestamp, matchedWith string) {
+func (f *Formatter) printDomainLine(domain, cn, timestamp, matchedWith, certType string) {
 	fmt.Printf("[%s] %s - ", timestamp, domain)
 	f.domainColor.Printf("%s", cn)
 
+	if notableCertType(certType) {
+		f.warningColor.Printf(" [%s]", certType)
+	}
 	if matchedWith != "" {
 		f.warningColor.Printf(" (matched: %s)", matchedWith)
 	}
@@ -105,14 +125,60 @@ func (f *Formatter) printDomainLine(domain, cn, timestamp, matchedWith string) {
 	fmt.Println()
 }
 
+// notableCertType reports whether a classifier label deserves attention on the domain
+// line; renewals are the routine case
+func notableCertType(certType string) bool {
+	switch certType {
+	case certstream.CertTypeNewDomain, certstream.CertTypeNewName, certstream.CertTypeReissue, certstream.CertTypeIssuerChange:
+		return true
+	}
+	return false
+}
+
 // printVerboseDetails prints detailed certificate information
-func (f *Formatter) printVerboseDetails(cert certstream.CertData, certType string) {
+func (f *Formatter) printVerboseDetails(event certstream.CertEvent) {
+	cert := event.Certificate
+	// Domains-only endpoints send nothing but the domains
+	if cert.MessageType == "dns_entries" {
+		fmt.Printf("    Type: dns_entries (no certificate details)\n")
+		return
+	}
+
 	notBefore := time.Unix(int64(cert.Data.LeafCert.NotBefore), 0).Format("2006-01-02")
 	notAfter := time.Unix(int64(cert.Data.LeafCert.NotAfter), 0).Format("2006-01-02")
 
-	fmt.Printf("    Type: %s\n", certType)
+	fmt.Printf("    Type: %s\n", event.CertType)
 	fmt.Printf("    Issuer: %s\n", cert.Data.LeafCert.Issuer.O)
 	fmt.Printf("    Valid: %s -> %s\n", notBefore, notAfter)
+	if event.X509 != nil {
+		fmt.Printf("    Key: %s\n", keyDescription(event.X509))
+	}
+	if len(cert.Data.Chain) > 0 {
+		fmt.Printf("    Chain: %s\n", chainSummary(cert.Data.Chain))
+	}
+}
+
+// keyDescription describes the public key of a parsed certificate, e.g. "ECDSA P-256"
+func keyDescription(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// chainSummary lists the common names of the chain certificates, leaf issuer first
+func chainSummary(chain []certstream.ChainCert) string {
+	names := make([]string, len(chain))
+	for i, cert := range chain {
+		names[i] = cert.Subject.CN
+		if names[i] == "" {
+			names[i] = cert.Subject.Aggregated
+		}
+	}
+	return strings.Join(names, ", ")
 }
 
 // PrintStartupInfo prints comprehensive startup configuration
@@ -189,11 +255,38 @@ func (f *Formatter) printEnvVariables() {
 		mask   bool
 	}{
 		{"CERTSTREAM_URL", false},
+		{"WEBSOCKET_MODE", false},
+		{"CT_LOGS", false},
+		{"CT_ONLY", false},
 		{"WEBHOOK_URL", false},
 		{"API_TOKEN", true},
+		{"ROUTES_FILE", false},
 		{"TARGET_DOMAINS", false},
+		{"DOMAINS_FILE", false},
+		{"REGEX_RULES", false},
+		{"KEYWORD_RULES", false},
+		{"FIELD_RULES", false},
+		{"FIELD_MODE", false},
+		{"FILTER", false},
+		{"LOOKALIKE_THRESHOLD", false},
+		{"HOMOGLYPHS", false},
+		{"PSL_FILE", false},
+		{"EXCLUDE_RULES", false},
+		{"EXCLUDE_FILE", false},
+		{"PARSE_DER", false},
+		{"DEDUP", false},
+		{"DEDUP_TTL", false},
+		{"CLASSIFY", false},
+		{"CLASSIFY_STATE", false},
+		{"CHECKPOINT_FILE", false},
+		{"QUEUE_DIR", false},
+		{"QUEUE_SYNC", false},
+		{"QUEUE_MAX_MB", false},
 		{"NO_BACKOFF", false},
 		{"BUFFER_SIZE", false},
+		{"RAW_BACKPRESSURE", false},
+		{"EVENT_BACKPRESSURE", false},
+		{"OUTPUT_BACKPRESSURE", false},
 		{"WORKERS", false},
 		{"STATS_INTERVAL", false},
 	}
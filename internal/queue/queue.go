@@ -0,0 +1,553 @@
+// Package queue provides a persistent first-in, first-out queue of records kept in
+// append-only segment files, so queued notifications survive restarts and outages
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when appended records are flushed to stable storage
+type SyncPolicy string
+
+// Sync policies accepted in Options.Sync
+const (
+	SyncAlways   SyncPolicy = "always"   // fsync after every append and acknowledgement
+	SyncInterval SyncPolicy = "interval" // fsync every Options.SyncInterval (default)
+	SyncNever    SyncPolicy = "never"    // leave flushing to the operating system
+)
+
+// Defaults used for zero Options fields
+const (
+	DefaultSegmentSize  = 64 * 1024 * 1024
+	DefaultSyncInterval = time.Second
+)
+
+// Errors returned by the queue
+var (
+	ErrFull   = errors.New("queue is full")
+	ErrClosed = errors.New("queue is closed")
+)
+
+// recordHeaderSize is the length and CRC-32C prefix of every record
+const recordHeaderSize = 8
+
+// maxRecordSize bounds a record, so a corrupt length is not mistaken for a huge record
+const maxRecordSize = 64 * 1024 * 1024
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a queue
+type Options struct {
+	Sync         SyncPolicy    // When records are flushed to disk (default: interval)
+	SyncInterval time.Duration // Flush interval of SyncInterval (default: 1s)
+	SegmentSize  int64         // Size at which a new segment file is started (default: 64MB)
+	MaxBytes     int64         // Most bytes of unread records before Append fails with ErrFull; 0 for no limit
+}
+
+// ParseSync parses "always", "never", "interval" or a duration, which selects the
+// interval policy with that interval
+func ParseSync(s string) (SyncPolicy, time.Duration, error) {
+	switch policy := SyncPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case SyncAlways, SyncNever:
+		return policy, 0, nil
+	case SyncInterval, "":
+		return SyncInterval, DefaultSyncInterval, nil
+	}
+	interval, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || interval <= 0 {
+		return "", 0, fmt.Errorf("sync policy must be always, never, interval or a positive duration, got %q", s)
+	}
+	return SyncInterval, interval, nil
+}
+
+// segment is one file of the queue; segments are numbered in append order
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Queue is a persistent FIFO queue in a directory. Records are appended to the newest
+// segment file and read from the oldest; a cursor file remembers how far reading got,
+// and segments read completely are deleted. After a crash, records appended but not
+// yet flushed may be lost, a partly written record at the end is discarded, and
+// records read but not yet acknowledged are read again. Any number of goroutines may
+// append, but only one may read.
+type Queue struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	segments []segment // oldest first; the last one is written to
+	writer   *os.File  // the last segment
+	reader   *os.File  // the first segment
+	readOff  int64     // offset of the next record in the first segment
+	peeked   int64     // size of the record returned by Peek and not yet acknowledged, 0 if none
+	count    int       // records not yet acknowledged
+	dirty    bool      // appended data not yet synced
+	closed   bool
+	ready    chan struct{} // signalled after an append
+	done     chan struct{} // closed by Close
+	syncDone chan struct{} // closed when the sync loop has exited
+}
+
+// Open opens the queue in dir, creating the directory if needed, and recovers it:
+// segments are checked record by record and truncated at the first incomplete or
+// corrupt one.
+func Open(dir string, opts Options) (*Queue, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncInterval
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &Queue{dir: dir, opts: opts, ready: make(chan struct{}, 1), done: make(chan struct{}), syncDone: make(chan struct{})}
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, fmt.Errorf("queue %s: %w", dir, err)
+	}
+
+	if opts.Sync == SyncInterval {
+		go q.syncLoop()
+	} else {
+		close(q.syncDone)
+	}
+	return q, nil
+}
+
+// recover loads the segments and the cursor, validating every record, and saves the
+// cursor it settled on
+func (q *Queue) recover() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".seg")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, segment{seq: seq})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+
+	cursorSeq, cursorOff := q.loadCursor()
+	// Segments before the cursor were read completely but not yet deleted
+	for len(q.segments) > 0 && q.segments[0].seq < cursorSeq {
+		if err := os.Remove(q.segmentPath(q.segments[0].seq)); err != nil {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0].seq != cursorSeq {
+		cursorOff = 0
+	}
+
+	for i := range q.segments {
+		start := int64(0)
+		if i == 0 {
+			start = cursorOff
+		}
+		size, records, aligned, err := q.check(q.segments[i].seq, start)
+		if err != nil {
+			return err
+		}
+		if !aligned {
+			// The cursor does not point at a record; read the segment again from the start
+			cursorOff = 0
+			if size, records, _, err = q.check(q.segments[i].seq, 0); err != nil {
+				return err
+			}
+		}
+		q.segments[i].size = size
+		q.count += records
+	}
+	q.readOff = cursorOff
+
+	// A queue read completely starts over with an empty segment
+	if q.count == 0 && len(q.segments) > 0 {
+		last := q.segments[len(q.segments)-1].seq
+		for _, segment := range q.segments {
+			if err := os.Remove(q.segmentPath(segment.seq)); err != nil {
+				return err
+			}
+		}
+		q.segments, q.readOff, cursorSeq = nil, 0, last+1
+	}
+	if len(q.segments) == 0 {
+		q.segments = []segment{{seq: max(cursorSeq, 1)}}
+	}
+	if q.writer, err = os.OpenFile(q.segmentPath(q.segments[len(q.segments)-1].seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	if q.reader, err = os.Open(q.segmentPath(q.segments[0].seq)); err != nil {
+		return err
+	}
+	return q.saveCursor()
+}
+
+// check validates the records of a segment, truncating the file at the first invalid
+// one. It returns the valid size, the number of records at or after start and whether
+// a record starts at start.
+func (q *Queue) check(seq uint64, start int64) (int64, int, bool, error) {
+	file, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	offset, records, aligned := int64(0), 0, start == 0
+	for offset < info.Size() {
+		size, err := readRecordSize(file, offset)
+		if err != nil {
+			break
+		}
+		if offset >= start {
+			records++
+		}
+		offset += size
+		aligned = aligned || offset == start
+	}
+	if offset < info.Size() {
+		if err := file.Truncate(offset); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	return offset, records, aligned, nil
+}
+
+// readRecordSize validates the record at offset and returns its size including the header
+func readRecordSize(file *os.File, offset int64) (int64, error) {
+	data, err := readRecord(file, offset)
+	if err != nil {
+		return 0, err
+	}
+	return recordHeaderSize + int64(len(data)), nil
+}
+
+// readRecord reads and verifies the record at offset
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := file.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("record at %d: invalid length %d", offset, length)
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("record at %d: checksum mismatch", offset)
+	}
+	return data, nil
+}
+
+// Append adds a record to the end of the queue
+func (q *Queue) Append(data []byte) error {
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds the limit of %d", len(data), maxRecordSize)
+	}
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+	copy(record[recordHeaderSize:], data)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if q.opts.MaxBytes > 0 && q.bytes()+int64(len(record)) > q.opts.MaxBytes {
+		return ErrFull
+	}
+
+	last := &q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+int64(len(record)) > q.opts.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+	if _, err := q.writer.Write(record); err != nil {
+		// Drop whatever part of the record was written, so the segment stays valid
+		q.writer.Truncate(last.size)
+		return fmt.Errorf("failed to append to queue: %w", err)
+	}
+	last.size += int64(len(record))
+	q.count++
+	q.dirty = true
+	if q.opts.Sync == SyncAlways {
+		if err := q.sync(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate starts a new segment; q.mu must be held
+func (q *Queue) rotate() error {
+	if err := q.sync(); err != nil {
+		return err
+	}
+	seq := q.segments[len(q.segments)-1].seq + 1
+	writer, err := os.OpenFile(q.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %w", err)
+	}
+	if q.opts.Sync == SyncAlways {
+		syncDir(q.dir)
+	}
+	q.writer.Close()
+	q.writer = writer
+	q.segments = append(q.segments, segment{seq: seq})
+	return nil
+}
+
+// Peek returns the oldest record without removing it, waiting until there is one or
+// the context ends. Call Ack once the record was handled to move on to the next one.
+func (q *Queue) Peek(ctx context.Context) ([]byte, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if q.count > 0 {
+			data, err := q.peek()
+			q.mu.Unlock()
+			return data, err
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-q.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// peek reads the oldest record, moving on from segments read completely; q.mu must be held
+func (q *Queue) peek() ([]byte, error) {
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	data, err := readRecord(q.reader, q.readOff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+	q.peeked = recordHeaderSize + int64(len(data))
+	return data, nil
+}
+
+// compact deletes the oldest segments once they are read completely, keeping the one
+// being written; q.mu must be held
+func (q *Queue) compact() error {
+	for len(q.segments) > 1 && q.readOff >= q.segments[0].size {
+		q.reader.Close()
+		if err := os.Remove(q.segmentPath(q.segments[0].seq)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete queue segment: %w", err)
+		}
+		q.segments = q.segments[1:]
+		reader, err := os.Open(q.segmentPath(q.segments[0].seq))
+		if err != nil {
+			return fmt.Errorf("failed to open queue segment: %w", err)
+		}
+		q.reader, q.readOff = reader, 0
+		if err := q.saveCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ack removes the record returned by the last Peek
+func (q *Queue) Ack() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.peeked == 0 {
+		return errors.New("ack without peek")
+	}
+	q.readOff += q.peeked
+	q.peeked = 0
+	q.count--
+	if err := q.saveCursor(); err != nil {
+		return err
+	}
+	return q.compact()
+}
+
+// Len returns the number of records not yet acknowledged
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Bytes returns the size of the records not yet acknowledged
+func (q *Queue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes()
+}
+
+// bytes returns the unread size; q.mu must be held
+func (q *Queue) bytes() int64 {
+	total := -q.readOff
+	for _, segment := range q.segments {
+		total += segment.size
+	}
+	return total
+}
+
+// Close flushes the queue and closes its files. Peek returns ErrClosed afterwards.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	q.mu.Unlock()
+	<-q.syncDone
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.sync()
+	return errors.Join(err, q.closeFiles())
+}
+
+func (q *Queue) closeFiles() error {
+	var errs []error
+	if q.writer != nil {
+		errs = append(errs, q.writer.Close())
+	}
+	if q.reader != nil {
+		errs = append(errs, q.reader.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// syncLoop flushes appended records every sync interval until the queue is closed
+func (q *Queue) syncLoop() {
+	defer close(q.syncDone)
+	ticker := time.NewTicker(q.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			q.sync()
+			q.mu.Unlock()
+		}
+	}
+}
+
+// sync flushes the segment being written if it changed; q.mu must be held
+func (q *Queue) sync() error {
+	if !q.dirty || q.opts.Sync == SyncNever {
+		return nil
+	}
+	if err := q.writer.Sync(); err != nil {
+		return fmt.Errorf("failed to sync queue: %w", err)
+	}
+	q.dirty = false
+	return nil
+}
+
+// cursorFile holds the sequence number of the first segment and the read offset in it
+const cursorFile = "cursor"
+
+// loadCursor returns the saved read position, or the start of the queue
+func (q *Queue) loadCursor() (uint64, int64) {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0
+	}
+	seq, err1 := strconv.ParseUint(fields[0], 10, 64)
+	offset, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil || offset < 0 {
+		return 0, 0
+	}
+	return seq, offset
+}
+
+// saveCursor replaces the cursor file with the current read position; q.mu must be held
+func (q *Queue) saveCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d\n", q.segments[0].seq, q.readOff)
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to save queue cursor: %w", err)
+	}
+	_, err = io.WriteString(file, data)
+	if err == nil && q.opts.Sync == SyncAlways {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save queue cursor: %w", err)
+	}
+	return nil
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// syncDir flushes directory entries, so new files survive a crash
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func drain(t *testing.T, q *Queue, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []string
+	for i := 0; i < n; i++ {
+		data, err := q.Peek(ctx)
+		if err != nil {
+			t.Fatalf("Peek after %v: %v", records, err)
+		}
+		if err := q.Ack(); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		records = append(records, string(data))
+	}
+	return records
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := q.Append([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := drain(t, q, 2); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("read %v", got)
+	}
+	// Read but not acknowledged, so it is delivered again
+	if _, err := q.Peek(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Peek(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Peek after Close = %v; want ErrClosed", err)
+	}
+
+	q, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 3 {
+		t.Errorf("Len = %d; want 3", q.Len())
+	}
+	q.Append([]byte("6"))
+	if got := drain(t, q, 4); fmt.Sprint(got) != "[3 4 5 6]" {
+		t.Errorf("read %v after restart", got)
+	}
+
+	// Peek waits for the next append
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Append([]byte("7"))
+	}()
+	if got := drain(t, q, 1); got[0] != "7" {
+		t.Errorf("read %v", got)
+	}
+	if q.Len() != 0 || q.Bytes() != 0 {
+		t.Errorf("Len = %d, Bytes = %d after draining", q.Len(), q.Bytes())
+	}
+}
+
+func TestQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"first", "second", "third"} {
+		q.Append([]byte(record))
+	}
+	q.Close()
+
+	// A record torn by a crash is discarded
+	files := segmentFiles(t, dir)
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2, 3, 4, 'f', 'o'})
+	f.Close()
+
+	q, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 3 {
+		t.Fatalf("Len = %d after a torn write; want 3", q.Len())
+	}
+	q.Append([]byte("fourth"))
+	q.Close()
+
+	// A corrupt record cuts the segment off there
+	data, _ := os.ReadFile(files[0])
+	data[recordHeaderSize+len("first")+recordHeaderSize] ^= 0xff
+	os.WriteFile(files[0], data, 0o644)
+
+	q, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := drain(t, q, q.Len()); fmt.Sprint(got) != "[first]" {
+		t.Errorf("read %v after corruption; want [first]", got)
+	}
+}
+
+func TestQueueCompaction(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{SegmentSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		q.Append([]byte(fmt.Sprintf("record-%02d", i)))
+	}
+	if n := len(segmentFiles(t, dir)); n != 20 {
+		t.Fatalf("%d segment files; want one per record", n)
+	}
+	drain(t, q, 15)
+	q.Close()
+
+	q, err = Open(dir, Options{SegmentSize: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if got := drain(t, q, 5); got[0] != "record-15" || got[4] != "record-19" {
+		t.Errorf("read %v after reopening", got)
+	}
+	if n := len(segmentFiles(t, dir)); n != 1 {
+		t.Errorf("%d segment files after draining; want 1", n)
+	}
+
+	// A drained queue starts over with an empty segment
+	q.Close()
+	if q, err = Open(dir, Options{SegmentSize: 32}); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	files := segmentFiles(t, dir)
+	if info, err := os.Stat(files[0]); len(files) != 1 || err != nil || info.Size() != 0 {
+		t.Errorf("segments after reopening a drained queue: %v", files)
+	}
+	q.Append([]byte("next"))
+	if got := drain(t, q, 1); got[0] != "next" {
+		t.Errorf("read %v", got)
+	}
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	q, err := Open(t.TempDir(), Options{MaxBytes: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Append(make([]byte, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Append(make([]byte, 10)); !errors.Is(err, ErrFull) {
+		t.Errorf("Append beyond MaxBytes = %v; want ErrFull", err)
+	}
+	drain(t, q, 1)
+	if err := q.Append(make([]byte, 10)); err != nil {
+		t.Errorf("Append after draining: %v", err)
+	}
+}
+
+func TestParseSync(t *testing.T) {
+	tests := []struct {
+		input    string
+		policy   SyncPolicy
+		interval time.Duration
+	}{
+		{"always", SyncAlways, 0},
+		{"Never", SyncNever, 0},
+		{"", SyncInterval, DefaultSyncInterval},
+		{"250ms", SyncInterval, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		policy, interval, err := ParseSync(tt.input)
+		if err != nil || policy != tt.policy || interval != tt.interval {
+			t.Errorf("ParseSync(%q) = %s, %v, %v", tt.input, policy, interval, err)
+		}
+	}
+	for _, invalid := range []string{"sometimes", "-1s"} {
+		if _, _, err := ParseSync(invalid); err == nil {
+			t.Errorf("ParseSync(%q) succeeded", invalid)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package routing maps matched watch entries and rules to named notification sinks
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/webhook"
+)
+
+// Sink types accepted in SinkConfig.Type
+const (
+	SinkWebhook = "webhook"
+	SinkFile    = "file"
+	SinkStdout  = "stdout"
+)
+
+// rulePrefixes mark MatchedDomains entries that are rules rather than watch patterns
+var rulePrefixes = []string{"regex:", "keyword:", "field:", "filter:"}
+
+// SinkConfig describes one named destination
+type SinkConfig struct {
+	Type        string `json:"type"`
+	URL         string `json:"url,omitempty"`           // webhook endpoint
+	APIToken    string `json:"api_token,omitempty"`     // webhook token
+	APITokenEnv string `json:"api_token_env,omitempty"` // environment variable holding the webhook token
+	Path        string `json:"path,omitempty"`          // file to append NDJSON notifications to
+}
+
+// Route sends matches of the listed watch entries to the listed sinks. Entries are
+// written as they appear in CertEvent.MatchedDomains: watch patterns such as "nhn.no"
+// or "*.login.nhn.*", or rules such as "regex:phish" and "keyword:helsenorge".
+type Route struct {
+	Name  string   `json:"name,omitempty"`
+	Match []string `json:"match"`
+	Sinks []string `json:"sinks"`
+}
+
+// Config is the routes file: named sinks, routes and the sinks used when no route applies
+type Config struct {
+	Sinks   map[string]SinkConfig `json:"sinks"`
+	Routes  []Route               `json:"routes"`
+	Default []string              `json:"default,omitempty"`
+}
+
+// LoadConfig reads and validates a routes file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes file: %w", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("routes file %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("routes file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Validate checks that sinks are complete and that routes only reference known sinks
+func (c *Config) Validate() error {
+	for name, sink := range c.Sinks {
+		switch sink.Type {
+		case SinkWebhook:
+			if sink.URL == "" {
+				return fmt.Errorf("sink %q: webhook needs a url", name)
+			}
+		case SinkFile:
+			if sink.Path == "" {
+				return fmt.Errorf("sink %q: file needs a path", name)
+			}
+		case SinkStdout:
+		default:
+			return fmt.Errorf("sink %q: unknown type %q (supported: webhook, file, stdout)", name, sink.Type)
+		}
+	}
+
+	for i, route := range c.Routes {
+		label := route.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+		if len(route.Match) == 0 {
+			return fmt.Errorf("route %s has no match entries", label)
+		}
+		if len(route.Sinks) == 0 {
+			return fmt.Errorf("route %s has no sinks", label)
+		}
+		for _, entry := range route.Match {
+			if _, err := normalizeEntry(entry); err != nil {
+				return fmt.Errorf("route %s: %w", label, err)
+			}
+		}
+		if err := c.checkSinks(route.Sinks); err != nil {
+			return fmt.Errorf("route %s: %w", label, err)
+		}
+	}
+	if err := c.checkSinks(c.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	return nil
+}
+
+// checkSinks reports the first sink name that is not defined
+func (c *Config) checkSinks(names []string) error {
+	for _, name := range names {
+		if _, ok := c.Sinks[name]; !ok {
+			return fmt.Errorf("unknown sink %q", name)
+		}
+	}
+	return nil
+}
+
+// Target is a sink together with its name, for logging
+type Target struct {
+	Name string
+	Sink Sink
+}
+
+// Router picks the sinks for each match
+type Router struct {
+	routes   map[string][]Target // normalized match entry -> sinks
+	defaults []Target
+	closers  []*WriterSink
+}
+
+// New opens the configured sinks and builds a router
+func New(cfg *Config) (*Router, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &Router{routes: make(map[string][]Target)}
+	targets := make(map[string]Target, len(cfg.Sinks))
+	for name, sinkCfg := range cfg.Sinks {
+		sink, err := r.openSink(sinkCfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("sink %q: %w", name, err)
+		}
+		targets[name] = Target{Name: name, Sink: sink}
+	}
+
+	for _, route := range cfg.Routes {
+		for _, entry := range route.Match {
+			key, _ := normalizeEntry(entry)
+			for _, name := range route.Sinks {
+				r.routes[key] = appendTarget(r.routes[key], targets[name])
+			}
+		}
+	}
+	for _, name := range cfg.Default {
+		r.defaults = appendTarget(r.defaults, targets[name])
+	}
+	return r, nil
+}
+
+// NewSingle builds a router that sends every match to one sink, the behaviour without a routes file
+func NewSingle(name string, sink Sink) *Router {
+	return &Router{routes: map[string][]Target{}, defaults: []Target{{Name: name, Sink: sink}}}
+}
+
+// openSink creates the sink for a configuration entry
+func (r *Router) openSink(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case SinkWebhook:
+		token := cfg.APIToken
+		if cfg.APITokenEnv != "" {
+			token = os.Getenv(cfg.APITokenEnv)
+		}
+		return webhook.NewClient(cfg.URL, token), nil
+	case SinkFile:
+		sink, err := NewFileSink(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		r.closers = append(r.closers, sink)
+		return sink, nil
+	}
+	return NewWriterSink(os.Stdout), nil
+}
+
+// Route returns the sinks for a match: those of every route listing any watch entry or
+// rule that fired for the domain, once each, or the default sinks when no route does
+func (r *Router) Route(match certstream.Match) []Target {
+	keys := match.Keys
+	if len(keys) == 0 {
+		keys = []string{match.Key()}
+	}
+	var targets []Target
+	for _, key := range keys {
+		for _, target := range r.routes[normalizeKey(key)] {
+			targets = appendTarget(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return r.defaults
+	}
+	return targets
+}
+
+// Targets returns every sink the router may pick, once each, ordered by name
+func (r *Router) Targets() []Target {
+	var targets []Target
+	for _, routed := range r.routes {
+		for _, target := range routed {
+			targets = appendTarget(targets, target)
+		}
+	}
+	for _, target := range r.defaults {
+		targets = appendTarget(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets
+}
+
+// Empty reports whether the router can never deliver anything
+func (r *Router) Empty() bool {
+	return len(r.routes) == 0 && len(r.defaults) == 0
+}
+
+// Close closes file sinks
+func (r *Router) Close() error {
+	var errs []error
+	for _, sink := range r.closers {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// appendTarget adds a target unless a target with the same name is already present
+func appendTarget(targets []Target, target Target) []Target {
+	for _, existing := range targets {
+		if existing.Name == target.Name {
+			return targets
+		}
+	}
+	return append(targets, target)
+}
+
+// normalizeEntry returns the canonical form of a route match entry, validating watch patterns
+func normalizeEntry(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	for _, prefix := range rulePrefixes {
+		if strings.HasPrefix(entry, prefix) {
+			return normalizeKey(entry), nil
+		}
+	}
+	pattern, err := certstream.ParsePattern(entry)
+	if err != nil {
+		return "", err
+	}
+	return pattern.String(), nil
+}
+
+// normalizeKey returns the canonical form of a match key; keyword terms are case-insensitive
+func normalizeKey(key string) string {
+	if term, ok := strings.CutPrefix(key, "keyword:"); ok {
+		return "keyword:" + strings.ToLower(term)
+	}
+	for _, prefix := range rulePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return key
+		}
+	}
+	if pattern, err := certstream.ParsePattern(key); err == nil {
+		return pattern.String()
+	}
+	return key
+}
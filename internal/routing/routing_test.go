@@ -0,0 +1,139 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/webhook"
+)
+
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func targetNames(targets []Target) []string {
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Name
+	}
+	return names
+}
+
+func TestRouterRoute(t *testing.T) {
+	dir := t.TempDir()
+	path := writeRoutes(t, `{
+		"sinks": {
+			"security": {"type": "webhook", "url": "https://security.example.com/hook", "api_token_env": "SECURITY_TOKEN"},
+			"web": {"type": "file", "path": "`+filepath.Join(dir, "web.ndjson")+`"},
+			"console": {"type": "stdout"}
+		},
+		"routes": [
+			{"name": "web team", "match": ["*.login.NHN.*", "keyword:Helsenorge"], "sinks": ["web"]},
+			{"match": ["nhn.no", "regex:phish", "*.login.nhn.*"], "sinks": ["security", "web"]}
+		],
+		"default": ["console"]
+	}`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	router, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		match certstream.Match
+		want  string
+	}{
+		{certstream.Match{Domain: "www.login.nhn.no", Pattern: "*.login.nhn.*", Kind: certstream.MatchKindPattern}, "web,security"},
+		{certstream.Match{Domain: "www.nhn.no", Pattern: "nhn.no", Kind: certstream.MatchKindSubdomain}, "security,web"},
+		{certstream.Match{Domain: "login-nhn.com", Pattern: "^login", Rule: "phish", Kind: certstream.MatchKindRegex}, "security,web"},
+		{certstream.Match{Domain: "helsenorge-login.info", Pattern: "keyword:helsenorge", Rule: "helsenorge", Kind: certstream.MatchKindKeyword}, "web"},
+		{certstream.Match{Domain: "example.org", Pattern: "example.org", Kind: certstream.MatchKindExact}, "console"},
+		// Every entry that fired for the domain counts, each sink once
+		{certstream.Match{Domain: "helsenorge.login.nhn.no", Pattern: "*.login.nhn.*", Kind: certstream.MatchKindPattern,
+			Keys: []string{"*.login.nhn.*", "nhn.no", "keyword:helsenorge"}}, "web,security"},
+		{certstream.Match{Domain: "helsenorge.nhn.no", Pattern: "nhn.no", Kind: certstream.MatchKindSubdomain,
+			Keys: []string{"nhn.no", "keyword:helsenorge"}}, "security,web"},
+		{certstream.Match{Domain: "helsenorge.example.org", Pattern: "example.org", Kind: certstream.MatchKindSubdomain,
+			Keys: []string{"example.org", "keyword:helsenorge"}}, "web"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(targetNames(router.Route(tt.match)), ","); got != tt.want {
+			t.Errorf("Route(%s) = %s; want %s", tt.match.Key(), got, tt.want)
+		}
+	}
+	if got := strings.Join(targetNames(router.Targets()), ","); got != "console,security,web" {
+		t.Errorf("Targets = %s", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown sink type", `{"sinks": {"a": {"type": "email"}}}`},
+		{"webhook without url", `{"sinks": {"a": {"type": "webhook"}}}`},
+		{"file without path", `{"sinks": {"a": {"type": "file"}}}`},
+		{"unknown route sink", `{"sinks": {"a": {"type": "stdout"}}, "routes": [{"match": ["nhn.no"], "sinks": ["b"]}]}`},
+		{"unknown default sink", `{"sinks": {"a": {"type": "stdout"}}, "default": ["b"]}`},
+		{"invalid pattern", `{"sinks": {"a": {"type": "stdout"}}, "routes": [{"match": ["nhn..no"], "sinks": ["a"]}]}`},
+		{"route without match", `{"sinks": {"a": {"type": "stdout"}}, "routes": [{"sinks": ["a"]}]}`},
+		{"invalid json", `{"sinks": `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadConfig(writeRoutes(t, tt.content)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matches.ndjson")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+
+	event := certstream.CertEvent{Matches: []certstream.Match{{Domain: "www.nhn.no", Pattern: "nhn.no", Kind: certstream.MatchKindSubdomain}}}
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(context.Background(), event, "www.nhn.no"); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	var payload webhook.Payload
+	if err := json.Unmarshal([]byte(lines[0]), &payload); err != nil {
+		t.Fatalf("line is not a payload: %v", err)
+	}
+	if payload.Domain != "www.nhn.no" || payload.MatchedWith != "nhn.no" || payload.MatchKind != "subdomain" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+}
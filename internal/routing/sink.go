@@ -0,0 +1,64 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jonasbg/certstream-monitor/certstream"
+	"github.com/jonasbg/certstream-monitor/internal/webhook"
+)
+
+// Sink delivers a notification for one matched domain of a certificate event.
+// *webhook.Client satisfies it.
+type Sink interface {
+	Send(ctx context.Context, event certstream.CertEvent, matchedDomain string) error
+}
+
+// WriterSink writes each notification as one line of JSON, using the webhook payload format
+type WriterSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewWriterSink creates a sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewFileSink creates a sink appending to the file at path, creating it if needed
+func NewFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sink file: %w", err)
+	}
+	return &WriterSink{w: f, closer: f}, nil
+}
+
+// Send writes the notification
+func (s *WriterSink) Send(_ context.Context, event certstream.CertEvent, matchedDomain string) error {
+	line, err := json.Marshal(webhook.NewPayload(event, matchedDomain))
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(line); err != nil {
+		return fmt.Errorf("failed to write notification: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying file, if the sink opened one
+func (s *WriterSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
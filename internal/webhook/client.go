@@ -37,15 +37,19 @@ func NewClient(url, apiToken string) *Client {
 
 // Payload represents the data sent to the webhook endpoint
 type Payload struct {
-	Domain      string    `json:"domain"`
-	Timestamp   time.Time `json:"timestamp"`
-	CertType    string    `json:"cert_type"`
-	CommonName  string    `json:"common_name"`
-	Issuer      string    `json:"issuer"`
-	NotBefore   time.Time `json:"not_before"`
-	NotAfter    time.Time `json:"not_after"`
-	AllDomains  []string  `json:"all_domains"`
-	MatchedWith string    `json:"matched_with"`
+	Domain        string    `json:"domain"`
+	DomainUnicode string    `json:"domain_unicode,omitempty"`
+	Registrable   string    `json:"registrable_domain,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	CertType      string    `json:"cert_type"`
+	CommonName    string    `json:"common_name"`
+	Issuer        string    `json:"issuer"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	AllDomains    []string  `json:"all_domains"`
+	MatchedWith   string    `json:"matched_with"`
+	MatchKind     string    `json:"match_kind,omitempty"`
+	Score         float64   `json:"score,omitempty"`
 }
 
 // Send sends a certificate event to the configured webhook endpoint
@@ -75,24 +79,75 @@ func (c *Client) Send(ctx context.Context, event certstream.CertEvent, matchedDo
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("webhook returned non-success status: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	return nil
 }
 
+// StatusError is returned by Send when the endpoint answers with a non-success status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook returned non-success status: %d", e.StatusCode)
+}
+
+// Permanent reports whether sending the same notification again cannot succeed: the
+// endpoint refused the notification itself with a client error. Authentication
+// failures, a missing endpoint, timeouts and rate limits can be fixed without changing
+// the notification, so they are not permanent.
+func (e *StatusError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
 // buildPayload constructs the webhook payload from a certificate event
 func (c *Client) buildPayload(event certstream.CertEvent, matchedDomain string) Payload {
+	return NewPayload(event, matchedDomain)
+}
+
+// NewPayload builds the notification payload for one matched domain of an event. Other
+// sinks use it so every destination receives the same document.
+func NewPayload(event certstream.CertEvent, matchedDomain string) Payload {
+	matchedWith := matchedDomain
+	var matchKind string
+	var score float64
+	registrable := certstream.RegistrableDomain(matchedDomain)
+	for _, match := range event.Matches {
+		if match.Domain == matchedDomain {
+			matchedWith = match.Pattern
+			matchKind = string(match.Kind)
+			score = match.Score
+			registrable = match.RegistrableDomain
+			break
+		}
+	}
+
+	var domainUnicode string
+	if unicodeDomain := certstream.ToUnicode(matchedDomain); unicodeDomain != matchedDomain {
+		domainUnicode = unicodeDomain
+	}
+
 	return Payload{
-		Domain:      matchedDomain,
-		Timestamp:   event.Timestamp,
-		CertType:    event.CertType,
-		CommonName:  event.Certificate.Data.LeafCert.Subject.CN,
-		Issuer:      event.Certificate.Data.LeafCert.Issuer.O,
-		NotBefore:   time.Unix(int64(event.Certificate.Data.LeafCert.NotBefore), 0),
-		NotAfter:    time.Unix(int64(event.Certificate.Data.LeafCert.NotAfter), 0),
-		AllDomains:  event.Certificate.Data.LeafCert.AllDomains,
-		MatchedWith: matchedDomain,
+		Domain:        matchedDomain,
+		DomainUnicode: domainUnicode,
+		Registrable:   registrable,
+		Timestamp:     event.Timestamp,
+		CertType:      event.CertType,
+		CommonName:    event.Certificate.Data.LeafCert.Subject.CN,
+		Issuer:        event.Certificate.Data.LeafCert.Issuer.O,
+		NotBefore:     time.Unix(int64(event.Certificate.Data.LeafCert.NotBefore), 0),
+		NotAfter:      time.Unix(int64(event.Certificate.Data.LeafCert.NotAfter), 0),
+		AllDomains:    event.Certificate.Data.LeafCert.AllDomains,
+		MatchedWith:   matchedWith,
+		MatchKind:     matchKind,
+		Score:         score,
 	}
 }
 
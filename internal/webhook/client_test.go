@@ -3,6 +3,7 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -101,6 +102,28 @@ func TestClient_Send_ErrorResponse(t *testing.T) {
 	if err == nil {
 		t.Error("expected error for non-success status code")
 	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError || statusErr.Permanent() {
+		t.Errorf("expected a temporary StatusError with status 500, got %v", err)
+	}
+}
+
+func TestStatusError_Permanent(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusUnprocessableEntity: true,
+		http.StatusUnauthorized:        false,
+		http.StatusNotFound:            false,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	}
+	for status, want := range tests {
+		if got := (&StatusError{StatusCode: status}).Permanent(); got != want {
+			t.Errorf("Permanent() for %d = %v, want %v", status, got, want)
+		}
+	}
 }
 
 func TestClient_SetTimeout(t *testing.T) {
@@ -112,3 +135,24 @@ func TestClient_SetTimeout(t *testing.T) {
 		t.Errorf("expected timeout %v, got %v", newTimeout, client.timeout)
 	}
 }
+
+func TestClient_BuildPayloadUnicode(t *testing.T) {
+	client := NewClient("https://example.com", "")
+	event := certstream.CertEvent{
+		Matches: []certstream.Match{{
+			Domain:        "xn--nn-4wc.no",
+			UnicodeDomain: "nһn.no",
+			Pattern:       "nhn.no",
+			Kind:          certstream.MatchKindHomoglyph,
+			Score:         1,
+		}},
+	}
+
+	payload := client.buildPayload(event, "xn--nn-4wc.no")
+	if payload.Domain != "xn--nn-4wc.no" || payload.DomainUnicode != "nһn.no" {
+		t.Errorf("expected punycode and unicode domain, got %q and %q", payload.Domain, payload.DomainUnicode)
+	}
+	if payload.MatchedWith != "nhn.no" || payload.MatchKind != "homoglyph" {
+		t.Errorf("unexpected match details: %+v", payload)
+	}
+}